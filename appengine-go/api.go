@@ -9,8 +9,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
 	"strings"
@@ -41,6 +41,10 @@ func unsubTokenKey(email string) string {
 	return fmt.Sprintf("unsub_token:%s", email)
 }
 
+func undoDeleteTokenKey(email string) string {
+	return fmt.Sprintf("undo_delete_token:%s", email)
+}
+
 func generateUnsubToken() string {
 	p := make([]byte, 16)
 	if _, err := rand.Read(p); err != nil {
@@ -50,17 +54,77 @@ func generateUnsubToken() string {
 }
 
 type Account struct {
-	Connection *Connection     `json:"connection"`
-	Settings   AccountSettings `json:"settings"`
+	Connection *Connection      `json:"connection"`
+	Settings   AccountSettings  `json:"settings"`
+	Deletion   *PendingDeletion `json:"deletion"` // or nil
 }
 
 func (a *Account) connectionComplete() bool {
 	return a.Connection != nil
 }
 
+func (a *Account) pendingDeletion() bool {
+	return a.Deletion != nil
+}
+
+// PendingDeletion indicates that deletion of the account was requested. The
+// account's data is purged at the Purge time, unless deletion is undone
+// before then.
+type PendingDeletion struct {
+	Requested int64 `json:"requested"` // unix seconds
+	Purge     int64 `json:"purge"`     // unix seconds
+}
+
 type AccountSettings struct {
 	EmailsEnabled bool   `json:"emailsEnabled"`
 	EmailFormat   string `json:"emailFormat"` // EmailFormatHTML | EmailFormatText
+
+	// See BirthdayOptions.
+	MinPlayCount  int      `json:"minPlayCount"`
+	MinLovedCount int      `json:"minLovedCount"`
+	MaxItems      int      `json:"maxItems"` // 0 means no limit
+	SortMode      SortMode `json:"sortMode"` // or "" for SortMostPlayed, in older accounts
+
+	ExcludeCompilations bool `json:"excludeCompilations"` // exclude "Various Artists" compilations
+	YearReleases        bool `json:"yearReleases"`        // include year-precision releases on 1 January
+
+	LeapDay       LeapDayRule `json:"leapDay"`       // or "" for LeapDayNone, in older accounts
+	MonthReleases MonthRule   `json:"monthReleases"` // or "" for MonthFirstDay, in older accounts
+}
+
+// birthdayOptions returns the options for the library of the service.
+// Spotify provides neither play counts nor loved songs, so the minimum
+// counts, which would exclude every album, are ignored for Spotify.
+func (s AccountSettings) birthdayOptions(service Service) BirthdayOptions {
+	mode := s.SortMode
+	if mode == "" {
+		mode = SortMostPlayed
+	}
+	leapDay := s.LeapDay
+	if leapDay == "" {
+		// Older accounts keep the behavior from before the setting
+		// existed; new accounts default to LeapDayFeb28.
+		leapDay = LeapDayNone
+	}
+	month := s.MonthReleases
+	if month == "" {
+		month = MonthFirstDay
+	}
+	minPlayCount, minLovedCount := s.MinPlayCount, s.MinLovedCount
+	if service == Spotify {
+		minPlayCount, minLovedCount = 0, 0
+	}
+	return BirthdayOptions{
+		MinPlayCount:  minPlayCount,
+		MinLovedCount: minLovedCount,
+		MaxItems:      s.MaxItems,
+		Sort:          mode,
+
+		ExcludeCompilations: s.ExcludeCompilations,
+		MatchYear:           s.YearReleases,
+		LeapDay:             leapDay,
+		Month:               month,
+	}
 }
 
 const (
@@ -109,22 +173,60 @@ var AllServices = [...]Service{
 }
 
 func (s *Server) AccountHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	email := s.currentIdentity(r)
+	lg := loggerFrom(r.Context())
+
+	email := s.apiIdentity(r, ScopeAccountRead)
 	if email == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeUnauthorized(w)
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
-	accJSON, err := s.redis.Get(accountKey(email)).Bytes()
+	acc, err := getAccount(accountKey(email), s.redis)
 	if err == redis.Nil {
-		w.WriteHeader(http.StatusNotFound)
+		writeNotFound(w, "no such account")
 		return
 	} else if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("get account: %s", err)
+		writeInternalError(w)
 		return
 	}
 
-	w.Write(accJSON)
+	rspJSON := mustMarshalJSON(toAccountResponse(acc))
+	if checkNotModified(w, r, computeETag(string(rspJSON))) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(rspJSON)
+}
+
+// AccountResponse is an Account as returned by the API. Connection
+// credentials are omitted.
+type AccountResponse struct {
+	Connection *ConnectionResponse `json:"connection"` // or nil
+	Settings   AccountSettings     `json:"settings"`
+	Deletion   *PendingDeletion    `json:"deletion"` // or nil
+}
+
+type ConnectionResponse struct {
+	Service  Service        `json:"service"`
+	Username string         `json:"username,omitempty"`
+	Error    *ConnectionErr `json:"error"`
+}
+
+func toAccountResponse(a Account) AccountResponse {
+	ret := AccountResponse{
+		Settings: a.Settings,
+		Deletion: a.Deletion,
+	}
+	if a.Connection != nil {
+		ret.Connection = &ConnectionResponse{
+			Service:  a.Connection.Service,
+			Username: a.Connection.Username,
+			Error:    a.Connection.Error,
+		}
+	}
+	return ret
 }
 
 func generatePassphrase() string {
@@ -152,26 +254,29 @@ The code is below:
 var passphraseEmailTmpl = template.Must(template.New("passphrase email").Parse(passphraseEmailText))
 
 func (s *Server) PassphraseHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := r.FormValue("email")
 	if email == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(w, "email required")
 		return
 	}
 
 	if err := validateEmail(email); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(w, "bad email")
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
 	pass := generatePassphrase()
 	if err := s.redis.SAdd(passphraseKey(email), pass).Err(); err != nil {
-		log.Printf("SET passhrase: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("SET passhrase: %s", err)
+		writeInternalError(w)
 		return
 	}
 	if err := s.redis.Expire(passphraseKey(email), passphraseExpiry).Err(); err != nil {
-		log.Printf("EXPIRE passhrase: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("EXPIRE passhrase: %s", err)
+		writeInternalError(w)
 		return
 	}
 
@@ -183,88 +288,105 @@ func (s *Server) PassphraseHandler(w http.ResponseWriter, r *http.Request, _ htt
 		"Passphrase": pass,
 	})
 	if err != nil {
-		log.Printf("execute template: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("execute template: %s", err)
+		writeInternalError(w)
 		return
 	}
 
 	if err := s.email.Send([]string{email}, passphraseEmailSubject, buf.String(), "", nil); err != nil {
-		log.Printf("send passphrase email: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("send passphrase email: %s", err)
+		writeInternalError(w)
 		return
 	}
 }
 
 func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := r.FormValue("email")
 	if email == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(w, "email required")
 		return
 	}
 
 	passphrase := r.FormValue("passphrase")
 	if passphrase == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(w, "passphrase required")
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
 	passphraseSuccess, err := s.redis.SIsMember(passphraseKey(email), passphrase).Result()
 	if err != nil {
-		log.Printf("SISMEMBER passphrase: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("SISMEMBER passphrase: %s", err)
+		writeInternalError(w)
 		return
 	}
 	// check passphrase only in non-dev
 	if !isDev() {
 		if !passphraseSuccess {
-			w.WriteHeader(http.StatusForbidden) // bad passphrase
+			writeAPIError(w, http.StatusForbidden, APIError{Code: ErrCodeBadPassphrase, Message: "bad passphrase"})
 			return
 		}
 	}
 
 	// ensure Account
 	acc := Account{
-		nil,
-		AccountSettings{
+		Connection: nil,
+		Settings: AccountSettings{
 			EmailsEnabled: true,
 			EmailFormat:   EmailFormatHTML,
+			SortMode:      SortMostPlayed,
+			LeapDay:       LeapDayFeb28,
+			MonthReleases: MonthFirstDay,
 		},
+		Deletion: nil,
 	}
 	if err := s.redis.SetNX(accountKey(email), mustMarshalJSON(acc), 0).Err(); err != nil {
-		log.Printf("SETNX account: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("SETNX account: %s", err)
+		writeInternalError(w)
 		return
 	}
 
 	// ensure unsub token
 	if err := s.redis.SetNX(unsubTokenKey(email), generateUnsubToken(), 0).Err(); err != nil {
-		log.Printf("SETNX unsub token: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("SETNX unsub token: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	// logging in cancels a pending deletion
+	if err := s.cancelAccountDeletion(r.Context(), email); err != nil {
+		lg.Errorf("cancel account deletion: %s", err)
+		writeInternalError(w)
 		return
 	}
 
 	if err := s.redis.Del(passphraseKey(email)).Err(); err != nil {
-		log.Printf("DEL passphrase: %s", err) // only log
+		lg.Warningf("DEL passphrase: %s", err) // only log
 	}
 
 	if err := s.setIdentityCookie(w, r, email); err != nil {
-		log.Printf("set identity cookie: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("set identity cookie: %s", err)
+		writeInternalError(w)
 		return
 	}
 }
 
 func (s *Server) DeleteAccountConnectionHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := s.currentIdentity(r)
 	if email == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeUnauthorized(w)
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
 	acc, err := getAccount(accountKey(email), s.redis)
 	if err != nil {
-		log.Printf("get account: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("get account: %s", err)
+		writeInternalError(w)
 		return
 	}
 	if !acc.connectionComplete() {
@@ -272,9 +394,9 @@ func (s *Server) DeleteAccountConnectionHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	if err := s.redis.Del(libraryCacheKey(acc.Connection.Service, email)).Err(); err != nil {
-		log.Printf("DEL library cache: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := s.redis.Del(libraryCacheKey(acc.Connection.Service, email), spotifyLibraryKey(email)).Err(); err != nil {
+		lg.Errorf("DEL library cache: %s", err)
+		writeInternalError(w)
 		return
 	}
 
@@ -283,59 +405,92 @@ func (s *Server) DeleteAccountConnectionHandler(w http.ResponseWriter, r *http.R
 		a.Connection = nil
 		return a
 	}); err != nil {
-		log.Printf("update account: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("update account: %s", err)
+		writeInternalError(w)
 		return
 	}
 }
 
-func (s *Server) SetEmailsEnabledHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+const (
+	deleteAccountEmailSubject = "Account deletion scheduled"
+	deleteAccountEmailText    = `Hi,
+
+Deletion of the account for {{.Email}} in the “{{.AppName}}” app (https://{{.AppDomain}}) was requested. Album birthday emails for the account have been stopped.
+
+The account's data will be permanently deleted on {{.PurgeDate}}. If you did not mean to delete your account, you can undo the deletion before then by visiting:
+
+{{.UndoURL}}
+
+Logging in again before then will also undo the deletion.
+`
+)
+
+var deleteAccountEmailTmpl = template.Must(template.New("delete account email").Parse(deleteAccountEmailText))
+
+func (s *Server) DeleteAccountHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := s.currentIdentity(r)
 	if email == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeUnauthorized(w)
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
-	var b bool
-	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
-		log.Printf("json-decode body: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	now := time.Now()
+	deletion := PendingDeletion{
+		Requested: now.Unix(),
+		Purge:     now.Add(s.config.DeletionGracePeriod).Unix(),
 	}
 
-	if err := UpdateEntity(s.redis, accountKey(email), &Account{}, func(v interface{}) interface{} {
+	err := UpdateEntity(s.redis, accountKey(email), &Account{}, func(v interface{}) interface{} {
 		a := v.(*Account)
-		a.Settings.EmailsEnabled = b
+		if a.Deletion == nil {
+			a.Deletion = &deletion
+		} else {
+			deletion = *a.Deletion // already pending; keep original schedule
+		}
 		return a
-	}); err != nil {
-		log.Printf("update account: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if err == redis.Nil {
+		writeNotFound(w, "no such account")
 		return
 	}
-}
-
-func (s *Server) DeleteAccountHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	email := s.currentIdentity(r)
-	if email == "" {
-		http.Error(w, "bad credentials", http.StatusUnauthorized)
+	if err != nil {
+		lg.Errorf("update account: %s", err)
+		writeInternalError(w)
 		return
 	}
 
-	var delKeys []string
-	delKeys = append(delKeys, passphraseKey(email))
-	for _, s := range AllServices {
-		delKeys = append(delKeys, libraryCacheKey(s, email))
+	undoToken := generateUnsubToken()
+	ttl := time.Until(time.Unix(deletion.Purge, 0))
+	if err := s.redis.Set(undoDeleteTokenKey(email), undoToken, ttl).Err(); err != nil {
+		lg.Errorf("SET undo delete token: %s", err)
+		writeInternalError(w)
+		return
 	}
-	delKeys = append(delKeys, accountKey(email))
-	// NOTE: don't delete unsub token
 
-	if err := s.redis.Del(delKeys...).Err(); err != nil {
-		log.Printf("DEL keys: %s", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	v := url.Values{}
+	v.Set("email", email)
+	v.Set("token", undoToken)
+
+	var buf bytes.Buffer
+	if err := deleteAccountEmailTmpl.Execute(&buf, map[string]interface{}{
+		"Email":     email,
+		"AppName":   AppName,
+		"AppDomain": AppDomain,
+		"PurgeDate": time.Unix(deletion.Purge, 0).UTC().Format("2 January 2006"),
+		"UndoURL":   s.config.BaseURL + "/undo-delete?" + v.Encode(),
+	}); err != nil {
+		lg.Errorf("execute template: %s", err)
+		writeInternalError(w)
 		return
 	}
+	if err := s.email.Send([]string{email}, deleteAccountEmailSubject, buf.String(), "", nil); err != nil {
+		lg.Warningf("send delete account email: %s", err) // only log
+	}
 
-	log.Printf("successfully deleted account: %s", email)
+	lg.Infof("scheduled account deletion")
 	http.SetCookie(w, &http.Cookie{
 		Name:   cookieNameIdentity,
 		MaxAge: -1, // delete cookie
@@ -343,21 +498,113 @@ func (s *Server) DeleteAccountHandler(w http.ResponseWriter, r *http.Request, _
 	io.WriteString(w, "deleted account\n")
 }
 
+// cancelAccountDeletion clears a pending deletion for the account, if any.
+// It is not an error if the account does not exist.
+func (s *Server) cancelAccountDeletion(ctx context.Context, email string) error {
+	canceled := false
+	err := UpdateEntity(s.redis, accountKey(email), &Account{}, func(v interface{}) interface{} {
+		a := v.(*Account)
+		canceled = a.Deletion != nil
+		a.Deletion = nil
+		return a
+	})
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.redis.Del(undoDeleteTokenKey(email)).Err(); err != nil {
+		return fmt.Errorf("DEL undo delete token: %s", err)
+	}
+	if canceled {
+		loggerFrom(ctx).With("account", accountHash(email)).Infof("canceled account deletion")
+	}
+	return nil
+}
+
+// errNotDue is returned by purgeAccountIfDue when the account has no
+// pending deletion, or its grace period hasn't ended.
+var errNotDue = errors.New("account deletion not due")
+
+// purgeAccountIfDue permanently deletes the account's data if the account's
+// deletion is pending and due at now. The check and the deletion happen in
+// a transaction, so an undo that races with the purge either wins or finds
+// the account deleted. It returns redis.Nil if the account doesn't exist,
+// and errNotDue if the deletion isn't due.
+func (s *Server) purgeAccountIfDue(email string, now int64) error {
+	txf := func(tx *redis.Tx) error {
+		b, err := tx.Get(accountKey(email)).Bytes()
+		if err != nil {
+			return err
+		}
+		var acc Account
+		mustUnmarshalJSON(b, &acc)
+		if !acc.pendingDeletion() || acc.Deletion.Purge > now {
+			return errNotDue
+		}
+
+		hashes, err := tx.HVals(apiTokensKey(email)).Result()
+		if err != nil {
+			return fmt.Errorf("HVALS api tokens: %s", err)
+		}
+		delKeys := accountDataKeys(email)
+		for _, h := range hashes {
+			delKeys = append(delKeys, apiTokenKey(h))
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(delKeys...)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < updateEntityAttempts; i++ {
+		err := s.redis.Watch(txf, accountKey(email), apiTokensKey(email))
+		if err == redis.TxFailedErr {
+			continue // concurrently modified; retry
+		}
+		return err
+	}
+	return fmt.Errorf("purge %s: too many concurrent modifications", accountHash(email))
+}
+
+// accountDataKeys returns the keys that hold the account's data, other than
+// the individual API token keys.
+func accountDataKeys(email string) []string {
+	var keys []string
+	keys = append(keys, passphraseKey(email))
+	for _, s := range AllServices {
+		keys = append(keys, libraryCacheKey(s, email))
+	}
+	keys = append(keys, accountKey(email))
+	keys = append(keys, undoDeleteTokenKey(email))
+	keys = append(keys, mutedArtistsKey(email), mutedAlbumsKey(email))
+	keys = append(keys, spotifyLibraryKey(email))
+	keys = append(keys, musicBrainzPendingKey(email))
+	keys = append(keys, apiTokensKey(email))
+	// NOTE: don't delete unsub token
+	return keys
+}
+
 func (s *Server) BirthdaysHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	ts := r.URL.Query()["timestamp"]
 	if len(ts) == 0 {
-		http.Error(w, "timestamp required", http.StatusBadRequest)
+		writeBadRequest(w, "timestamp required")
 		return
 	}
 	if len(ts) > 10 {
-		http.Error(w, "too many timestamps", http.StatusBadRequest)
+		writeBadRequest(w, "too many timestamps")
 		return
 	}
 	var timestamps []int64
 	for _, t := range ts {
 		i, err := strconv.ParseInt(t, 10, 64)
 		if err != nil {
-			http.Error(w, "bad timestamp", http.StatusBadRequest)
+			writeBadRequest(w, "bad timestamp")
 			return
 		}
 		timestamps = append(timestamps, i)
@@ -372,8 +619,8 @@ func (s *Server) BirthdaysHandler(w http.ResponseWriter, r *http.Request, _ http
 		var err error
 		loc, err = time.LoadLocation(timeZoneName)
 		if err != nil {
-			log.Printf("load location %s: %s", timeZoneName, err)
-			http.Error(w, "bad timezone", http.StatusBadRequest)
+			lg.Warningf("load location %s: %s", timeZoneName, err)
+			writeBadRequest(w, "bad timezone")
 			return
 		}
 	}
@@ -383,63 +630,74 @@ func (s *Server) BirthdaysHandler(w http.ResponseWriter, r *http.Request, _ http
 		cache = "on"
 	}
 	if cache != "on" && cache != "off" {
-		http.Error(w, "bad cache", http.StatusBadRequest)
+		writeBadRequest(w, "bad cache")
 		return
 	}
 
-	email := s.currentIdentity(r)
+	email := s.apiIdentity(r, ScopeBirthdaysRead)
 	if email == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeUnauthorized(w)
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
 	acc, err := getAccount(accountKey(email), s.redis)
 	if err != nil {
-		log.Printf("get account: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("get account: %s", err)
+		writeInternalError(w)
 		return
 	}
 
 	if !acc.connectionComplete() {
-		w.WriteHeader(412)
+		writeAPIError(w, http.StatusPreconditionFailed, APIError{Code: ErrCodeConnectionRequired, Message: "no music service connected"})
 		return
 	}
 
 	conn := *acc.Connection
-	ctx := context.Background() // intentional
+	ctx := contextWithLogger(context.Background(), lg) // intentional
 
 	var songs []Song
 
 	if cache == "on" {
-		songs = s.getSongsFromCache(conn.Service, email)
+		songs = s.getSongsFromCache(ctx, conn.Service, email)
 	}
 
 	if songs == nil { // need to do a live fetch?
 		var err error
-		songs, err = FetchSongs(ctx, s.http, conn, s.config)
+		songs, err = s.fetchSongs(ctx, email, conn)
 		var cerr ConnectionErrReason
 		if errors.As(err, &cerr) {
-			log.Printf("fetch songs connection error: %s", err)
+			lg.Warningf("fetch songs connection error: %s", err)
 			switch cerr {
 			case ConnectionErrPermission, ConnectionErrNotFound:
-				w.WriteHeader(422)
+				writeConnectionError(w, http.StatusUnprocessableEntity, conn.Service, cerr)
 			case ConnectionErrGeneric:
-				w.WriteHeader(http.StatusInternalServerError)
+				writeConnectionError(w, http.StatusInternalServerError, conn.Service, cerr)
 			default:
 				panic("unreachable")
 			}
 			return
 		}
 		if err != nil {
-			log.Printf("fetch songs: %s", err)
-			w.WriteHeader(http.StatusInternalServerError)
+			lg.Errorf("fetch songs: %s", err)
+			writeInternalError(w)
 			return
 		}
 	}
 
-	s.putSongsToCache(conn.Service, email, songs)
+	s.putSongsToCache(ctx, conn.Service, email, songs)
+
+	mutes, err := s.getMutes(email)
+	if err != nil {
+		lg.Errorf("get mutes: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	songs = mutes.filterMuted(songs)
 
-	result := computeBirthdaysForTimestamps(timestamps, loc, songs)
+	opts := acc.Settings.birthdayOptions(conn.Service)
+	result := computeBirthdaysForTimestamps(timestamps, loc, songs, opts)
 
 	if !result.HasItems() {
 		// have to fast-forward until we find a day with birthday item
@@ -448,34 +706,62 @@ func (s *Server) BirthdaysHandler(w http.ResponseWriter, r *http.Request, _ http
 
 		for addDay := 1; addDay < 360; addDay++ {
 			t := latestTime.AddDate(0, 0, addDay)
-			items := computeBirthdays(t.Unix(), loc, songs)
-			if len(items) != 0 {
-				result[t.Unix()] = items
+			day := computeBirthdays(t.Unix(), loc, songs, opts)
+			if len(day.Items) != 0 {
+				result[t.Unix()] = day
 				break
 			}
 		}
 	}
 
+	baseURL := requestBaseURL(r)
+	var lists [][]BirthdayItem
+	for _, day := range result {
+		s.setArtworkURLs(baseURL, day.Items)
+		lists = append(lists, day.Items)
+	}
+	colors := s.setCachedArtworkColors(ctx, lists...)
+
+	// The ETag covers the colors, since the response changes once missing
+	// colors are computed.
+	tsStrings := make([]string, len(timestamps))
+	for i, t := range timestamps {
+		tsStrings[i] = strconv.FormatInt(t, 10)
+	}
+	etag := computeETag(
+		libraryVersion(songs),
+		string(mustMarshalJSON(acc.Settings)),
+		string(mustMarshalJSON(mutes)),
+		strings.Join(tsStrings, ","),
+		loc.String(),
+		baseURL,
+		string(mustMarshalJSON(colors)),
+	)
+	if checkNotModified(w, r, etag) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(result); err != nil {
-		log.Printf("write response: %s", err)
+		lg.Errorf("write response: %s", err)
 	}
 }
 
-type BirthdayResponse map[int64][]BirthdayItem
+type BirthdayResponse map[int64]BirthdayDay
 
 func (b BirthdayResponse) HasItems() bool {
 	for _, v := range b {
-		if len(v) != 0 {
+		if len(v.Items) != 0 {
 			return true
 		}
 	}
 	return false
 }
 
-func computeBirthdaysForTimestamps(timestamps []int64, loc *time.Location, songs []Song) BirthdayResponse {
+func computeBirthdaysForTimestamps(timestamps []int64, loc *time.Location, songs []Song, opts BirthdayOptions) BirthdayResponse {
 	m := make(BirthdayResponse)
 	for _, t := range timestamps {
-		m[t] = computeBirthdays(t, loc, songs)
+		m[t] = computeBirthdays(t, loc, songs, opts)
 	}
 	return m
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// APIErrorCode is a machine-readable code identifying the kind of error in
+// an API error response. Clients should switch on the code rather than on
+// the HTTP status.
+//
+// NOTE: keep this in sync with the APIErrorCode type in web/api.ts.
+type APIErrorCode string
+
+const (
+	ErrCodeBadRequest    APIErrorCode = "bad_request"
+	ErrCodeUnauthorized  APIErrorCode = "unauthorized"
+	ErrCodeBadPassphrase APIErrorCode = "bad_passphrase"
+	ErrCodeInvalidFields APIErrorCode = "invalid_fields" // details are []FieldError
+	ErrCodeForbidden     APIErrorCode = "forbidden"
+	ErrCodeNotFound      APIErrorCode = "not_found"
+	ErrCodeTooManyTokens APIErrorCode = "too_many_tokens"
+	ErrCodeTooManyMutes  APIErrorCode = "too_many_mutes"
+	ErrCodeRateLimited   APIErrorCode = "rate_limited"
+	ErrCodeInternal      APIErrorCode = "internal"
+
+	ErrCodeConnectionRequired   APIErrorCode = "connection_required"   // account has no music service connection
+	ErrCodeConnectionPermission APIErrorCode = "connection_permission" // ConnectionErrPermission
+	ErrCodeConnectionNotFound   APIErrorCode = "connection_not_found"  // ConnectionErrNotFound
+	ErrCodeConnectionGeneric    APIErrorCode = "connection_error"      // ConnectionErrGeneric
+)
+
+// APIErrorResponse is the body of every error response from the /api/v1
+// and /connect endpoints.
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+type APIError struct {
+	Code    APIErrorCode `json:"code"`
+	Message string       `json:"message"`
+	Details interface{}  `json:"details,omitempty"`
+}
+
+// FieldError describes an invalid field in a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ConnectionErrDetails are the details for errors with a Connection code.
+type ConnectionErrDetails struct {
+	Service Service             `json:"service"`
+	Reason  ConnectionErrReason `json:"reason"`
+}
+
+func connectionErrCode(reason ConnectionErrReason) APIErrorCode {
+	switch reason {
+	case ConnectionErrPermission:
+		return ErrCodeConnectionPermission
+	case ConnectionErrNotFound:
+		return ErrCodeConnectionNotFound
+	case ConnectionErrGeneric:
+		return ErrCodeConnectionGeneric
+	default:
+		panic("unreachable")
+	}
+}
+
+func connectionErrMessage(reason ConnectionErrReason) string {
+	switch reason {
+	case ConnectionErrPermission:
+		return "music service profile is not accessible; it may be private"
+	case ConnectionErrNotFound:
+		return "music service profile not found"
+	case ConnectionErrGeneric:
+		return "failed to fetch from music service"
+	default:
+		panic("unreachable")
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, code int, e APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(APIErrorResponse{Error: e}) // ignore error; nothing more can be done
+}
+
+func writeBadRequest(w http.ResponseWriter, message string) {
+	writeAPIError(w, http.StatusBadRequest, APIError{Code: ErrCodeBadRequest, Message: message})
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusUnauthorized, APIError{Code: ErrCodeUnauthorized, Message: "not logged in"})
+}
+
+func writeNotFound(w http.ResponseWriter, message string) {
+	writeAPIError(w, http.StatusNotFound, APIError{Code: ErrCodeNotFound, Message: message})
+}
+
+func writeInternalError(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusInternalServerError, APIError{Code: ErrCodeInternal, Message: "internal error"})
+}
+
+// writeConnectionError writes an error response for a failed music service
+// connection.
+func writeConnectionError(w http.ResponseWriter, code int, service Service, reason ConnectionErrReason) {
+	writeAPIError(w, code, APIError{
+		Code:    connectionErrCode(reason),
+		Message: connectionErrMessage(reason),
+		Details: ConnectionErrDetails{Service: service, Reason: reason},
+	})
+}
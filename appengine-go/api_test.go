@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccountHandlerOmitsCredentials(t *testing.T) {
+	s, _ := newTestServer(t)
+	const email = "a@example.com"
+	putTestAccount(t, s, email, Account{
+		Connection: &Connection{Service: Spotify, Conn: Conn{RefreshToken: "secret-refresh-token"}},
+		Settings:   AccountSettings{EmailsEnabled: true},
+	})
+
+	token := putTestAPIToken(t, s, email, ScopeAccountRead)
+
+	for _, tt := range []struct {
+		name string
+		auth func(r *http.Request)
+	}{
+		{"cookie", func(r *http.Request) { r.AddCookie(testIdentityCookie(t, s, email)) }},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/account", nil)
+			tt.auth(req)
+			rec := httptest.NewRecorder()
+			s.AccountHandler(rec, req, nil)
+
+			if rec.Code != 200 {
+				t.Fatalf("status: got %d, want 200", rec.Code)
+			}
+			body := rec.Body.String()
+			if strings.Contains(body, "secret-refresh-token") || strings.Contains(body, "refreshToken") {
+				t.Errorf("response contains credentials: %s", body)
+			}
+			var got AccountResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Connection == nil || got.Connection.Service != Spotify || !got.Settings.EmailsEnabled {
+				t.Errorf("unexpected response: %s", body)
+			}
+		})
+	}
+}
+
+func TestDeleteAccountHandlerUndoURL(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.config.BaseURL = "https://staging.albumday.test"
+	const email = "a@example.com"
+	putTestAccount(t, s, email, Account{})
+
+	req := httptest.NewRequest("DELETE", "/api/v1/account", nil)
+	req.AddCookie(testIdentityCookie(t, s, email))
+	rec := httptest.NewRecorder()
+	s.DeleteAccountHandler(rec, req, nil)
+	if rec.Code != 200 {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+
+	sent := s.email.(*testEmailClient).sent
+	if len(sent) != 1 {
+		t.Fatalf("got %d emails", len(sent))
+	}
+	if !strings.Contains(sent[0].BodyText, "https://staging.albumday.test/undo-delete?") {
+		t.Errorf("undo URL not at the base URL:\n%s", sent[0].BodyText)
+	}
+}
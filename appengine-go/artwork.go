@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Artwork is served via a proxy that resizes it to standard sizes and
+// re-encodes it as JPEG, since the original artwork can be large, and
+// some email clients load or block third-party images. Proxy URLs are
+// signed, so that the proxy can't be used for arbitrary URLs.
+//
+// The proxy doesn't serve WebP, even to clients that accept it: the
+// standard library has no WebP encoder (golang.org/x/image/webp only
+// decodes), and JPEG is supported by all email clients.
+
+const (
+	ArtworkSizeEmail     = 180
+	ArtworkSizeThumbnail = 64
+)
+
+var artworkSizes = map[int]bool{
+	ArtworkSizeEmail:     true,
+	ArtworkSizeThumbnail: true,
+}
+
+const (
+	maxArtworkSourceSize   = 10 << 20
+	maxArtworkSourcePixels = 5000 * 5000
+	artworkJPEGQuality     = 85
+	artworkCacheTTL        = 30 * 24 * time.Hour
+)
+
+func artworkCacheKey(sourceURL string, size int) string {
+	h := sha256.Sum256([]byte(sourceURL))
+	return fmt.Sprintf("artwork:%s:%d", hex.EncodeToString(h[:16]), size)
+}
+
+// artworkSigningKey derives the key for signing artwork proxy URLs.
+func artworkSigningKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("artwork"))
+	return mac.Sum(nil)
+}
+
+func (s *Server) artworkSignature(sourceURL string, size int) string {
+	mac := hmac.New(sha256.New, s.artworkKey)
+	fmt.Fprintf(mac, "%d\x00%s", size, sourceURL)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// artworkProxyURL returns the signed proxy URL, at baseURL, for the
+// artwork at the size, or "" if sourceURL is "".
+func (s *Server) artworkProxyURL(baseURL, sourceURL string, size int) string {
+	if sourceURL == "" {
+		return ""
+	}
+	v := url.Values{}
+	v.Set("url", sourceURL)
+	v.Set("size", strconv.Itoa(size))
+	v.Set("sig", s.artworkSignature(sourceURL, size))
+	return baseURL + "/artwork?" + v.Encode()
+}
+
+// ArtworkURLs are the proxy URLs for an album's artwork.
+type ArtworkURLs struct {
+	Email     string `json:"email"`     // ArtworkSizeEmail; or ""
+	Thumbnail string `json:"thumbnail"` // ArtworkSizeThumbnail; or ""
+}
+
+// setArtworkURLs sets the artwork proxy URLs, at baseURL, of the items.
+// baseURL is requestBaseURL for responses to the request, or the config's
+// BaseURL for emails.
+func (s *Server) setArtworkURLs(baseURL string, items []BirthdayItem) {
+	for i := range items {
+		items[i].Artwork = ArtworkURLs{
+			Email:     s.artworkProxyURL(baseURL, items[i].ArtworkURL, ArtworkSizeEmail),
+			Thumbnail: s.artworkProxyURL(baseURL, items[i].ArtworkURL, ArtworkSizeThumbnail),
+		}
+	}
+}
+
+func (s *Server) ArtworkHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	sourceURL := r.FormValue("url")
+	if sourceURL == "" {
+		http.Error(w, "missing url", http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(r.FormValue("size"))
+	if err != nil || !artworkSizes[size] {
+		http.Error(w, "bad size", http.StatusBadRequest)
+		return
+	}
+	sig := r.FormValue("sig")
+	if !hmac.Equal([]byte(sig), []byte(s.artworkSignature(sourceURL, size))) {
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+
+	key := artworkCacheKey(sourceURL, size)
+	b, err := s.redis.Get(key).Bytes()
+	switch {
+	case err == nil:
+		artworkCacheTotal.Inc("hit")
+	case err == redis.Nil:
+		artworkCacheTotal.Inc("miss")
+		img, err := s.fetchArtwork(r.Context(), sourceURL)
+		if err != nil {
+			lg.Warningf("fetch artwork: %s", err)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resizeImage(img, size), &jpeg.Options{Quality: artworkJPEGQuality}); err != nil {
+			lg.Errorf("encode artwork: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		b = buf.Bytes()
+		if err := s.redis.Set(key, b, artworkCacheTTL).Err(); err != nil {
+			lg.Errorf("SET artwork: %s", err) // only log
+		}
+		if err := s.cacheArtworkColor(sourceURL, img); err != nil {
+			lg.Errorf("SETNX artwork color: %s", err) // only log
+		}
+	default:
+		lg.Errorf("GET artwork: %s", err)
+		artworkCacheTotal.Inc("error")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(b)
+}
+
+// fetchArtwork fetches and decodes the artwork.
+func (s *Server) fetchArtwork(ctx context.Context, sourceURL string) (image.Image, error) {
+	req, err := http.NewRequest("GET", sourceURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %s", err)
+	}
+	req = req.WithContext(ctx)
+
+	rsp, err := s.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %s", err)
+	}
+	defer drainAndClose(rsp.Body)
+
+	if !is2xxStatus(rsp.StatusCode) {
+		return nil, StatusError{rsp.StatusCode}
+	}
+
+	src, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxArtworkSourceSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read body: %s", err)
+	}
+	if len(src) > maxArtworkSourceSize {
+		return nil, fmt.Errorf("image too large: more than %d bytes", maxArtworkSourceSize)
+	}
+
+	// check the dimensions before decoding, to not decode huge images
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("decode config: %s", err)
+	}
+	if cfg.Width*cfg.Height > maxArtworkSourcePixels {
+		return nil, fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("decode: %s", err)
+	}
+	return img, nil
+}
+
+// resizeImage scales the image down, preserving its aspect ratio, to fit
+// within size×size pixels, by averaging the source pixels that cover each
+// destination pixel. Images that already fit are not scaled up.
+// Transparent pixels are composited onto white.
+func resizeImage(src image.Image, size int) *image.RGBA {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, sh*size/sw
+		} else {
+			dw, dh = sw*size/sh, size
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*sh/dh, (dy+1)*sh/dh
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*sw/dw, (dx+1)*sw/dw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					pr, pg, pb, pa := src.At(sb.Min.X+x, sb.Min.Y+y).RGBA() // alpha-premultiplied
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			// composite onto white: c + (1 - alpha) * white
+			white := 0xffff*n - a
+			dst.SetRGBA(dx, dy, color.RGBA{
+				R: uint8((r + white) / n >> 8),
+				G: uint8((g + white) / n >> 8),
+				B: uint8((b + white) / n >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
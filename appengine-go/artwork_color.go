@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Each album's artwork has a dominant color, used for card backgrounds and
+// placeholders. Colors are cached by artwork URL. They are computed when
+// the artwork proxy fetches the artwork, and otherwise in a task, so that
+// API responses don't wait for them.
+
+const (
+	artworkColorTTL     = 30 * 24 * time.Hour
+	artworkNoColorTTL   = 24 * time.Hour  // after a failure to compute the color
+	artworkColorBudget  = 5 * time.Second // for setArtworkColors
+	artworkColorWorkers = 4
+
+	artworkColorTaskBudget  = time.Minute
+	maxArtworkColorTaskURLs = 100
+)
+
+// noArtworkColor is cached when the color could not be computed.
+const noArtworkColor = "none"
+
+func artworkColorKey(sourceURL string) string {
+	h := sha256.Sum256([]byte(sourceURL))
+	return fmt.Sprintf("artwork_color:%s", hex.EncodeToString(h[:16]))
+}
+
+// dominantColor returns the dominant color of the image as "#rrggbb". The
+// image's pixels are grouped into buckets of similar colors, with
+// saturated pixels weighted more than grey ones, so that a colorful
+// element can win over a larger plain background. The color is the average of
+// the heaviest bucket.
+func dominantColor(img image.Image) string {
+	small := resizeImage(img, 32)
+
+	type bucket struct {
+		weight  int
+		r, g, b int
+		n       int
+	}
+	var buckets [16 * 16 * 16]bucket
+
+	best := -1
+	for i := 0; i < len(small.Pix); i += 4 {
+		r, g, b := int(small.Pix[i]), int(small.Pix[i+1]), int(small.Pix[i+2])
+
+		max, min := r, r
+		for _, c := range [...]int{g, b} {
+			if c > max {
+				max = c
+			}
+			if c < min {
+				min = c
+			}
+		}
+
+		k := r>>4<<8 | g>>4<<4 | b>>4
+		bk := &buckets[k]
+		bk.weight += 1 + 16*(max-min)/255 // saturation bonus
+		bk.r, bk.g, bk.b = bk.r+r, bk.g+g, bk.b+b
+		bk.n++
+		if best == -1 || bk.weight > buckets[best].weight {
+			best = k
+		}
+	}
+	if best == -1 {
+		return ""
+	}
+
+	bk := buckets[best]
+	return fmt.Sprintf("#%02x%02x%02x", bk.r/bk.n, bk.g/bk.n, bk.b/bk.n)
+}
+
+// tintColor mixes the "#rrggbb" color with white, for use as a background
+// behind dark text.
+func tintColor(c string) string {
+	var r, g, b int
+	if _, err := fmt.Sscanf(c, "#%02x%02x%02x", &r, &g, &b); err != nil {
+		return ""
+	}
+	const keep = 20 // percent
+	mix := func(v int) int { return (v*keep + 255*(100-keep)) / 100 }
+	return fmt.Sprintf("#%02x%02x%02x", mix(r), mix(g), mix(b))
+}
+
+// cacheArtworkColor caches the dominant color of the artwork, unless it
+// is already cached.
+func (s *Server) cacheArtworkColor(sourceURL string, img image.Image) error {
+	return s.redis.SetNX(artworkColorKey(sourceURL), dominantColor(img), artworkColorTTL).Err()
+}
+
+// artworkColors returns the cached dominant colors of the artworks, by
+// URL, and the URLs whose colors aren't cached.
+func (s *Server) artworkColors(urls []string) (colors map[string]string, missing []string, err error) {
+	colors = make(map[string]string)
+	if len(urls) == 0 {
+		return colors, nil, nil
+	}
+
+	keys := make([]string, len(urls))
+	for i, u := range urls {
+		keys[i] = artworkColorKey(u)
+	}
+	vals, err := s.redis.MGet(keys...).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("MGET artwork colors: %s", err)
+	}
+
+	for i, v := range vals {
+		c, ok := v.(string)
+		switch {
+		case !ok: // nil if not cached
+			missing = append(missing, urls[i])
+		case c != noArtworkColor:
+			colors[urls[i]] = c
+		}
+	}
+	return colors, missing, nil
+}
+
+// computeArtworkColors computes and caches the dominant colors of the
+// artworks, until ctx is done, and returns the computed colors, by URL.
+// complete is false if ctx was done before all colors were computed.
+func (s *Server) computeArtworkColors(ctx context.Context, urls []string) (colors map[string]string, complete bool) {
+	lg := loggerFrom(ctx)
+	colors = make(map[string]string)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	complete = true
+	sem := make(chan struct{}, artworkColorWorkers)
+	for _, u := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			img, err := s.fetchArtwork(ctx, u)
+			if err != nil {
+				if ctx.Err() != nil {
+					mu.Lock()
+					complete = false
+					mu.Unlock()
+					return
+				}
+				lg.Warningf("fetch artwork for color: %s", err)
+				if err := s.redis.Set(artworkColorKey(u), noArtworkColor, artworkNoColorTTL).Err(); err != nil {
+					lg.Errorf("SET artwork color: %s", err) // only log
+				}
+				return
+			}
+
+			c := dominantColor(img)
+			if err := s.redis.Set(artworkColorKey(u), c, artworkColorTTL).Err(); err != nil {
+				lg.Errorf("SET artwork color: %s", err) // only log
+			}
+			mu.Lock()
+			colors[u] = c
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+	return colors, complete
+}
+
+// ArtworkColorTask is the payload of the artwork color task, which
+// computes the colors that setCachedArtworkColors found missing.
+type ArtworkColorTask struct {
+	URLs []string `json:"urls"`
+}
+
+func artworkColorPendingKey(sourceURL string) string {
+	h := sha256.Sum256([]byte(sourceURL))
+	return fmt.Sprintf("artwork_color_pending:%s", hex.EncodeToString(h[:16]))
+}
+
+// enqueueArtworkColors enqueues a task to compute the colors of the
+// artworks, except those already pending in another task.
+func (s *Server) enqueueArtworkColors(ctx context.Context, urls []string) {
+	lg := loggerFrom(ctx)
+
+	if len(urls) > maxArtworkColorTaskURLs {
+		urls = urls[:maxArtworkColorTaskURLs]
+	}
+	// The keys expire in case the task is lost; the task deletes them when
+	// done.
+	cmds := make([]*redis.BoolCmd, len(urls))
+	_, err := s.redis.Pipelined(func(p redis.Pipeliner) error {
+		for i, u := range urls {
+			cmds[i] = p.SetNX(artworkColorPendingKey(u), 1, 2*artworkColorTaskBudget)
+		}
+		return nil
+	})
+	if err != nil {
+		lg.Errorf("SETNX artwork color pending: %s", err)
+		return
+	}
+	var pending []string
+	for i, cmd := range cmds {
+		if cmd.Val() {
+			pending = append(pending, urls[i])
+		}
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := s.tasks.PostJSONTask(ctx, "/internal/task/artwork-color", ArtworkColorTask{pending}); err != nil {
+		lg.Errorf("post JSON task: %s", err)
+		s.clearArtworkColorsPending(ctx, pending)
+	}
+}
+
+func (s *Server) clearArtworkColorsPending(ctx context.Context, urls []string) {
+	keys := make([]string, len(urls))
+	for i, u := range urls {
+		keys[i] = artworkColorPendingKey(u)
+	}
+	if err := s.redis.Del(keys...).Err(); err != nil {
+		loggerFrom(ctx).Errorf("DEL artwork color pending: %s", err) // only log
+	}
+}
+
+// artworkURLs returns the distinct artwork URLs of the items in the lists.
+func artworkURLs(lists [][]BirthdayItem) []string {
+	seen := make(map[string]bool)
+	var urls []string
+	for _, items := range lists {
+		for _, it := range items {
+			if it.ArtworkURL != "" && !seen[it.ArtworkURL] {
+				seen[it.ArtworkURL] = true
+				urls = append(urls, it.ArtworkURL)
+			}
+		}
+	}
+	return urls
+}
+
+func setItemColors(lists [][]BirthdayItem, colors map[string]string) {
+	for _, items := range lists {
+		for i := range items {
+			items[i].Color = colors[items[i].ArtworkURL]
+		}
+	}
+}
+
+// setCachedArtworkColors sets the cached colors of the items in each list,
+// without waiting for missing colors, which are left "" and computed in a
+// task. It returns the colors that were set, by URL.
+func (s *Server) setCachedArtworkColors(ctx context.Context, lists ...[]BirthdayItem) map[string]string {
+	colors, missing, err := s.artworkColors(artworkURLs(lists))
+	if err != nil {
+		loggerFrom(ctx).Errorf("artwork colors: %s", err) // only log
+		return nil
+	}
+	if len(missing) != 0 {
+		s.enqueueArtworkColors(ctx, missing)
+	}
+	setItemColors(lists, colors)
+	return colors
+}
+
+// setArtworkColors sets the colors of the items, computing missing colors
+// within a time budget. It is for callers, such as tasks, that can wait.
+func (s *Server) setArtworkColors(ctx context.Context, items []BirthdayItem) {
+	lg := loggerFrom(ctx)
+	lists := [][]BirthdayItem{items}
+
+	colors, missing, err := s.artworkColors(artworkURLs(lists))
+	if err != nil {
+		lg.Errorf("artwork colors: %s", err) // only log
+		return
+	}
+	if len(missing) != 0 {
+		ctx, cancel := context.WithTimeout(ctx, artworkColorBudget)
+		defer cancel()
+		computed, _ := s.computeArtworkColors(ctx, missing)
+		for u, c := range computed {
+			colors[u] = c
+		}
+	}
+	setItemColors(lists, colors)
+}
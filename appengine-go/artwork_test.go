@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestBaseURL(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/v1/birthdays", nil)
+	req.Host = "localhost:8080"
+	if got, want := requestBaseURL(req), "http://localhost:8080"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	req.Host = "albumday.cc"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	if got, want := requestBaseURL(req), "https://albumday.cc"; got != want {
+		t.Errorf("X-Forwarded-Proto: got %q, want %q", got, want)
+	}
+
+	req.Header.Del("X-Forwarded-Proto")
+	req.TLS = &tls.ConnectionState{}
+	if got, want := requestBaseURL(req), "https://albumday.cc"; got != want {
+		t.Errorf("TLS: got %q, want %q", got, want)
+	}
+}
+
+// serveTestArtwork serves a solid red PNG.
+func serveTestArtwork(t *testing.T) *httptest.Server {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 400, 400))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+3] = 0xff, 0xff
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, img)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestArtworkProxy(t *testing.T) {
+	s, _ := newTestServer(t)
+	srv := serveTestArtwork(t)
+
+	items := []BirthdayItem{{Album: Album{ArtworkURL: srv.URL + "/a.png"}}, {}}
+	s.setArtworkURLs("https://staging.albumday.test", items)
+
+	if items[1].Artwork != (ArtworkURLs{}) {
+		t.Errorf("no artwork: got %+v", items[1].Artwork)
+	}
+	for _, proxyURL := range []string{items[0].Artwork.Email, items[0].Artwork.Thumbnail} {
+		if !strings.HasPrefix(proxyURL, "https://staging.albumday.test/artwork?") {
+			t.Fatalf("proxy URL %s not at the base URL", proxyURL)
+		}
+	}
+
+	u, err := url.Parse(items[0].Artwork.Thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.ArtworkHandler(rec, httptest.NewRequest("GET", u.RequestURI(), nil), nil)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	img, _, err := image.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != ArtworkSizeThumbnail || b.Dy() != ArtworkSizeThumbnail {
+		t.Errorf("got size %v", b)
+	}
+	r, g, b, _ := img.At(0, 0).RGBA()
+	if c := (color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 0xff}); c.R < 0xf0 || c.G > 0x10 || c.B > 0x10 {
+		t.Errorf("got color %v", c)
+	}
+
+	// The signature covers the size.
+	q := u.Query()
+	q.Set("size", "180")
+	rec = httptest.NewRecorder()
+	s.ArtworkHandler(rec, httptest.NewRequest("GET", "/artwork?"+q.Encode(), nil), nil)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("tampered size: got %d", rec.Code)
+	}
+}
+
+// countRequests counts the requests to the handler.
+func countRequests(h http.Handler, n *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(n, 1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+func TestSetCachedArtworkColors(t *testing.T) {
+	s, f := newTestServer(t)
+	srv := serveTestArtwork(t)
+	var fetches int32
+	srv.Config.Handler = countRequests(srv.Config.Handler, &fetches)
+
+	cached, missing := srv.URL+"/cached.png", srv.URL+"/missing.png"
+	if err := s.redis.Set(artworkColorKey(cached), "#123456", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []BirthdayItem{{Album: Album{ArtworkURL: cached}}, {Album: Album{ArtworkURL: missing}}}
+	colors := s.setCachedArtworkColors(context.Background(), items)
+	if items[0].Color != "#123456" || items[1].Color != "" {
+		t.Errorf("got colors %q, %q", items[0].Color, items[1].Color)
+	}
+	if len(colors) != 1 || colors[cached] != "#123456" {
+		t.Errorf("got %v", colors)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 0 {
+		t.Errorf("fetched artwork %d times", n)
+	}
+
+	tasks := s.tasks.(*testTasksClient).tasks
+	if len(tasks) != 1 || tasks[0].Path != "/internal/task/artwork-color" {
+		t.Fatalf("got tasks %+v", tasks)
+	}
+	if got := tasks[0].Payload.(ArtworkColorTask).URLs; len(got) != 1 || got[0] != missing {
+		t.Errorf("got task URLs %v", got)
+	}
+	if ttl := f.ttl(artworkColorPendingKey(missing)); ttl <= 0 {
+		t.Errorf("pending key TTL %s", ttl)
+	}
+
+	// The color is already pending.
+	s.setCachedArtworkColors(context.Background(), items)
+	if n := len(s.tasks.(*testTasksClient).tasks); n != 1 {
+		t.Errorf("got %d tasks, want 1", n)
+	}
+}
+
+func TestArtworkColorTaskHandler(t *testing.T) {
+	s, _ := newTestServer(t)
+	srv := serveTestArtwork(t)
+
+	ok, bad := srv.URL+"/a.png", "http://127.0.0.1:0/b.png"
+	for _, u := range []string{ok, bad} {
+		if err := s.redis.Set(artworkColorPendingKey(u), 1, time.Minute).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(string(mustMarshalJSON(ArtworkColorTask{[]string{ok, bad}})))
+	s.ArtworkColorTaskHandler(rec, httptest.NewRequest("POST", "/internal/task/artwork-color", body), nil)
+	if rec.Code != 200 {
+		t.Fatalf("got %d", rec.Code)
+	}
+
+	for u, want := range map[string]string{ok: "#ff0000", bad: noArtworkColor} {
+		if got, _ := s.redis.Get(artworkColorKey(u)).Result(); got != want {
+			t.Errorf("%s: got color %q, want %q", u, got, want)
+		}
+		if n, _ := s.redis.Exists(artworkColorPendingKey(u)).Result(); n != 0 {
+			t.Errorf("%s: still pending", u)
+		}
+	}
+}
+
+func TestBirthdaysHandlerArtworkColors(t *testing.T) {
+	s, _ := newTestServer(t)
+	srv := serveTestArtwork(t)
+	var fetches int32
+	srv.Config.Handler = countRequests(srv.Config.Handler, &fetches)
+
+	const email = "foo@example.com"
+	putTestAccount(t, s, email, Account{Connection: &Connection{Service: Spotify}})
+	token := putTestAPIToken(t, s, email, ScopeBirthdaysRead)
+	songs := []Song{{
+		Artist:     "Fleetwood Mac",
+		Album:      "Rumours",
+		Title:      "Dreams",
+		Release:    ReleaseDate{Year: 1977, Month: 2, Day: 4, Precision: PrecisionDay},
+		ArtworkURL: srv.URL + "/rumours.png",
+	}}
+	s.putSongsToCache(context.Background(), Spotify, email, songs)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		ts := time.Date(2020, 2, 4, 0, 0, 0, 0, time.UTC).Unix()
+		req := httptest.NewRequest("GET", "/api/v1/birthdays?timeZone=UTC&timestamp="+strconv.FormatInt(ts, 10), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		s.BirthdaysHandler(rec, req, nil)
+		return rec
+	}
+
+	rec := get("")
+	if rec.Code != 200 {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+	if strings.Contains(rec.Body.String(), "#ff0000") {
+		t.Errorf("color set before it was computed")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 0 {
+		t.Errorf("fetched artwork %d times", n)
+	}
+	if rec := get(etag); rec.Code != http.StatusNotModified {
+		t.Errorf("unchanged: got %d", rec.Code)
+	}
+
+	// Once the color is computed, the response changes.
+	tasks := s.tasks.(*testTasksClient).tasks
+	if len(tasks) != 1 {
+		t.Fatalf("got %d tasks", len(tasks))
+	}
+	body := strings.NewReader(string(mustMarshalJSON(tasks[0].Payload)))
+	s.ArtworkColorTaskHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/internal/task/artwork-color", body), nil)
+
+	rec = get(etag)
+	if rec.Code != 200 {
+		t.Fatalf("after color: got %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), `"color":"#ff0000"`) {
+		t.Errorf("color not set: %s", rec.Body)
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Errorf("ETag unchanged")
+	}
+}
@@ -8,7 +8,9 @@ import (
 )
 
 type Album struct {
-	Artist       string       `json:"artist"`
+	Artist       string       `json:"artist"`  // joint credit for Artists
+	Artists      []string     `json:"artists"` // the album's artists
+	Compilation  bool         `json:"compilation"`
 	Album        string       `json:"album"`
 	Release      ReleaseDate  `json:"release"`
 	Link         string       `json:"link"`       // or ""
@@ -34,18 +36,22 @@ func (a Album) Hash() string {
 
 type BirthdayItem struct {
 	Album
-	Songs []BirthdayItemSong `json:"songs"`
+	Artwork ArtworkURLs        `json:"artwork"` // set by Server.setArtworkURLs
+	Color   string             `json:"color"`   // dominant color of the artwork, "#rrggbb"; or "". Set by Server.setArtworkColors
+	Songs   []BirthdayItemSong `json:"songs"`
 }
 
 type BirthdayItemSong struct {
-	Title string `json:"title"`
-	Link  string `json:"link"` // or ""
+	Title   string   `json:"title"`
+	Link    string   `json:"link"`    // or ""
+	Artists []string `json:"artists"` // if different from the album's artists; or null
 }
 
 func toBirthdayItemSong(s Song) BirthdayItemSong {
 	return BirthdayItemSong{
 		s.Title,
 		s.Link,
+		s.TrackArtists,
 	}
 }
 
@@ -60,31 +66,182 @@ func toBirthdayItemSongs(songs []Song) []BirthdayItemSong {
 type ReleaseMatch string
 
 const (
-	MatchNone  ReleaseMatch = "none"
-	MatchDay   ReleaseMatch = "day"
-	MatchMonth ReleaseMatch = "month"
+	MatchNone        ReleaseMatch = "none"
+	MatchDay         ReleaseMatch = "day"
+	MatchLeapDay     ReleaseMatch = "leap day"      // 29 February release, matched on another day in a non-leap year
+	MatchMonth       ReleaseMatch = "month"         // month-precision release, matched on the first day of the month
+	MatchMonthAnyDay ReleaseMatch = "month any day" // month-precision release, matched on any day of the month
+	MatchMonthWeekly ReleaseMatch = "month weekly"  // month-precision release, matched on each Monday of the month
+	MatchYear        ReleaseMatch = "year"          // year-precision release, matched on 1 January
 )
 
+// matched reports whether the release matched.
+func (m ReleaseMatch) matched() bool {
+	return m != MatchNone
+}
+
+// exact reports whether the release matched on its release day.
+func (m ReleaseMatch) exact() bool {
+	return m == MatchDay
+}
+
+// monthly reports whether a month-precision release matched.
+func (m ReleaseMatch) monthly() bool {
+	return m == MatchMonth || m == MatchMonthAnyDay || m == MatchMonthWeekly
+}
+
+// LeapDayRule is the day on which releases on 29 February are matched in
+// non-leap years.
+type LeapDayRule string
+
+const (
+	LeapDayNone  LeapDayRule = "none" // not matched in non-leap years
+	LeapDayFeb28 LeapDayRule = "february 28"
+	LeapDayMar1  LeapDayRule = "march 1"
+)
+
+// MonthRule is the days on which month-precision releases are matched.
+type MonthRule string
+
+const (
+	MonthFirstDay MonthRule = "first day" // the first day of the month
+	MonthAnyDay   MonthRule = "any day"   // every day of the month
+	MonthWeekly   MonthRule = "weekly"    // each Monday of the month
+)
+
+// monthDigestDay is the day of the week on which month-precision releases
+// are matched with MonthWeekly.
+const monthDigestDay = time.Monday
+
 type FullDate struct {
 	Year  int
 	Month time.Month
 	Day   int
 }
 
-func matchRelease(target FullDate, d ReleaseDate) ReleaseMatch {
-	if d.Day != 0 {
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
+
+func (d FullDate) weekday() time.Weekday {
+	return time.Date(d.Year, d.Month, d.Day, 0, 0, 0, 0, time.UTC).Weekday()
+}
+
+func matchRelease(target FullDate, d ReleaseDate, opts BirthdayOptions) ReleaseMatch {
+	switch d.precision() {
+	case PrecisionDay:
 		if target.Day == d.Day && target.Month == d.Month {
 			return MatchDay
 		}
+		if d.Month == time.February && d.Day == 29 && !isLeapYear(target.Year) {
+			switch {
+			case opts.LeapDay == LeapDayFeb28 && target.Month == time.February && target.Day == 28,
+				opts.LeapDay == LeapDayMar1 && target.Month == time.March && target.Day == 1:
+				return MatchLeapDay
+			}
+		}
+		return MatchNone
+	case PrecisionMonth:
+		if target.Month != d.Month {
+			return MatchNone
+		}
+		switch opts.Month {
+		case MonthAnyDay:
+			return MatchMonthAnyDay
+		case MonthWeekly:
+			if target.weekday() == monthDigestDay {
+				return MatchMonthWeekly
+			}
+			return MatchNone
+		default:
+			if target.Day == 1 {
+				return MatchMonth
+			}
+			return MatchNone
+		}
+	case PrecisionYear:
+		if opts.MatchYear && target.Month == time.January && target.Day == 1 {
+			return MatchYear
+		}
 		return MatchNone
+	default:
+		return MatchNone
+	}
+}
+
+type SortMode string
+
+const (
+	SortMostPlayed  SortMode = "most played"
+	SortOldestFirst SortMode = "oldest first"
+	SortNewestFirst SortMode = "newest first"
+)
+
+// BirthdayOptions control which albums are included in the birthday items
+// for a day, and their order.
+type BirthdayOptions struct {
+	// An album is included only if it has at least MinPlayCount total plays
+	// or at least MinLovedCount loved songs. A zero value disables the
+	// respective threshold; if both are zero, all albums are included.
+	MinPlayCount  int
+	MinLovedCount int
+
+	MaxItems int // 0 means no limit
+	Sort     SortMode
+
+	ExcludeCompilations bool
+
+	// MatchYear includes albums that have only a release year, on 1
+	// January of each year.
+	MatchYear bool
+
+	LeapDay LeapDayRule
+	Month   MonthRule
+}
+
+func (o BirthdayOptions) include(a *AlbumAndSongs) bool {
+	if o.ExcludeCompilations && a.Album.Compilation {
+		return false
+	}
+	if o.MinPlayCount == 0 && o.MinLovedCount == 0 {
+		return true
+	}
+	return (o.MinPlayCount > 0 && a.PlayCount >= o.MinPlayCount) ||
+		(o.MinLovedCount > 0 && a.Loved >= o.MinLovedCount)
+}
+
+func (o BirthdayOptions) less(a, b *AlbumAndSongs) bool {
+	switch o.Sort {
+	case SortOldestFirst:
+		if c := compareReleaseDates(a.Album.Release, b.Album.Release); c != 0 {
+			return c < 0
+		}
+	case SortNewestFirst:
+		if c := compareReleaseDates(a.Album.Release, b.Album.Release); c != 0 {
+			return c > 0
+		}
 	}
-	if target.Month == d.Month && target.Day == 1 {
-		return MatchMonth
+	return compareAlbums(a, b)
+}
+
+func compareReleaseDates(a, b ReleaseDate) int {
+	switch {
+	case a.Year != b.Year:
+		return a.Year - b.Year
+	case a.Month != b.Month:
+		return int(a.Month - b.Month)
+	default:
+		return a.Day - b.Day
 	}
-	return MatchNone
 }
 
-func computeBirthdays(unix int64, loc *time.Location, songs []Song) []BirthdayItem {
+// BirthdayDay is the birthday items for a day.
+type BirthdayDay struct {
+	Items   []BirthdayItem `json:"items"`
+	Omitted int            `json:"omitted"` // number of matching albums excluded by the options
+}
+
+func computeBirthdays(unix int64, loc *time.Location, songs []Song, opts BirthdayOptions) BirthdayDay {
 	target := time.Unix(unix, 0).In(loc)
 	targetDate := FullDate{
 		Year:  target.Year(),
@@ -92,43 +249,57 @@ func computeBirthdays(unix int64, loc *time.Location, songs []Song) []BirthdayIt
 		Day:   target.Day(),
 	}
 
-	matchingAlbums := make(map[string][]Song)
-	hashToAlbums := make(map[string]Album)
+	matchingAlbums := make(map[string][]Song) // by albumGroupKey
+	keyToAlbums := make(map[string]Album)
 
 	for _, s := range songs {
-		match := matchRelease(targetDate, s.Release)
-		switch match {
-		case MatchDay, MatchMonth:
+		match := matchRelease(targetDate, s.Release, opts)
+		if match.matched() {
 			a := Album{
 				Artist:       s.Artist,
+				Artists:      s.albumArtists(),
+				Compilation:  s.Compilation,
 				Album:        s.Album,
 				Release:      s.Release,
 				Link:         s.AlbumLink,
 				ArtworkURL:   s.ArtworkURL,
 				ReleaseMatch: match,
 			}
-			matchingAlbums[a.Hash()] = append(matchingAlbums[a.Hash()], s)
-			hashToAlbums[a.Hash()] = a
-		case MatchNone:
-			// skip
-		default:
-			panic("unreachable")
+			k := albumGroupKey(s, match)
+			matchingAlbums[k] = append(matchingAlbums[k], s)
+			if existing, ok := keyToAlbums[k]; !ok || preferAlbum(a, existing) {
+				keyToAlbums[k] = a
+			}
 		}
 	}
 
 	var consolidated []*AlbumAndSongs
-	for hash, songs := range matchingAlbums {
-		consolidated = append(consolidated, &AlbumAndSongs{hashToAlbums[hash], songs, 0, 0})
+	for k, songs := range matchingAlbums {
+		consolidated = append(consolidated, &AlbumAndSongs{keyToAlbums[k], songs, 0, 0})
 	}
 
 	for _, a := range consolidated {
 		a.FillCounts()
 	}
 
-	// sort albums ...
+	// filter by thresholds ...
+	total := len(consolidated)
+	included := consolidated[:0]
+	for _, a := range consolidated {
+		if opts.include(a) {
+			included = append(included, a)
+		}
+	}
+	consolidated = included
+
+	// ... sort albums ...
 	sort.Slice(consolidated, func(i, j int) bool {
-		return compareAlbums(consolidated[i], consolidated[j])
+		return opts.less(consolidated[i], consolidated[j])
 	})
+	// ... limit ...
+	if opts.MaxItems > 0 && len(consolidated) > opts.MaxItems {
+		consolidated = consolidated[:opts.MaxItems]
+	}
 	// ... and sort the songs within each album
 	for _, a := range consolidated {
 		sort.Slice(a.Songs, func(i, j int) bool {
@@ -144,7 +315,10 @@ func computeBirthdays(unix int64, loc *time.Location, songs []Song) []BirthdayIt
 			Songs: toBirthdayItemSongs(a.Songs),
 		}
 	}
-	return ret
+	return BirthdayDay{
+		Items:   ret,
+		Omitted: total - len(ret),
+	}
 }
 
 type AlbumAndSongs struct {
@@ -187,10 +361,10 @@ func compareAlbums(a, b *AlbumAndSongs) bool {
 	if b.Album.Release.Year > a.Album.Release.Year {
 		return false
 	}
-	if a.Album.ReleaseMatch == MatchDay && b.Album.ReleaseMatch != MatchDay {
+	if a.Album.ReleaseMatch.exact() && !b.Album.ReleaseMatch.exact() {
 		return true
 	}
-	if b.Album.ReleaseMatch == MatchDay && a.Album.ReleaseMatch != MatchDay {
+	if b.Album.ReleaseMatch.exact() && !a.Album.ReleaseMatch.exact() {
 		return false
 	}
 	if a.Album.Artist < b.Album.Artist {
@@ -231,82 +405,68 @@ func compareSongs(a, b Song) bool {
 	return a.Title < b.Title
 }
 
-// Returns whether the songs are the same, but for the artists, where there are
-// multiple artists with a shared primary artist. Returns the album with the
-// smaller artist name.
-//
-// For an example, see block comment at end of file.
-//
-// XXX: unused
-func equalButMultipleArtists(a, b Album) (Album, bool) {
-	hasSmaller := false
-	var result Album
-
-	if strings.HasPrefix(a.Artist, b.Artist) {
-		hasSmaller = true
-		result = b
-	}
-	if strings.HasPrefix(b.Artist, a.Artist) {
-		hasSmaller = true
-		result = a
-	}
-
-	if !hasSmaller {
-		return result, false
-	}
-
-	a.Artist = "" // clear for comparison
-	b.Artist = ""
+// artistSeparators separate the primary artist from the other artists in
+// an artist credit.
+var artistSeparators = []string{
+	",",
+	" & ",
+	" feat. ", " Feat. ", " feat ", " Feat ",
+	" ft. ", " Ft. ",
+	" featuring ", " Featuring ",
+	" (feat. ", " (Feat. ",
+}
 
-	if !a.Equal(b) {
-		return result, false
+// primaryArtist returns the first artist in an artist credit that may name
+// multiple artists. For example, the primary artist for "Max Richter, KiKi
+// Layne & Robert Ziegler" is "Max Richter".
+func primaryArtist(artist string) string {
+	end := len(artist)
+	for _, sep := range artistSeparators {
+		if i := strings.Index(artist, sep); i > 0 && i < end {
+			end = i
+		}
 	}
-	return result, true
+	return strings.TrimSpace(artist[:end])
 }
 
-/*
-{
-  artist: 'Max Richter, KiKi Layne, Mari Samuelsen & Robert Ziegler',
-  album: 'Voices',
-  title: 'Murmuration: Pt. 1',
-  release: { year: 2020, month: 8, day: 1 },
-  link: 'https://music.apple.com/us/album/murmuration-pt-1/1520370274?i=1520371405&uo=4',
-  albumLink: 'https://music.apple.com/us/album/murmuration-pt-1/1520370274',
-  artworkURL: 'https://selective-scrobble.appspot.com/api/v1/artwork?hash=9474552211958018425228240237176124193187112784089215',
-  playCount: 1,
-  loved: false
-}
-{
-  artist: 'Max Richter',
-  album: 'Voices',
-  title: 'Prelude 6: Pt. 2',
-  release: { year: 2020, month: 8, day: 1 },
-  link: 'https://music.apple.com/us/album/prelude-6-pt-2/1520370274?i=1520371402&uo=4',
-  albumLink: 'https://music.apple.com/us/album/prelude-6-pt-2/1520370274',
-  artworkURL: 'https://selective-scrobble.appspot.com/api/v1/artwork?hash=9474552211958018425228240237176124193187112784089215',
-  playCount: 1,
-  loved: false
-}
-{
-  artist: 'Max Richter, KiKi Layne & Robert Ziegler',
-  album: 'Voices',
-  title: 'Hypocognition: Pt. 1',
-  release: { year: 2020, month: 8, day: 1 },
-  link: 'https://music.apple.com/us/album/hypocognition-pt-1/1520370274?i=1520371395&uo=4',
-  albumLink: 'https://music.apple.com/us/album/hypocognition-pt-1/1520370274',
-  artworkURL: 'https://selective-scrobble.appspot.com/api/v1/artwork?hash=9474552211958018425228240237176124193187112784089215',
-  playCount: 1,
-  loved: false
+// albumGroupKey returns the key by which songs that matched a date are
+// grouped into albums. Spotify songs are grouped by the album's listed
+// artists. Scrobble songs only have a credit, and tracks on the same album
+// may credit different featured artists, so they are grouped by the primary
+// artist of the credit; for example, tracks on Max Richter's "Voices" are
+// credited to "Max Richter" and to "Max Richter, KiKi Layne & Robert
+// Ziegler". Compilations are grouped by album alone.
+//
+// Editions of an album are grouped by the base title, so that "Rumours"
+// and "Rumours (Super Deluxe)" are one album; preferOriginalReleases gives
+// them the same release date. The artwork isn't in the key, since editions
+// usually have different artwork.
+func albumGroupKey(s Song, match ReleaseMatch) string {
+	artist := normalizeName(primaryArtist(s.Artist))
+	if s.ArtistsListed {
+		artist = normalizeName(joinArtists(s.Artists))
+	}
+	if s.Compilation {
+		artist = ""
+	}
+	base, _ := baseAlbumTitle(s.Album)
+	return fmt.Sprintf("%s:%s:%s:%s",
+		artist, normalizeName(base), s.Release.Hash(), match)
 }
-{
-  artist: 'Max Richter, Grace Davidson, Mari Samuelsen & Robert Ziegler',
-  album: 'Voices',
-  title: 'Chorale: Pt. 2',
-  release: { year: 2020, month: 8, day: 1 },
-  link: 'https://music.apple.com/us/album/chorale-pt-2/1520370274?i=1520371283&uo=4',
-  albumLink: 'https://music.apple.com/us/album/chorale-pt-2/1520370274',
-  artworkURL: 'https://selective-scrobble.appspot.com/api/v1/artwork?hash=9474552211958018425228240237176124193187112784089215',
-  playCount: 1,
-  loved: false
+
+// preferAlbum reports whether a should be used over b to represent their
+// album group. The original edition is preferred over reissues. Then the
+// album with the shorter artist credit is preferred, as it is more likely
+// to name only the album's artist.
+func preferAlbum(a, b Album) bool {
+	if ra, rb := isReissue(a.Album), isReissue(b.Album); ra != rb {
+		return !ra
+	}
+	if len(a.Artist) != len(b.Artist) {
+		return len(a.Artist) < len(b.Artist)
+	}
+	if a.Artist != b.Artist {
+		return a.Artist < b.Artist
+	}
+	return a.Link < b.Link
 }
-*/
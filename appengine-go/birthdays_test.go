@@ -0,0 +1,199 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+// birthdayAlbums returns the artists and titles of the albums on the day.
+func birthdayAlbums(d BirthdayDay) []string {
+	var ret []string
+	for _, it := range d.Items {
+		ret = append(ret, it.Album.Artist+" - "+it.Album.Album)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestComputeBirthdaysGrouping(t *testing.T) {
+	voices := ReleaseDate{Year: 2020, Month: 8, Day: 1, Precision: PrecisionDay}
+	scrobble := func(artist, title string) Song {
+		return Song{
+			Artist:      artist,
+			Album:       "Voices",
+			Title:       title,
+			Artists:     []string{artist},
+			Release:     voices,
+			Link:        "https://music.apple.com/us/album/" + title + "/1520370274",
+			AlbumLink:   "https://music.apple.com/us/album/" + title + "/1520370274",
+			ArtworkURL:  "https://example.com/voices.jpg",
+			PlayCount:   1,
+			TrackNumber: -1,
+		}
+	}
+	spotify := func(album string, artists []string, title string) Song {
+		return Song{
+			Artist:        joinArtists(artists),
+			Album:         album,
+			Title:         title,
+			Artists:       artists,
+			ArtistsListed: true,
+			Release:       ReleaseDate{Year: 1975, Month: 11, Day: 21, Precision: PrecisionDay},
+			TrackNumber:   1,
+		}
+	}
+	rumours := func(album, artwork, title string, rel ReleaseDate) Song {
+		s := spotify(album, []string{"Fleetwood Mac"}, title)
+		s.Release = rel
+		s.ArtworkURL = artwork
+		return s
+	}
+
+	tests := []struct {
+		name  string
+		unix  int64
+		songs []Song
+		want  []string
+	}{
+		{
+			// Scrobble credits featured artists on some tracks; they are on
+			// one album.
+			"voices",
+			time.Date(2021, 8, 1, 12, 0, 0, 0, time.UTC).Unix(),
+			[]Song{
+				scrobble("Max Richter, KiKi Layne, Mari Samuelsen & Robert Ziegler", "Murmuration: Pt. 1"),
+				scrobble("Max Richter", "Prelude 6: Pt. 2"),
+				scrobble("Max Richter, KiKi Layne & Robert Ziegler", "Hypocognition: Pt. 1"),
+				scrobble("Max Richter, Grace Davidson, Mari Samuelsen & Robert Ziegler", "Chorale: Pt. 2"),
+			},
+			[]string{"Max Richter - Voices"},
+		},
+		{
+			// Band names contain separators, so Spotify albums are grouped
+			// by their listed artists, not a split credit.
+			"band names",
+			time.Date(2021, 11, 21, 12, 0, 0, 0, time.UTC).Unix(),
+			[]Song{
+				spotify("Gratitude", []string{"Earth, Wind & Fire"}, "Shining Star"),
+				spotify("Gratitude", []string{"Earth"}, "Gratitude"),
+				spotify("Greatest Hits", []string{"Simon & Garfunkel"}, "Mrs. Robinson"),
+				spotify("Greatest Hits", []string{"Simon & Garfunkel"}, "The Boxer"),
+				spotify("Greatest Hits", []string{"Simon"}, "Kodachrome"),
+			},
+			[]string{"Earth - Gratitude", "Earth, Wind & Fire - Gratitude", "Simon & Garfunkel - Greatest Hits", "Simon - Greatest Hits"},
+		},
+		{
+			// Editions are one album, represented by the original.
+			"editions",
+			time.Date(2021, 2, 4, 12, 0, 0, 0, time.UTC).Unix(),
+			preferOriginalReleases([]Song{
+				rumours("Rumours (Super Deluxe)", "https://example.com/deluxe.jpg", "Dreams", ReleaseDate{Year: 2013, Month: 1, Day: 29, Precision: PrecisionDay}),
+				rumours("Rumours", "https://example.com/rumours.jpg", "Go Your Own Way", ReleaseDate{Year: 1977, Month: 2, Day: 4, Precision: PrecisionDay}),
+				rumours("Rumours - Remastered", "https://example.com/remastered.jpg", "The Chain", ReleaseDate{Year: 2004, Precision: PrecisionYear}),
+			}),
+			[]string{"Fleetwood Mac - Rumours"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := birthdayAlbums(computeBirthdays(tt.unix, time.UTC, tt.songs, BirthdayOptions{}))
+			if !equalStrings(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchRelease(t *testing.T) {
+	day := func(y int, m time.Month, d int) ReleaseDate {
+		return ReleaseDate{Year: y, Month: m, Day: d, Precision: PrecisionDay}
+	}
+	month := func(y int, m time.Month) ReleaseDate {
+		return ReleaseDate{Year: y, Month: m, Precision: PrecisionMonth}
+	}
+	year := ReleaseDate{Year: 1999, Precision: PrecisionYear}
+	leap := day(2000, time.February, 29)
+
+	tests := []struct {
+		name   string
+		target FullDate
+		rel    ReleaseDate
+		opts   BirthdayOptions
+		want   ReleaseMatch
+	}{
+		{"day", FullDate{2021, 8, 1}, day(2020, 8, 1), BirthdayOptions{}, MatchDay},
+		{"other day", FullDate{2021, 8, 2}, day(2020, 8, 1), BirthdayOptions{}, MatchNone},
+		{"other month", FullDate{2021, 9, 1}, day(2020, 8, 1), BirthdayOptions{}, MatchNone},
+		{"same date", FullDate{2020, 8, 1}, day(2020, 8, 1), BirthdayOptions{}, MatchDay},
+		{"zero", FullDate{2021, 1, 1}, ReleaseDate{}, BirthdayOptions{MatchYear: true}, MatchNone},
+
+		// 29 February
+		{"leap day in leap year", FullDate{2024, 2, 29}, leap, BirthdayOptions{LeapDay: LeapDayNone}, MatchDay},
+		{"leap day, none", FullDate{2021, 2, 28}, leap, BirthdayOptions{LeapDay: LeapDayNone}, MatchNone},
+		{"leap day, none, march 1", FullDate{2021, 3, 1}, leap, BirthdayOptions{LeapDay: LeapDayNone}, MatchNone},
+		{"leap day, feb 28", FullDate{2021, 2, 28}, leap, BirthdayOptions{LeapDay: LeapDayFeb28}, MatchLeapDay},
+		{"leap day, feb 28, march 1", FullDate{2021, 3, 1}, leap, BirthdayOptions{LeapDay: LeapDayFeb28}, MatchNone},
+		{"leap day, mar 1", FullDate{2021, 3, 1}, leap, BirthdayOptions{LeapDay: LeapDayMar1}, MatchLeapDay},
+		{"leap day, mar 1, feb 28", FullDate{2021, 2, 28}, leap, BirthdayOptions{LeapDay: LeapDayMar1}, MatchNone},
+		{"leap day, feb 28 in leap year", FullDate{2024, 2, 28}, leap, BirthdayOptions{LeapDay: LeapDayFeb28}, MatchNone},
+		{"leap day, mar 1 in leap year", FullDate{2024, 3, 1}, leap, BirthdayOptions{LeapDay: LeapDayMar1}, MatchNone},
+		{"leap day, 2100", FullDate{2100, 2, 28}, leap, BirthdayOptions{LeapDay: LeapDayFeb28}, MatchLeapDay},
+		{"feb 28 release", FullDate{2021, 2, 28}, day(2000, 2, 28), BirthdayOptions{LeapDay: LeapDayMar1}, MatchDay},
+
+		// month precision
+		{"month, first day", FullDate{2021, 8, 1}, month(2020, 8), BirthdayOptions{}, MatchMonth},
+		{"month, first day, other day", FullDate{2021, 8, 2}, month(2020, 8), BirthdayOptions{Month: MonthFirstDay}, MatchNone},
+		{"month, any day", FullDate{2021, 8, 17}, month(2020, 8), BirthdayOptions{Month: MonthAnyDay}, MatchMonthAnyDay},
+		{"month, any day, other month", FullDate{2021, 9, 17}, month(2020, 8), BirthdayOptions{Month: MonthAnyDay}, MatchNone},
+		{"month, weekly, monday", FullDate{2021, 8, 2}, month(2020, 8), BirthdayOptions{Month: MonthWeekly}, MatchMonthWeekly},
+		{"month, weekly, sunday", FullDate{2021, 8, 1}, month(2020, 8), BirthdayOptions{Month: MonthWeekly}, MatchNone},
+
+		// year precision
+		{"year", FullDate{2021, 1, 1}, year, BirthdayOptions{MatchYear: true}, MatchYear},
+		{"year, disabled", FullDate{2021, 1, 1}, year, BirthdayOptions{}, MatchNone},
+		{"year, other day", FullDate{2021, 1, 2}, year, BirthdayOptions{MatchYear: true}, MatchNone},
+	}
+
+	for _, tt := range tests {
+		if got := matchRelease(tt.target, tt.rel, tt.opts); got != tt.want {
+			t.Errorf("%s: matchRelease(%+v, %+v): got %q, want %q", tt.name, tt.target, tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestBirthdayOptionsDefaults(t *testing.T) {
+	// Older accounts have empty values.
+	opts := AccountSettings{}.birthdayOptions(Scrobble)
+	if opts.LeapDay != LeapDayNone || opts.Month != MonthFirstDay || opts.Sort != SortMostPlayed {
+		t.Errorf("got %+v", opts)
+	}
+}
+
+func TestBirthdayOptionsMinCounts(t *testing.T) {
+	settings := AccountSettings{MinPlayCount: 5}
+	song := Song{
+		Artist:  "Fleetwood Mac",
+		Album:   "Rumours",
+		Title:   "Dreams",
+		Release: ReleaseDate{Year: 1977, Month: 2, Day: 4, Precision: PrecisionDay},
+	}
+	ts := time.Date(2020, 2, 4, 0, 0, 0, 0, time.UTC).Unix()
+
+	// Spotify songs have no play counts, so the minimum is ignored.
+	day := computeBirthdays(ts, time.UTC, []Song{song}, settings.birthdayOptions(Spotify))
+	if len(day.Items) != 1 {
+		t.Errorf("spotify: got %d items, want 1", len(day.Items))
+	}
+
+	day = computeBirthdays(ts, time.UTC, []Song{song}, settings.birthdayOptions(Scrobble))
+	if len(day.Items) != 0 {
+		t.Errorf("scrobble, not enough plays: got %d items, want 0", len(day.Items))
+	}
+	song.PlayCount = 5
+	day = computeBirthdays(ts, time.UTC, []Song{song}, settings.birthdayOptions(Scrobble))
+	if len(day.Items) != 1 {
+		t.Errorf("scrobble: got %d items, want 1", len(day.Items))
+	}
+}
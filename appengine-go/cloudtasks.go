@@ -11,7 +11,24 @@ import (
 	"google.golang.org/genproto/googleapis/cloud/tasks/v2"
 )
 
-const queueName = "projects/albumday/locations/us-central1/queues/internal"
+const (
+	queueName            = "projects/albumday/locations/us-central1/queues/internal"
+	musicBrainzQueueName = "projects/albumday/locations/us-central1/queues/musicbrainz"
+	artworkQueueName     = "projects/albumday/locations/us-central1/queues/artwork"
+)
+
+// taskQueue returns the queue for tasks that post to the path. MusicBrainz
+// lookup and artwork color tasks have their own queues, in which they don't
+// delay daily emails.
+func taskQueue(path string) string {
+	switch path {
+	case "/internal/task/musicbrainz":
+		return musicBrainzQueueName
+	case "/internal/task/artwork-color":
+		return artworkQueueName
+	}
+	return queueName
+}
 
 const headerTasksSecret = "x-tasks-secret"
 
@@ -34,7 +51,7 @@ func (c *CloudTasksClient) PostJSONTask(ctx context.Context, path string, payloa
 	}
 
 	task := &tasks.CreateTaskRequest{
-		Parent: queueName,
+		Parent: taskQueue(path),
 		Task: &tasks.Task{
 			MessageType: &tasks.Task_AppEngineHttpRequest{
 				AppEngineHttpRequest: &tasks.AppEngineHttpRequest{
@@ -64,6 +81,8 @@ type DevTasksClient struct {
 	secret string
 }
 
+// PostJSONTask posts the task to the dev server in the background, like
+// Cloud Tasks does, so that the caller isn't delayed by the task handler.
 func (c *DevTasksClient) PostJSONTask(ctx context.Context, path string, payload interface{}) error {
 	p, err := json.Marshal(payload)
 	if err != nil {
@@ -74,17 +93,21 @@ func (c *DevTasksClient) PostJSONTask(ctx context.Context, path string, payload
 	if err != nil {
 		return err
 	}
-	req = req.WithContext(ctx)
 	req.Header.Set("content-type", "application/json")
 	req.Header.Set(headerTasksSecret, c.tasksSecret())
 
-	rsp, err := c.http.Do(req)
-	if err != nil {
-		return fmt.Errorf("POST task: %s", err)
-	}
-	if !is2xxStatus(rsp.StatusCode) {
-		return StatusError{rsp.StatusCode}
-	}
+	lg := loggerFrom(ctx)
+	go func() {
+		rsp, err := c.http.Do(req)
+		if err != nil {
+			lg.Errorf("POST task %s: %s", path, err)
+			return
+		}
+		drainAndClose(rsp.Body)
+		if !is2xxStatus(rsp.StatusCode) {
+			lg.Errorf("POST task %s: %s", path, StatusError{rsp.StatusCode})
+		}
+	}()
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"cloud.google.com/go/datastore"
 )
@@ -21,12 +22,48 @@ type Config struct {
 	SpotifyClientID     string
 	SpotifyClientSecret string
 
-	CookieSecret string
-	TasksSecret  string
+	CookieSecret  string
+	TasksSecret   string
+	MetricsSecret string // bearer token for the metrics endpoint
 
 	PreviewEmail string
+
+	// BaseURL is the scheme and host for links in emails, e.g.
+	// "https://albumday.cc".
+	BaseURL string
+
+	MusicBrainzBaseURL string // or "" for the default
+
+	ReissueRules []ReissueRule // or nil for the defaults
+
+	// DeletionGracePeriod is the time after a deletion request that an
+	// account's data is purged.
+	DeletionGracePeriod time.Duration
 }
 
+// validate returns an error if a required field is missing.
+func (c Config) validate() error {
+	required := map[string]string{
+		"RedisHost":    c.RedisHost,
+		"RedisPort":    c.RedisPort,
+		"CookieSecret": c.CookieSecret,
+		"TasksSecret":  c.TasksSecret,
+	}
+	if env() == Prod {
+		required["SendgridAPIKey"] = c.SendgridAPIKey
+		required["SpotifyClientID"] = c.SpotifyClientID
+		required["SpotifyClientSecret"] = c.SpotifyClientSecret
+	}
+	for name, v := range required {
+		if v == "" {
+			return fmt.Errorf("missing %s", name)
+		}
+	}
+	return nil
+}
+
+const defaultDeletionGracePeriod = 7 * 24 * time.Hour
+
 type Metadata struct {
 	RedisHost           string
 	SendgridAPIKey      string
@@ -34,7 +71,12 @@ type Metadata struct {
 	SpotifyClientSecret string
 	CookieSecret        string
 	TasksSecret         string
+	MetricsSecret       string
 	PreviewEmail        string
+	BaseURL             string // or "" for the default
+	DeletionGraceDays   int    // or 0 for the default
+	MusicBrainzBaseURL  string // or "" for the default
+	ReissueRules        string // JSON; see parseReissueRules. Or "" for the defaults.
 }
 
 func loadConfig(ctx context.Context, ds *datastore.Client) (Config, error) {
@@ -58,6 +100,21 @@ func loadConfig(ctx context.Context, ds *datastore.Client) (Config, error) {
 			return Config{}, fmt.Errorf("get metadata: %s", err)
 		}
 
+		rules, err := loadReissueRules(m.ReissueRules)
+		if err != nil {
+			return Config{}, err
+		}
+
+		baseURL := "https://" + AppDomain
+		if m.BaseURL != "" {
+			baseURL = m.BaseURL
+		}
+
+		gracePeriod := defaultDeletionGracePeriod
+		if m.DeletionGraceDays > 0 {
+			gracePeriod = time.Duration(m.DeletionGraceDays) * 24 * time.Hour
+		}
+
 		return Config{
 			RedisHost: m.RedisHost,
 			RedisPort: "6379",
@@ -71,9 +128,19 @@ func loadConfig(ctx context.Context, ds *datastore.Client) (Config, error) {
 			SpotifyClientSecret: m.SpotifyClientSecret,
 			CookieSecret:        m.CookieSecret,
 			TasksSecret:         m.TasksSecret,
+			MetricsSecret:       m.MetricsSecret,
 			PreviewEmail:        m.PreviewEmail,
+			BaseURL:             baseURL,
+			DeletionGracePeriod: gracePeriod,
+			MusicBrainzBaseURL:  m.MusicBrainzBaseURL,
+			ReissueRules:        rules,
 		}, nil
 	case Dev:
+		rules, err := loadReissueRules(os.Getenv("REISSUE_RULES"))
+		if err != nil {
+			return Config{}, err
+		}
+
 		return Config{
 			RedisHost:           "localhost",
 			RedisPort:           "6379",
@@ -81,9 +148,26 @@ func loadConfig(ctx context.Context, ds *datastore.Client) (Config, error) {
 			SpotifyClientSecret: os.Getenv("SPOTIFY_CLIENT_SECRET"),
 			CookieSecret:        "AVR30Z8RZrDwBRgGYwM7CpcADLGLiDxjk+lTiU01sBsuAZ3eOctoGn7pqWUnwIA3hgfsqL8elZty/2YKkZCLlg==",
 			TasksSecret:         "bar",
+			MetricsSecret:       "baz",
 			PreviewEmail:        "foo@gmail.com",
+			BaseURL:             devBaseURL(),
+			DeletionGracePeriod: 10 * time.Minute,
+			MusicBrainzBaseURL:  os.Getenv("MUSICBRAINZ_BASE_URL"),
+			ReissueRules:        rules,
 		}, nil
 	default:
 		panic("unreachable")
 	}
 }
+
+// loadReissueRules parses the reissue rules in the config, if any.
+func loadReissueRules(s string) ([]ReissueRule, error) {
+	if s == "" {
+		return nil, nil
+	}
+	rules, err := parseReissueRules(s)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %s", err)
+	}
+	return rules, nil
+}
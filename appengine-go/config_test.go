@@ -0,0 +1,18 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	c := Config{RedisHost: "localhost", RedisPort: "6379", CookieSecret: "cookie", TasksSecret: "tasks"}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.TasksSecret = ""
+	if err := c.validate(); err == nil || !strings.Contains(err.Error(), "TasksSecret") {
+		t.Errorf("missing TasksSecret: got %v", err)
+	}
+}
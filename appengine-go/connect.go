@@ -3,14 +3,12 @@ package main
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/gorilla/securecookie"
 	"github.com/julienschmidt/httprouter"
 )
@@ -20,10 +18,23 @@ const (
 	cookieAgeState  = 30 * time.Minute
 )
 
+// StateCookie binds an in-progress OAuth flow to the browser that started
+// it. The state itself is opaque; the details of the flow are stored
+// server-side in an OAuthState.
 type StateCookie struct {
-	State   string
-	Email   string
-	Service Service
+	State string
+}
+
+// OAuthState is the server-side state for an in-progress OAuth flow, keyed
+// by the state parameter.
+type OAuthState struct {
+	Email        string
+	Service      Service
+	CodeVerifier string
+}
+
+func oauthStateKey(state string) string {
+	return fmt.Sprintf("oauth_state:%s", state)
 }
 
 func stateParam() string {
@@ -40,32 +51,54 @@ func stateCookieCodec(secret string) *securecookie.SecureCookie {
 		SetSerializer(securecookie.JSONEncoder{})
 }
 
+// takeOAuthState gets and deletes the OAuthState for the state parameter, so
+// that each state can be used at most once. Returns redis.Nil if there is
+// no such state.
+func (s *Server) takeOAuthState(state string) (OAuthState, error) {
+	var get *redis.StringCmd
+	if _, err := s.redis.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(oauthStateKey(state))
+		pipe.Del(oauthStateKey(state))
+		return nil
+	}); err != nil {
+		return OAuthState{}, err
+	}
+
+	b, err := get.Bytes()
+	if err != nil {
+		return OAuthState{}, err
+	}
+	var o OAuthState
+	mustUnmarshalJSON(b, &o)
+	return o, nil
+}
+
 func (s *Server) ConnectSpotifyHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := s.currentIdentity(r)
 	if email == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeUnauthorized(w)
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
-	stateCookie := StateCookie{
-		State:   stateParam(),
-		Email:   email,
-		Service: Spotify,
+	state := stateParam()
+	oauthState := OAuthState{
+		Email:        email,
+		Service:      Spotify,
+		CodeVerifier: generateCodeVerifier(),
+	}
+	if err := s.redis.Set(oauthStateKey(state), mustMarshalJSON(oauthState), cookieAgeState).Err(); err != nil {
+		lg.Errorf("SET oauth state: %s", err)
+		writeInternalError(w)
+		return
 	}
-	stateCookieJSON := mustMarshalJSON(stateCookie)
 
-	v := url.Values{}
-	v.Set("client_id", s.config.SpotifyClientID)
-	v.Set("response_type", "code")
-	v.Set("redirect_uri", spotifyRedirectURL(r))
-	v.Set("state", string(stateCookieJSON))
-	v.Set("scope", "user-library-read")
-	v.Set("show_dialog", "false")
-
-	encoded, err := s.stateCookie.Encode(cookieNameState, stateCookie)
+	encoded, err := s.stateCookie.Encode(cookieNameState, StateCookie{State: state})
 	if err != nil {
-		log.Printf("encode state cookie: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("encode state cookie: %s", err)
+		writeInternalError(w)
 		return
 	}
 	http.SetCookie(w, &http.Cookie{
@@ -73,10 +106,13 @@ func (s *Server) ConnectSpotifyHandler(w http.ResponseWriter, r *http.Request, _
 		Value:    encoded,
 		Expires:  time.Now().Add(cookieAgeState),
 		HttpOnly: true,
+		Secure:   !isDev(),
+		SameSite: http.SameSiteLaxMode,
 		Path:     "/",
 	})
 
-	http.Redirect(w, r, "https://accounts.spotify.com/authorize?"+v.Encode(), http.StatusFound)
+	u := s.spotify.AuthorizeURL(spotifyRedirectURL(r), state, oauthState.CodeVerifier)
+	http.Redirect(w, r, u, http.StatusFound)
 }
 
 func spotifyRedirectURL(userReq *http.Request) string {
@@ -92,6 +128,7 @@ func spotifyRedirectURL(userReq *http.Request) string {
 
 func (s *Server) AuthSpotifyHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	lg := loggerFrom(ctx)
 
 	successResponse := func() {
 		http.SetCookie(w, &http.Cookie{
@@ -109,7 +146,7 @@ func (s *Server) AuthSpotifyHandler(w http.ResponseWriter, r *http.Request, _ ht
 	}
 
 	if error := r.FormValue("error"); error != "" {
-		log.Printf("connect error: %s", error)
+		lg.Warningf("connect error: %s", error)
 		errorResponse()
 		return
 	}
@@ -117,84 +154,72 @@ func (s *Server) AuthSpotifyHandler(w http.ResponseWriter, r *http.Request, _ ht
 	code := r.FormValue("code")
 	state := r.FormValue("state")
 
-	// extract state from spotify
-	var spotifyState StateCookie
-	if err := json.Unmarshal([]byte(state), &spotifyState); err != nil {
-		log.Printf("json-unmarshal state: %s", err)
-		errorResponse()
-		return
-	}
-
 	// extract state from cookie
 	cookie, err := r.Cookie(cookieNameState)
 	if err != nil {
-		log.Printf("get state cookie %s: %s", cookieNameState, err)
+		lg.Warningf("get state cookie %s: %s", cookieNameState, err)
 		errorResponse()
 		return
 	}
 	var cookieState StateCookie
 	err = s.stateCookie.Decode(cookieNameState, cookie.Value, &cookieState)
 	if err != nil {
-		log.Printf("decode state cookie: %s", err)
+		lg.Warningf("decode state cookie: %s", err)
 		errorResponse()
 		return
 	}
 
 	// ensure state matches
-	if cookieState.State != spotifyState.State {
-		log.Printf("state mismatch: %s != %s", cookieState.State, spotifyState.State)
+	if state == "" || cookieState.State != state {
+		lg.Warningf("state mismatch")
 		errorResponse()
 		return
 	}
 
-	// fetch tokens
-	v := url.Values{}
-	v.Set("grant_type", "authorization_code")
-	v.Set("code", code)
-	v.Set("redirect_uri", spotifyRedirectURL(r))
-	v.Set("client_id", s.config.SpotifyClientID)
-	v.Set("client_secret", s.config.SpotifyClientSecret)
-
-	req, err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", strings.NewReader(v.Encode()))
+	oauthState, err := s.takeOAuthState(state)
+	if err == redis.Nil {
+		lg.Warningf("missing oauth state: expired or already used")
+		errorResponse()
+		return
+	}
 	if err != nil {
-		log.Printf("new request: %s", err)
+		lg.Errorf("take oauth state: %s", err)
 		errorResponse()
 		return
 	}
-	req = req.WithContext(ctx)
-	req.Header.Set("content-type", "application/x-www-form-urlencoded")
+	lg = lg.With("account", accountHash(oauthState.Email), "service", Spotify)
 
-	rsp, err := s.http.Do(req)
-	if err != nil {
-		log.Printf("do spotify request: %s", err)
+	if oauthState.Service != Spotify || oauthState.Email != s.currentIdentity(r) {
+		lg.Warningf("oauth state does not match current identity or service")
 		errorResponse()
 		return
 	}
-	defer drainAndClose(rsp.Body)
-	if !is2xxStatus(rsp.StatusCode) {
-		log.Printf("bad status: %s", rsp.StatusCode)
+
+	// fetch tokens
+	tok, err := s.spotify.Exchange(ctx, code, spotifyRedirectURL(r), oauthState.CodeVerifier)
+	if err != nil {
+		lg.Errorf("exchange spotify code: %s", err)
 		errorResponse()
 		return
 	}
 
-	var tokenRsp SpotifyTokenResponse
-	if err := json.NewDecoder(rsp.Body).Decode(&tokenRsp); err != nil {
-		log.Printf("json-decode spotify token response: %s", err)
+	// The stored library may be of a different Spotify account.
+	if err := s.clearLibrary(oauthState.Email); err != nil {
+		lg.Errorf("clear library: %s", err)
 		errorResponse()
 		return
 	}
 
-	accountEmail := cookieState.Email
-	if err := UpdateEntity(s.redis, accountKey(accountEmail), &Account{}, func(v interface{}) interface{} {
+	if err := UpdateEntity(s.redis, accountKey(oauthState.Email), &Account{}, func(v interface{}) interface{} {
 		a := v.(*Account)
 		a.Connection = &Connection{
 			Service: Spotify,
-			Conn:    Conn{RefreshToken: tokenRsp.RefreshToken},
+			Conn:    Conn{RefreshToken: tok.RefreshToken},
 			Error:   nil,
 		}
 		return a
 	}); err != nil {
-		log.Printf("update connection: %s", err)
+		lg.Errorf("update connection: %s", err)
 		errorResponse()
 		return
 	}
@@ -202,28 +227,20 @@ func (s *Server) AuthSpotifyHandler(w http.ResponseWriter, r *http.Request, _ ht
 	successResponse()
 }
 
-type SpotifyTokenResponse struct {
-	RefreshToken string `json:"refresh_token"`
-	// Don't care about below fields.
-	//
-	// AccessToken  string `json:"access_token"`
-	// TokenType    string `json:"token_type"`
-	// Scope        string `json:"scope"`
-	// ExpiresIn    int    `json:"expires_in"`
-}
-
 func (s *Server) ConnectScrobbleHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	lg := loggerFrom(ctx)
 
 	email := s.currentIdentity(r)
 	if email == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+		writeUnauthorized(w)
 		return
 	}
+	lg = lg.With("account", accountHash(email), "service", Scrobble)
 
 	scrobbleUsername := r.FormValue("username")
 	if scrobbleUsername == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBadRequest(w, "username required")
 		return
 	}
 
@@ -234,33 +251,39 @@ func (s *Server) ConnectScrobbleHandler(w http.ResponseWriter, r *http.Request,
 
 	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
-		log.Printf("new request: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("new request: %s", err)
+		writeInternalError(w)
 		return
 	}
 	req = req.WithContext(ctx)
 
 	rsp, err := s.http.Do(req)
 	if err != nil {
-		log.Printf("get scrobbled: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("get scrobbled: %s", err)
+		writeInternalError(w)
 		return
 	}
 	defer drainAndClose(rsp.Body)
 
 	if !is2xxStatus(rsp.StatusCode) {
-		log.Printf("bad status: %d", rsp.StatusCode)
+		lg.Warningf("bad status: %d", rsp.StatusCode)
 		switch rsp.StatusCode {
 		case 403:
-			w.WriteHeader(409) // profile appears to be private
+			writeConnectionError(w, http.StatusConflict, Scrobble, ConnectionErrPermission)
 		case 404:
-			w.WriteHeader(404) // profile not found
+			writeConnectionError(w, http.StatusNotFound, Scrobble, ConnectionErrNotFound)
 		default:
-			w.WriteHeader(http.StatusInternalServerError)
+			writeConnectionError(w, http.StatusInternalServerError, Scrobble, ConnectionErrGeneric)
 		}
 		return
 	}
 
+	if err := s.clearLibrary(email); err != nil {
+		lg.Errorf("clear library: %s", err)
+		writeInternalError(w)
+		return
+	}
+
 	if err := UpdateEntity(s.redis, accountKey(email), &Account{}, func(v interface{}) interface{} {
 		a := v.(*Account)
 		a.Connection = &Connection{
@@ -270,8 +293,17 @@ func (s *Server) ConnectScrobbleHandler(w http.ResponseWriter, r *http.Request,
 		}
 		return a
 	}); err != nil {
-		log.Printf("update connection: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		lg.Errorf("update connection: %s", err)
+		writeInternalError(w)
 		return
 	}
 }
+
+// clearLibrary deletes the account's cached and stored libraries, so that
+// a new connection doesn't start from the previous connection's library.
+func (s *Server) clearLibrary(email string) error {
+	if err := s.redis.Del(libraryCacheKey(Spotify, email), libraryCacheKey(Scrobble, email), spotifyLibraryKey(email)).Err(); err != nil {
+		return fmt.Errorf("DEL library: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectScrobbleClearsLibrary(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.http = &http.Client{Transport: hostTransport{
+		"selective-scrobble.appspot.com": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"songs": []}`))
+		}),
+	}}
+
+	const email = "foo@example.com"
+	putTestAccount(t, s, email, Account{Connection: &Connection{Service: Spotify, Conn: Conn{RefreshToken: "refresh"}}})
+	keys := []string{libraryCacheKey(Spotify, email), spotifyLibraryKey(email)}
+	for _, k := range keys {
+		if err := s.redis.Set(k, "[]", 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/connect/scrobble", strings.NewReader("username=bar"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(testIdentityCookie(t, s, email))
+	rec := httptest.NewRecorder()
+	s.ConnectScrobbleHandler(rec, req, nil)
+	if rec.Code != 200 {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, k := range keys {
+		if n, _ := s.redis.Exists(k).Result(); n != 0 {
+			t.Errorf("%s not deleted", k)
+		}
+	}
+	acc, err := getAccount(accountKey(email), s.redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Connection.Service != Scrobble || acc.Connection.Username != "bar" {
+		t.Errorf("got connection %+v", acc.Connection)
+	}
+}
+
+func TestCodeChallenge(t *testing.T) {
+	// RFC 7636 Appendix B.
+	const verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	if got, want := codeChallenge(verifier), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestAuthSpotifyHandler(t *testing.T) {
+	s, f := newTestServer(t)
+	spotify := &fakeSpotify{refreshToken: "refresh"}
+	_, s.spotify = spotify.client()
+
+	const email = "foo@example.com"
+	putTestAccount(t, s, email, Account{})
+	identity := testIdentityCookie(t, s, email)
+
+	// connect starts the flow, and returns the state and its cookie
+	var challenge string
+	connect := func() (string, *http.Cookie) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/connect/spotify", nil)
+		req.AddCookie(identity)
+		rec := httptest.NewRecorder()
+		s.ConnectSpotifyHandler(rec, req, nil)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("connect: got %d", rec.Code)
+		}
+		u, err := url.Parse(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := u.Query().Get("state")
+		challenge = u.Query().Get("code_challenge")
+		if ttl := f.ttl(oauthStateKey(state)); ttl <= 0 || ttl > cookieAgeState {
+			t.Errorf("state TTL %s", ttl)
+		}
+		return state, rec.Result().Cookies()[0]
+	}
+
+	// auth completes the flow, and returns whether it succeeded
+	auth := func(state string, cookies ...*http.Cookie) bool {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/auth/spotify?code=code&state="+state, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		s.AuthSpotifyHandler(rec, req, nil)
+		return rec.Header().Get("Location") == "/feed?connect-success=1"
+	}
+
+	state, stateCookie := connect()
+	if !auth(state, identity, stateCookie) {
+		t.Fatal("auth failed")
+	}
+	if got := codeChallenge(spotify.tokenForm.Get("code_verifier")); got != challenge {
+		t.Errorf("code verifier does not match challenge %s", challenge)
+	}
+	acc, err := getAccount(accountKey(email), s.redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Connection == nil || acc.Connection.Service != Spotify || acc.Connection.RefreshToken != "refresh" {
+		t.Errorf("got connection %+v", acc.Connection)
+	}
+
+	t.Run("reused", func(t *testing.T) {
+		if auth(state, identity, stateCookie) {
+			t.Error("reused state accepted")
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		other := stateParam()
+		encoded, err := s.stateCookie.Encode(cookieNameState, StateCookie{State: other})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth(other, identity, &http.Cookie{Name: cookieNameState, Value: encoded}) {
+			t.Error("unknown state accepted")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		state, stateCookie := connect()
+		if err := s.redis.PExpire(oauthStateKey(state), time.Millisecond).Err(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if auth(state, identity, stateCookie) {
+			t.Error("expired state accepted")
+		}
+	})
+
+	t.Run("other identity", func(t *testing.T) {
+		state, stateCookie := connect()
+		putTestAccount(t, s, "bar@example.com", Account{})
+		if auth(state, testIdentityCookie(t, s, "bar@example.com"), stateCookie) {
+			t.Error("state accepted for another identity")
+		}
+		if n, _ := s.redis.Exists(oauthStateKey(state)).Result(); n != 0 {
+			t.Error("state not consumed")
+		}
+	})
+
+	t.Run("no state cookie", func(t *testing.T) {
+		state, _ := connect()
+		if auth(state, identity) {
+			t.Error("state accepted without cookie")
+		}
+	})
+}
+
+func TestFetchSongsPersistsRotatedRefreshToken(t *testing.T) {
+	s, _ := newTestServer(t)
+	track := testSavedTrack("a", "2020-01-01T00:00:00Z")
+	track.Track.Album.ReleaseDate, track.Track.Album.ReleaseDatePrecision = "1977-02-04", "day"
+	spotify := &fakeSpotify{
+		tracks:       []SpotifySavedTrack{track},
+		pageSize:     50,
+		refreshToken: "rotated",
+	}
+	s.http, s.spotify = spotify.client()
+
+	const email = "foo@example.com"
+	conn := Connection{Service: Spotify, Conn: Conn{RefreshToken: "refresh"}}
+	putTestAccount(t, s, email, Account{Connection: &conn})
+
+	songs, err := s.fetchSongs(context.Background(), email, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(songs) != 1 {
+		t.Errorf("got %d songs", len(songs))
+	}
+	if got := spotify.tokenForm.Get("refresh_token"); got != "refresh" {
+		t.Errorf("refreshed with %q", got)
+	}
+	acc, err := getAccount(accountKey(email), s.redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.Connection.RefreshToken != "rotated" {
+		t.Errorf("got refresh token %q, want rotated", acc.Connection.RefreshToken)
+	}
+}
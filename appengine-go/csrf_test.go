@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireSameOrigin(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := RequireSameOrigin(ok)
+
+	const host = "albumday.cc"
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		headers map[string]string
+		want    int
+	}{
+		{"same origin", "POST", "/api/v1/login", map[string]string{"Origin": "https://" + host}, 200},
+		{"same origin referer", "DELETE", "/api/v1/account", map[string]string{"Referer": "https://" + host + "/settings"}, 200},
+		{"cross-site origin", "POST", "/api/v1/login", map[string]string{"Origin": "https://evil.example"}, 403},
+		{"cross-site referer", "DELETE", "/api/v1/account", map[string]string{"Referer": "https://evil.example/page"}, 403},
+		{"origin overrides referer", "POST", "/connect/scrobble", map[string]string{"Origin": "https://evil.example", "Referer": "https://" + host + "/feed"}, 403},
+		{"null origin, cross-site referer", "POST", "/connect/scrobble", map[string]string{"Origin": "null", "Referer": "https://evil.example/"}, 403},
+		{"missing origin and referer", "PATCH", "/api/v1/account/settings", nil, 403},
+		{"lookalike host", "POST", "/api/v1/mutes/artists", map[string]string{"Origin": "https://" + host + ".evil.example"}, 403},
+		{"unparseable origin", "POST", "/api/v1/tokens", map[string]string{"Origin": "://"}, 403},
+		{"bearer token is not exempt", "DELETE", "/api/v1/account", map[string]string{"Authorization": "Bearer ad_x", "Origin": "https://evil.example"}, 403},
+		{"bearer token without origin", "POST", "/api/v1/tokens", map[string]string{"Authorization": "Bearer ad_x"}, 403},
+
+		{"safe method", "GET", "/api/v1/account", map[string]string{"Origin": "https://evil.example"}, 200},
+		{"internal", "POST", "/internal/task/daily-email", nil, 200},
+		{"unsub one-click", "POST", "/unsub", map[string]string{"Origin": "https://mail.example"}, 200},
+		{"mute confirm", "POST", "/mute", nil, 200},
+		{"undo delete confirm", "POST", "/undo-delete", nil, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "https://"+host+tt.path, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status: got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
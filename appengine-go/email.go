@@ -13,9 +13,17 @@ var templateFuncs = template.FuncMap{
 	},
 	"lower": strings.ToLower,
 	"releaseMatchMonth": func(r ReleaseMatch) bool {
-		return r == MatchMonth
+		return r.monthly()
 	},
-	"pluralize": pluralize,
+	"releaseMatchLeapDay": func(r ReleaseMatch) bool {
+		return r == MatchLeapDay
+	},
+	"releaseMatchYear": func(r ReleaseMatch) bool {
+		return r == MatchYear
+	},
+	"pluralize":   pluralize,
+	"tintColor":   tintColor,
+	"joinArtists": joinArtists,
 	"yearsAgo": func(todayYear int, year int) string {
 		return fmt.Sprintf("%dy ago", todayYear-year)
 	},
@@ -31,7 +39,9 @@ type EmailTmplArgs struct {
 	Today         time.Time
 	AppVisitURL   string
 	BirthdayItems []BirthdayItem
+	OmittedItems  int // number of matching albums excluded by the account's settings
 	UnsubURL      string
+	MuteAlbumURL  func(Album) string // or nil
 	SupportEmail  string
 	Browser       bool
 	IsDev         bool
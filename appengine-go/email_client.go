@@ -63,6 +63,22 @@ func (l *LoggingEmailClient) Send(to []string, subject string, bodyText string,
 	return nil
 }
 
+// MetricsEmailClient records metrics for emails sent via the underlying
+// client.
+type MetricsEmailClient struct {
+	EmailClient
+}
+
+func (m *MetricsEmailClient) Send(to []string, subject string, bodyText string, bodyHTML string, header map[string]string) error {
+	err := m.EmailClient.Send(to, subject, bodyText, bodyHTML, header)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	emailSendTotal.Inc(result)
+	return err
+}
+
 func newEmailClient(sendgridAPIKey string) EmailClient {
 	switch env() {
 	case Prod:
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 )
 
@@ -33,3 +34,14 @@ func devAddr() string {
 func devBaseURL() string {
 	return "http://" + devAddr()
 }
+
+// requestBaseURL returns the scheme and host that the request was made to,
+// e.g. "https://albumday.cc". App Engine terminates TLS and sets
+// X-Forwarded-Proto.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// deployVersion identifies the deployed version of the app, so that ETags
+// change when the code that computes responses may have changed.
+// https://cloud.google.com/appengine/docs/standard/go/runtime#environment_variables
+var deployVersion = os.Getenv("GAE_VERSION")
+
+// computeETag returns a weak ETag for a response that is determined by
+// the parts. It's weak because Gzip may compress the response, and the
+// gzip and identity encodings of a response aren't byte-for-byte
+// equivalent, so they must not share a strong ETag.
+// https://tools.ietf.org/html/rfc7232#section-2.1
+func computeETag(parts ...string) string {
+	h := sha256.New()
+	h.Write([]byte(deployVersion))
+	for _, p := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(p))
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// libraryVersion identifies the contents of a library.
+func libraryVersion(songs []Song) string {
+	h := sha256.Sum256(mustMarshalJSON(songs))
+	return hex.EncodeToString(h[:16])
+}
+
+// etagMatches reports whether the If-None-Match header value matches the
+// ETag, using weak comparison.
+// https://tools.ietf.org/html/rfc7232#section-3.2
+func etagMatches(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(v), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotModified sets the validator and cache headers for a private
+// response that must be revalidated before reuse. If the request's
+// If-None-Match header matches the ETag, it writes a 304 response and
+// returns true.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Add("Vary", "Cookie, Authorization")
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
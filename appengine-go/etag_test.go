@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckNotModified(t *testing.T) {
+	etag := computeETag("a", "b")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("ETag %s is not weak", etag)
+	}
+
+	for _, inm := range []string{etag, strings.TrimPrefix(etag, "W/"), `"x", ` + etag} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("If-None-Match", inm)
+		rec := httptest.NewRecorder()
+		if !checkNotModified(rec, req, etag) || rec.Code != 304 {
+			t.Errorf("If-None-Match %s: not matched", inm)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `W/"other"`)
+	if checkNotModified(httptest.NewRecorder(), req, etag) {
+		t.Errorf("mismatched ETag matched")
+	}
+}
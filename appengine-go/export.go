@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// exportInterval is the minimum interval between data exports for an
+// account, when requested via the API.
+const exportInterval = 1 * time.Hour
+
+func exportRateLimitKey(email string) string {
+	return fmt.Sprintf("export_ratelimit:%s", email)
+}
+
+// AccountExport is the data stored about an account. Secrets, such as
+// connection refresh tokens and API token hashes, are omitted. There is no
+// stored email delivery history or server-side session data to include.
+type AccountExport struct {
+	Exported  int64              `json:"exported"` // unix seconds
+	Email     string             `json:"email"`
+	Account   AccountResponse    `json:"account"`
+	APITokens []APIToken         `json:"apiTokens"`
+	Mutes     Mutes              `json:"mutes"`
+	Libraries map[Service][]Song `json:"libraries"` // cached libraries, by service
+
+	SpotifyLibrary *SpotifyLibrary `json:"spotifyLibrary"` // stored for incremental sync; or null
+}
+
+// accountExport returns the export for the account. Returns redis.Nil if
+// there is no such account.
+func (s *Server) accountExport(ctx context.Context, email string) (AccountExport, error) {
+	acc, err := getAccount(accountKey(email), s.redis)
+	if err != nil {
+		return AccountExport{}, err
+	}
+
+	tokens, err := s.getAPITokens(email)
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("get api tokens: %s", err)
+	}
+
+	mutes, err := s.getMutes(email)
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("get mutes: %s", err)
+	}
+
+	libraries := make(map[Service][]Song)
+	for _, service := range AllServices {
+		if songs := s.getSongsFromCache(ctx, service, email); songs != nil {
+			libraries[service] = songs
+		}
+	}
+
+	spotifyLibrary, err := s.getSpotifyLibrary(email)
+	if err != nil {
+		return AccountExport{}, fmt.Errorf("get spotify library: %s", err)
+	}
+
+	return AccountExport{
+		Exported:  time.Now().Unix(),
+		Email:     email,
+		Account:   toAccountResponse(acc),
+		APITokens: tokens,
+		Mutes:     mutes,
+		Libraries: libraries,
+
+		SpotifyLibrary: spotifyLibrary,
+	}, nil
+}
+
+func (s *Server) ExportAccountHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	ok, err := s.redis.SetNX(exportRateLimitKey(email), time.Now().Unix(), exportInterval).Result()
+	if err != nil {
+		lg.Errorf("SETNX export rate limit: %s", err)
+		writeInternalError(w)
+		return
+	}
+	if !ok {
+		lg.Infof("export rate limited")
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(exportInterval/time.Second)))
+		writeAPIError(w, http.StatusTooManyRequests, APIError{
+			Code:    ErrCodeRateLimited,
+			Message: fmt.Sprintf("exports are limited to one per %s", exportInterval),
+		})
+		return
+	}
+
+	export, err := s.accountExport(r.Context(), email)
+	if err != nil {
+		// release the rate limit slot, since no export was made
+		if err := s.redis.Del(exportRateLimitKey(email)).Err(); err != nil {
+			lg.Errorf("DEL export rate limit: %s", err) // only log
+		}
+		if err == redis.Nil {
+			writeNotFound(w, "no such account")
+			return
+		}
+		lg.Errorf("account export: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	lg.Infof("exported account data")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="albumday-export.json"`)
+	if err := writeIndentedJSON(w, export); err != nil {
+		lg.Errorf("write response: %s", err)
+	}
+}
+
+// exportAccountCommand writes the export for the account to w. It is the
+// admin equivalent of ExportAccountHandler, and is not rate limited.
+func (s *Server) exportAccountCommand(ctx context.Context, w io.Writer, email string) error {
+	export, err := s.accountExport(ctx, email)
+	if err == redis.Nil {
+		return fmt.Errorf("no such account %s", email)
+	}
+	if err != nil {
+		return fmt.Errorf("account export: %s", err)
+	}
+	loggerFrom(ctx).With("account", accountHash(email)).Infof("exported account data (admin)")
+	return writeIndentedJSON(w, export)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExportAccountHandlerRateLimit(t *testing.T) {
+	s, _ := newTestServer(t)
+	const email = "a@example.com"
+
+	export := func() int {
+		req := httptest.NewRequest("GET", "/api/v1/account/export", nil)
+		req.AddCookie(testIdentityCookie(t, s, email))
+		rec := httptest.NewRecorder()
+		s.ExportAccountHandler(rec, req, nil)
+		return rec.Code
+	}
+
+	// A failed export doesn't use up the rate limit.
+	if got := export(); got != 404 {
+		t.Fatalf("missing account: got %d, want 404", got)
+	}
+	if got := export(); got != 404 {
+		t.Fatalf("missing account, again: got %d, want 404", got)
+	}
+
+	putTestAccount(t, s, email, Account{Connection: &Connection{Service: Spotify, Conn: Conn{RefreshToken: "secret"}}})
+	if got := export(); got != 200 {
+		t.Fatalf("export: got %d, want 200", got)
+	}
+	if got := export(); got != 429 {
+		t.Fatalf("second export: got %d, want 429", got)
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeRedis is an in-memory server that speaks enough of the Redis protocol
+// for the commands the server uses, so that tests don't need a Redis
+// instance. It supports strings, hashes, sets, expiration, and WATCH,
+// MULTI and EXEC.
+type fakeRedis struct {
+	mu      sync.Mutex
+	values  map[string]interface{} // string | map[string]string | map[string]bool
+	expires map[string]time.Time
+	version map[string]int // incremented on each modification, for WATCH
+
+	// beforeExec, if set, is called with the lock held before each EXEC,
+	// to simulate a concurrent modification.
+	beforeExec func()
+}
+
+// newTestRedis returns a client for a new fakeRedis, which is closed at the
+// end of the test.
+func newTestRedis(t *testing.T) (*redis.Client, *fakeRedis) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		values:  make(map[string]interface{}),
+		expires: make(map[string]time.Time),
+		version: make(map[string]int),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	c := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	t.Cleanup(func() {
+		c.Close()
+		ln.Close()
+	})
+	return c, f
+}
+
+// ttl returns the time to live of the key, or 0 if it has no expiration.
+func (f *fakeRedis) ttl(key string) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if at, ok := f.expires[key]; ok {
+		return time.Until(at)
+	}
+	return 0
+}
+
+type fakeConn struct {
+	watched map[string]int // key -> version when watched
+	queue   [][]string     // nil if not in MULTI
+	inMulti bool
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	c := &fakeConn{}
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		reply := f.handle(c, args)
+		f.mu.Unlock()
+		writeReply(w, reply)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimSuffix(line, "\r\n"), err
+}
+
+type (
+	statusReply string
+	errorReply  string
+	nilReply    struct{}
+	nilArray    struct{}
+)
+
+func writeReply(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case statusReply:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case errorReply:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case nilReply:
+		fmt.Fprintf(w, "$-1\r\n")
+	case nilArray:
+		fmt.Fprintf(w, "*-1\r\n")
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	default:
+		panic(fmt.Sprintf("bad reply type %T", v))
+	}
+}
+
+func (f *fakeRedis) handle(c *fakeConn, args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	switch cmd {
+	case "MULTI":
+		c.inMulti = true
+		c.queue = nil
+		return statusReply("OK")
+	case "EXEC":
+		defer func() {
+			c.inMulti, c.queue, c.watched = false, nil, nil
+		}()
+		if f.beforeExec != nil {
+			f.beforeExec()
+		}
+		for k, v := range c.watched {
+			f.expire(k)
+			if f.version[k] != v {
+				return nilArray{}
+			}
+		}
+		var replies []interface{}
+		for _, q := range c.queue {
+			replies = append(replies, f.exec(q))
+		}
+		return replies
+	case "DISCARD":
+		c.inMulti, c.queue = false, nil
+		return statusReply("OK")
+	case "WATCH":
+		if c.watched == nil {
+			c.watched = make(map[string]int)
+		}
+		for _, k := range args[1:] {
+			f.expire(k)
+			c.watched[k] = f.version[k]
+		}
+		return statusReply("OK")
+	case "UNWATCH":
+		c.watched = nil
+		return statusReply("OK")
+	}
+	if c.inMulti {
+		c.queue = append(c.queue, args)
+		return statusReply("QUEUED")
+	}
+	return f.exec(args)
+}
+
+// expire deletes the key if it has expired.
+func (f *fakeRedis) expire(key string) {
+	if at, ok := f.expires[key]; ok && !time.Now().Before(at) {
+		f.del(key)
+	}
+}
+
+func (f *fakeRedis) del(key string) bool {
+	_, ok := f.values[key]
+	delete(f.values, key)
+	delete(f.expires, key)
+	if ok {
+		f.version[key]++
+	}
+	return ok
+}
+
+func (f *fakeRedis) set(key string, v interface{}) {
+	f.values[key] = v
+	f.version[key]++
+}
+
+func (f *fakeRedis) hash(key string, create bool) (map[string]string, error) {
+	v, ok := f.values[key]
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		h := make(map[string]string)
+		f.values[key] = h
+		return h, nil
+	}
+	h, ok := v.(map[string]string)
+	if !ok {
+		return nil, errWrongType
+	}
+	return h, nil
+}
+
+func (f *fakeRedis) setMembers(key string, create bool) (map[string]bool, error) {
+	v, ok := f.values[key]
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		s := make(map[string]bool)
+		f.values[key] = s
+		return s, nil
+	}
+	s, ok := v.(map[string]bool)
+	if !ok {
+		return nil, errWrongType
+	}
+	return s, nil
+}
+
+var errWrongType = fmt.Errorf("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+func (f *fakeRedis) exec(args []string) interface{} {
+	cmd := strings.ToUpper(args[0])
+	for _, k := range commandKeys(cmd, args) {
+		f.expire(k)
+	}
+
+	switch cmd {
+	case "PING":
+		return statusReply("PONG")
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return nilReply{}
+		}
+		s, ok := v.(string)
+		if !ok {
+			return errorReply(errWrongType.Error())
+		}
+		return s
+	case "MGET":
+		var ret []interface{}
+		for _, k := range args[1:] {
+			if s, ok := f.values[k].(string); ok {
+				ret = append(ret, s)
+			} else {
+				ret = append(ret, nilReply{})
+			}
+		}
+		return ret
+	case "SET":
+		key, value := args[1], args[2]
+		var ttl time.Duration
+		nx, xx := false, false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "EX", "PX":
+				n, _ := strconv.Atoi(args[i+1])
+				unit := time.Second
+				if strings.ToUpper(args[i]) == "PX" {
+					unit = time.Millisecond
+				}
+				ttl = time.Duration(n) * unit
+				i++
+			case "NX":
+				nx = true
+			case "XX":
+				xx = true
+			}
+		}
+		_, exists := f.values[key]
+		if (nx && exists) || (xx && !exists) {
+			return nilReply{}
+		}
+		f.set(key, value)
+		delete(f.expires, key)
+		if ttl > 0 {
+			f.expires[key] = time.Now().Add(ttl)
+		}
+		return statusReply("OK")
+	case "SETNX":
+		if _, ok := f.values[args[1]]; ok {
+			return 0
+		}
+		f.set(args[1], args[2])
+		return 1
+	case "INCR":
+		n := 0
+		if s, ok := f.values[args[1]].(string); ok {
+			n, _ = strconv.Atoi(s)
+		}
+		n++
+		f.set(args[1], strconv.Itoa(n))
+		return n
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if f.del(k) {
+				n++
+			}
+		}
+		return n
+	case "EXISTS":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := f.values[k]; ok {
+				n++
+			}
+		}
+		return n
+	case "EXPIRE", "PEXPIRE":
+		if _, ok := f.values[args[1]]; !ok {
+			return 0
+		}
+		n, _ := strconv.Atoi(args[2])
+		unit := time.Second
+		if cmd == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		f.expires[args[1]] = time.Now().Add(time.Duration(n) * unit)
+		f.version[args[1]]++
+		return 1
+	case "TTL", "PTTL":
+		if _, ok := f.values[args[1]]; !ok {
+			return -2
+		}
+		at, ok := f.expires[args[1]]
+		if !ok {
+			return -1
+		}
+		unit := time.Second
+		if cmd == "PTTL" {
+			unit = time.Millisecond
+		}
+		return int(time.Until(at) / unit)
+	case "KEYS":
+		var ret []interface{}
+		var keys []string
+		for k := range f.values {
+			f.expire(k)
+			if _, ok := f.values[k]; !ok {
+				continue
+			}
+			if ok, _ := path.Match(args[1], k); ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ret = append(ret, k)
+		}
+		return ret
+	case "HSET":
+		h, err := f.hash(args[1], true)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		n := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, ok := h[args[i]]; !ok {
+				n++
+			}
+			h[args[i]] = args[i+1]
+		}
+		f.version[args[1]]++
+		return n
+	case "HGET":
+		h, err := f.hash(args[1], false)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		v, ok := h[args[2]]
+		if !ok {
+			return nilReply{}
+		}
+		return v
+	case "HVALS":
+		h, err := f.hash(args[1], false)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		var fields []string
+		for k := range h {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+		ret := []interface{}{}
+		for _, k := range fields {
+			ret = append(ret, h[k])
+		}
+		return ret
+	case "HLEN":
+		h, err := f.hash(args[1], false)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		return len(h)
+	case "HDEL":
+		h, err := f.hash(args[1], false)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		n := 0
+		for _, field := range args[2:] {
+			if _, ok := h[field]; ok {
+				delete(h, field)
+				n++
+			}
+		}
+		if n > 0 {
+			f.version[args[1]]++
+		}
+		if len(h) == 0 && h != nil {
+			f.del(args[1])
+		}
+		return n
+	case "SADD":
+		s, err := f.setMembers(args[1], true)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		n := 0
+		for _, m := range args[2:] {
+			if !s[m] {
+				s[m] = true
+				n++
+			}
+		}
+		f.version[args[1]]++
+		return n
+	case "SISMEMBER":
+		s, err := f.setMembers(args[1], false)
+		if err != nil {
+			return errorReply(err.Error())
+		}
+		if s[args[2]] {
+			return 1
+		}
+		return 0
+	default:
+		return errorReply("ERR unknown command '" + args[0] + "'")
+	}
+}
+
+// commandKeys returns the keys that the command accesses.
+func commandKeys(cmd string, args []string) []string {
+	switch cmd {
+	case "PING", "KEYS":
+		return nil
+	case "MGET", "DEL", "EXISTS":
+		return args[1:]
+	default:
+		if len(args) > 1 {
+			return args[1:2]
+		}
+		return nil
+	}
+}
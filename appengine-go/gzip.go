@@ -0,0 +1,134 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipThreshold is the response size above which responses are compressed.
+// Smaller responses don't benefit much, since they fit in a packet or so.
+const gzipThreshold = 1400
+
+// Gzip compresses responses larger than gzipThreshold if the client
+// accepts gzip encoding and the content type is compressible.
+func Gzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close(r)
+		h.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		v = strings.TrimSpace(v)
+		if i := strings.Index(v, ";"); i != -1 {
+			if strings.TrimSpace(v[i+1:]) == "q=0" {
+				continue
+			}
+			v = strings.TrimSpace(v[:i])
+		}
+		if v == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+func compressibleContentType(ct string) bool {
+	return strings.HasPrefix(ct, "text/") ||
+		strings.Contains(ct, "json") ||
+		strings.Contains(ct, "javascript") ||
+		strings.Contains(ct, "xml") ||
+		strings.HasPrefix(ct, "image/svg")
+}
+
+// gzipResponseWriter buffers the response until it exceeds gzipThreshold,
+// at which point it decides whether to compress it.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer // or nil if not compressing
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.decided {
+		if g.gz != nil {
+			return g.gz.Write(p)
+		}
+		return g.ResponseWriter.Write(p)
+	}
+
+	g.buf = append(g.buf, p...)
+	if len(g.buf) < gzipThreshold {
+		return len(p), nil
+	}
+	if err := g.decide(true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// decide writes the header and the buffered data, compressing if
+// large is true and the response is compressible.
+func (g *gzipResponseWriter) decide(large bool) error {
+	g.decided = true
+
+	h := g.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+
+	if large && h.Get("Content-Encoding") == "" && compressibleContentType(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.ResponseWriter.WriteHeader(g.status)
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+		_, err := g.gz.Write(g.buf)
+		g.buf = nil
+		return err
+	}
+
+	g.ResponseWriter.WriteHeader(g.status)
+	_, err := g.ResponseWriter.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipResponseWriter) close(r *http.Request) {
+	if !g.decided {
+		if len(g.buf) == 0 { // no body; e.g. 304
+			g.decided = true
+			if g.status != 0 {
+				g.ResponseWriter.WriteHeader(g.status)
+			}
+			return
+		}
+		if err := g.decide(false); err != nil {
+			loggerFrom(r.Context()).Warningf("write response: %s", err)
+		}
+		return
+	}
+	if g.gz != nil {
+		if err := g.gz.Close(); err != nil {
+			loggerFrom(r.Context()).Warningf("close gzip writer: %s", err)
+		}
+	}
+}
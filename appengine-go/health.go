@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const readinessTimeout = 2 * time.Second
+
+type HealthResponse struct {
+	Status string                 `json:"status"` // "ok" | "unavailable"
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status    string  `json:"status"` // "ok" | "error"
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// runHealthCheck runs the named check. The endpoint is public, so the
+// response only has a generic error; the details are logged.
+func runHealthCheck(ctx context.Context, name string, f func() error) HealthCheck {
+	start := time.Now()
+	err := f()
+	c := HealthCheck{
+		Status:    "ok",
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		loggerFrom(ctx).Warningf("readiness check %s: %s", name, err)
+		c.Status = "error"
+		c.Error = name + " unavailable"
+	}
+	return c
+}
+
+// HealthzHandler reports whether the process is up.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealthResponse(w, r, http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// ReadyzHandler reports whether the server's dependencies are available.
+// It responds with 503 if Redis is unreachable. The config is static, so
+// it's validated at startup instead; see run.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := map[string]HealthCheck{
+		"redis": runHealthCheck(ctx, "redis", func() error {
+			return s.redis.WithContext(ctx).Ping().Err()
+		}),
+	}
+
+	rsp := HealthResponse{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, c := range checks {
+		if c.Status != "ok" {
+			rsp.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	writeHealthResponse(w, r, code, rsp)
+}
+
+func writeHealthResponse(w http.ResponseWriter, r *http.Request, code int, rsp HealthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		loggerFrom(r.Context()).Errorf("write response: %s", err)
+	}
+}
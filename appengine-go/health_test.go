@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.config.RedisHost, s.config.RedisPort = "localhost", "6379"
+
+	get := func() (int, HealthResponse, string) {
+		rec := httptest.NewRecorder()
+		s.ReadyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil), nil)
+		var rsp HealthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, rsp, rec.Body.String()
+	}
+
+	if code, rsp, body := get(); code != 200 || rsp.Status != "ok" {
+		t.Errorf("got %d %s, want 200", code, body)
+	}
+
+	s.redis.Close()
+	code, rsp, body := get()
+	if code != 503 || rsp.Checks["redis"].Status != "error" {
+		t.Errorf("redis unavailable: got %d %s, want 503", code, body)
+	}
+	if strings.Contains(body, "closed") {
+		t.Errorf("response has the error details: %s", body)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCookieSecret = "test-cookie-secret-test-cookie-secret-test-cookie"
+
+// newTestServer returns a Server backed by a fake Redis. Its MusicBrainz
+// client is unusable until replaced by the test.
+func newTestServer(t *testing.T) (*Server, *fakeRedis) {
+	t.Helper()
+	c, f := newTestRedis(t)
+	httpc := &http.Client{Timeout: 5 * time.Second}
+	return &Server{
+		email:  &testEmailClient{},
+		tasks:  &testTasksClient{},
+		config: Config{CookieSecret: testCookieSecret, TasksSecret: "tasks", BaseURL: "https://albumday.test", DeletionGracePeriod: time.Hour},
+		redis:  c,
+		http:   httpc,
+
+		musicBrainz: newMusicBrainz(httpc, c, "http://127.0.0.1:0"),
+
+		identityCookie: identityCookieCodec(testCookieSecret),
+		stateCookie:    stateCookieCodec(testCookieSecret),
+		artworkKey:     artworkSigningKey(testCookieSecret),
+	}, f
+}
+
+// testEmailClient records sent emails.
+type testEmailClient struct {
+	mu   sync.Mutex
+	sent []testEmail
+}
+
+type testEmail struct {
+	To                          []string
+	Subject, BodyText, BodyHTML string
+}
+
+func (c *testEmailClient) Send(to []string, subject, bodyText, bodyHTML string, header map[string]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, testEmail{to, subject, bodyText, bodyHTML})
+	return nil
+}
+
+// identityCookie returns an identity cookie for the email.
+func testIdentityCookie(t *testing.T, s *Server, email string) *http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if err := s.setIdentityCookie(rec, httptest.NewRequest("GET", "/", nil), email); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Result().Cookies()[0]
+}
+
+// putTestAccount stores the account.
+func putTestAccount(t *testing.T, s *Server, email string, acc Account) {
+	t.Helper()
+	if err := s.redis.Set(accountKey(email), mustMarshalJSON(acc), 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putTestAPIToken stores a new API token for the email, and returns the
+// token.
+func putTestAPIToken(t *testing.T, s *Server, email string, scopes ...TokenScope) string {
+	t.Helper()
+	token := generateAPIToken()
+	rec := apiTokenRecord{APIToken: APIToken{ID: generateAPITokenID(), Scopes: scopes}, Email: email}
+	if err := s.redis.Set(apiTokenKey(hashAPIToken(token)), mustMarshalJSON(rec), 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.redis.HSet(apiTokensKey(email), rec.ID, hashAPIToken(token)).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testTasksClient records posted tasks.
+type testTasksClient struct {
+	mu    sync.Mutex
+	tasks []testTask
+}
+
+type testTask struct {
+	Path    string
+	Payload interface{}
+}
+
+func (c *testTasksClient) PostJSONTask(ctx context.Context, path string, payload interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tasks = append(c.tasks, testTask{path, payload})
+	return nil
+}
+
+func (c *testTasksClient) Close() error        { return nil }
+func (c *testTasksClient) tasksSecret() string { return "tasks" }
+
+// hostTransport routes requests to the handlers by host, for clients of
+// services with fixed URLs, such as Spotify.
+type hostTransport map[string]http.Handler
+
+func (t hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	h, ok := t[req.URL.Host]
+	if !ok {
+		return nil, fmt.Errorf("no handler for host %s", req.URL.Host)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+func TestMain(m *testing.M) {
+	if err := loadReleaseDateZones(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
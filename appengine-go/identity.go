@@ -1,10 +1,11 @@
 package main
 
 import (
-	"log"
+	"context"
 	"net/http"
 	"time"
 
+	"github.com/go-redis/redis"
 	"github.com/gorilla/securecookie"
 )
 
@@ -35,6 +36,8 @@ func (s *Server) setIdentityCookie(w http.ResponseWriter, r *http.Request, email
 		Value:    encoded,
 		Expires:  time.Now().Add(cookieAgeIdentity),
 		HttpOnly: true,
+		Secure:   !isDev(),
+		SameSite: http.SameSiteLaxMode,
 		Path:     "/",
 	}
 	http.SetCookie(w, cookie)
@@ -50,8 +53,27 @@ func (s *Server) currentIdentity(r *http.Request) string {
 	var t IdentityCookie
 	err = s.identityCookie.Decode(cookieNameIdentity, cookie.Value, &t)
 	if err != nil {
-		log.Printf("decode identity cookie: %s", err)
+		loggerFrom(r.Context()).Warningf("decode identity cookie: %s", err)
+		return ""
+	}
+	if s.deletionPending(r.Context(), t.Email) {
 		return ""
 	}
 	return t.Email
 }
+
+// deletionPending reports whether the account's deletion is pending, in
+// which case its cookies and API tokens are no longer accepted. Logging in
+// again cancels the deletion. If the account can't be read, it reports
+// true.
+func (s *Server) deletionPending(ctx context.Context, email string) bool {
+	acc, err := getAccount(accountKey(email), s.redis)
+	if err == redis.Nil {
+		return false // not created yet
+	}
+	if err != nil {
+		loggerFrom(ctx).With("account", accountHash(email)).Errorf("get account: %s", err)
+		return true
+	}
+	return acc.pendingDeletion()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdentityPendingDeletion(t *testing.T) {
+	s, _ := newTestServer(t)
+	const email = "a@example.com"
+	putTestAccount(t, s, email, Account{})
+	token := putTestAPIToken(t, s, email, ScopeAccountRead)
+
+	identities := func() (cookie, bearer string) {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(testIdentityCookie(t, s, email))
+		cookie = s.currentIdentity(r)
+		r = httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		bearer = s.apiIdentity(r, ScopeAccountRead)
+		return
+	}
+
+	if c, b := identities(); c != email || b != email {
+		t.Errorf("before deletion: got %q, %q; want %q", c, b, email)
+	}
+
+	putTestAccount(t, s, email, Account{Deletion: &PendingDeletion{Requested: 1, Purge: 2}})
+	if c, b := identities(); c != "" || b != "" {
+		t.Errorf("deletion pending: got %q, %q; want empty", c, b)
+	}
+}
@@ -2,10 +2,10 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"time"
@@ -20,6 +20,7 @@ type DailyEmailTask struct {
 
 func (s *Server) DailyEmailCronHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	lg := loggerFrom(ctx)
 
 	// https://redis.io/commands/keys:
 	//
@@ -28,7 +29,7 @@ func (s *Server) DailyEmailCronHandler(w http.ResponseWriter, r *http.Request, _
 	// scan a 1 million key database in 40 milliseconds.
 	accountKeys, err := s.redis.Keys("account:*").Result()
 	if err != nil {
-		log.Printf("KEYS account:*", err)
+		lg.Errorf("KEYS account:*: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -36,7 +37,7 @@ func (s *Server) DailyEmailCronHandler(w http.ResponseWriter, r *http.Request, _
 	for _, k := range accountKeys {
 		err := s.tasks.PostJSONTask(ctx, "/internal/task/daily-email", DailyEmailTask{k})
 		if err != nil {
-			log.Printf("post JSON task for %s: %s", k, err) // log and continue
+			lg.With("account", accountHash(emailFromAccountKey(k))).Errorf("post JSON task: %s", err) // log and continue
 		}
 	}
 
@@ -47,36 +48,55 @@ var calcuttaLoc = mustLoadLocation("Asia/Calcutta")
 
 func (s *Server) DailyEmailTaskHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	lg := loggerFrom(ctx)
+
+	// outcome is one of "sent", "skipped", "error"
+	outcome, reason := "error", ""
+	defer func() { dailyEmailTasksTotal.Inc(outcome, reason) }()
 
 	var task DailyEmailTask
 	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
-		log.Printf("json-decode request body: %s", err)
+		lg.Warningf("json-decode request body: %s", err)
+		reason = "bad payload"
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
 	email := emailFromAccountKey(task.AccountKey)
+	lg = lg.With("account", accountHash(email))
+	ctx = contextWithLogger(ctx, lg)
 
 	acc, err := getAccount(task.AccountKey, s.redis)
 	if err == redis.Nil {
-		log.Printf("missing account %s", email)
+		lg.Warningf("missing account")
+		outcome, reason = "skipped", "missing account"
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 	if err != nil {
-		log.Printf("get account: %s", err)
+		lg.Errorf("get account: %s", err)
+		reason = "get account"
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	if acc.pendingDeletion() {
+		lg.Infof("skipping email: pending deletion")
+		outcome, reason = "skipped", "pending deletion"
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
 	if !acc.Settings.EmailsEnabled {
-		log.Printf("skipping email for %s: emails disabled", email)
+		lg.Infof("skipping email: emails disabled")
+		outcome, reason = "skipped", "emails disabled"
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
 	if !acc.connectionComplete() {
-		log.Printf("skipping email for %s: connection incomplete", email)
+		lg.Infof("skipping email: connection incomplete")
+		outcome, reason = "skipped", "connection incomplete"
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -84,18 +104,20 @@ func (s *Server) DailyEmailTaskHandler(w http.ResponseWriter, r *http.Request, _
 	conn := *acc.Connection
 
 	// fetch songs
-	songs := s.getSongsFromCache(conn.Service, email)
+	songs := s.getSongsFromCache(ctx, conn.Service, email)
 
 	if songs == nil {
 		var err error
-		songs, err = FetchSongs(ctx, s.http, conn, s.config)
+		songs, err = s.fetchSongs(ctx, email, conn)
 		var cerr ConnectionErrReason
 		if errors.As(err, &cerr) {
-			log.Printf("fetch songs connection error: %s", err)
+			lg.Warningf("fetch songs connection error: %s", err)
 			switch cerr {
 			case ConnectionErrPermission, ConnectionErrNotFound:
+				outcome, reason = "skipped", "connection "+string(cerr)
 				w.WriteHeader(http.StatusNoContent)
 			case ConnectionErrGeneric:
+				reason = "fetch songs"
 				w.WriteHeader(http.StatusInternalServerError)
 			default:
 				panic("unreachable")
@@ -103,21 +125,35 @@ func (s *Server) DailyEmailTaskHandler(w http.ResponseWriter, r *http.Request, _
 			return
 		}
 		if err != nil {
-			log.Printf("fetch songs: %s", err)
+			lg.Errorf("fetch songs: %s", err)
+			reason = "fetch songs"
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 	}
 
-	s.putSongsToCache(conn.Service, email, songs)
+	s.putSongsToCache(ctx, conn.Service, email, songs)
+
+	mutes, err := s.getMutes(email)
+	if err != nil {
+		lg.Errorf("get mutes: %s", err)
+		reason = "get mutes"
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	songs = mutes.filterMuted(songs)
 
 	t := time.Now().In(calcuttaLoc)
 
 	// compute birthdays
-	items := computeBirthdays(t.Unix(), calcuttaLoc, songs)
+	day := computeBirthdays(t.Unix(), calcuttaLoc, songs, acc.Settings.birthdayOptions(conn.Service))
+	items := day.Items
+	s.setArtworkURLs(s.config.BaseURL, items)
+	s.setArtworkColors(ctx, items)
 
 	if len(items) == 0 {
-		log.Printf("no items for %s: skipping sending email", email)
+		lg.Infof("no items: skipping sending email")
+		outcome, reason = "skipped", "no items"
 		w.WriteHeader(http.StatusCreated)
 		return
 	}
@@ -125,7 +161,8 @@ func (s *Server) DailyEmailTaskHandler(w http.ResponseWriter, r *http.Request, _
 	// make unsub link
 	unsubToken, err := s.redis.Get(unsubTokenKey(email)).Result()
 	if err != nil {
-		log.Printf("GET unsub token: %s", err)
+		lg.Errorf("GET unsub token: %s", err)
+		reason = "unsub token"
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -142,12 +179,17 @@ func (s *Server) DailyEmailTaskHandler(w http.ResponseWriter, r *http.Request, _
 		Today:         t,
 		AppVisitURL:   "https://" + AppDomain + "/feed",
 		BirthdayItems: items,
+		OmittedItems:  day.Omitted,
 		UnsubURL:      unsubURL,
-		SupportEmail:  SupportEmail,
-		Browser:       false,
-		IsDev:         env() == Dev,
+		MuteAlbumURL: func(a Album) string {
+			return muteAlbumURL(email, unsubToken, a)
+		},
+		SupportEmail: SupportEmail,
+		Browser:      false,
+		IsDev:        env() == Dev,
 	}); err != nil {
-		log.Printf("execute email template: %s", err)
+		lg.Errorf("execute email template: %s", err)
+		reason = "execute template"
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
@@ -162,7 +204,8 @@ func (s *Server) DailyEmailTaskHandler(w http.ResponseWriter, r *http.Request, _
 			"List-Unsubscribe": fmt.Sprintf("<%s>", unsubURL),
 		},
 	); err != nil {
-		log.Printf("send email: %s", err)
+		lg.Errorf("send email: %s", err)
+		reason = "send email"
 		var serr StatusError
 		if errors.As(err, &serr) {
 			if !isRetryableStatus(serr.Code) {
@@ -174,6 +217,118 @@ func (s *Server) DailyEmailTaskHandler(w http.ResponseWriter, r *http.Request, _
 		return
 	}
 
+	outcome = "sent"
+	w.WriteHeader(http.StatusOK)
+}
+
+// MusicBrainzTaskHandler looks up the release dates of albums for an
+// account. See enrichSongs.
+func (s *Server) MusicBrainzTaskHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	lg := loggerFrom(ctx)
+
+	var task MusicBrainzTask
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		lg.Warningf("json-decode request body: %s", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	lg = lg.With("account", accountHash(task.Email))
+	ctx = contextWithLogger(ctx, lg)
+
+	found, remaining, err := s.lookupAlbums(ctx, task.Albums, musicBrainzTaskBudget)
+	if found > 0 {
+		// so that the next request applies the release dates
+		if err := s.redis.Del(libraryCacheKey(task.Service, task.Email)).Err(); err != nil {
+			lg.Errorf("DEL library cache: %s", err) // only log
+		}
+	}
+	if err != nil {
+		lg.Warningf("lookup albums: %s", err)
+		w.WriteHeader(http.StatusServiceUnavailable) // retry; found albums are cached
+		return
+	}
+
+	if len(remaining) != 0 {
+		// The budget ran out. The next task owns the pending key.
+		if err := s.redis.Expire(musicBrainzPendingKey(task.Email), 2*musicBrainzTaskBudget).Err(); err != nil {
+			lg.Errorf("EXPIRE musicbrainz pending: %s", err) // only log
+		}
+		if err := s.tasks.PostJSONTask(ctx, "/internal/task/musicbrainz", MusicBrainzTask{task.Email, task.Service, remaining}); err != nil {
+			lg.Errorf("post JSON task: %s", err)
+			w.WriteHeader(http.StatusServiceUnavailable) // retry; looked up albums are cached
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := s.redis.Del(musicBrainzPendingKey(task.Email)).Err(); err != nil {
+		lg.Errorf("DEL musicbrainz pending: %s", err) // only log
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ArtworkColorTaskHandler computes the colors of artworks. See
+// setCachedArtworkColors.
+func (s *Server) ArtworkColorTaskHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	lg := loggerFrom(ctx)
+
+	var task ArtworkColorTask
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		lg.Warningf("json-decode request body: %s", err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	colors, missing, err := s.artworkColors(task.URLs)
+	if err != nil {
+		lg.Errorf("artwork colors: %s", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, artworkColorTaskBudget)
+	defer cancel()
+	computed, complete := s.computeArtworkColors(ctx, missing)
+	if !complete {
+		lg.Infof("artwork color budget exhausted: computed %d of %d colors", len(computed), len(missing))
+	}
+	lg.Infof("artwork colors: %d cached, %d computed", len(colors), len(computed))
+
+	s.clearArtworkColorsPending(ctx, task.URLs)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) PurgeAccountsCronHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	accountKeys, err := s.redis.Keys("account:*").Result()
+	if err != nil {
+		lg.Errorf("KEYS account:*: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().Unix()
+
+	for _, k := range accountKeys {
+		email := emailFromAccountKey(k)
+		lg := lg.With("account", accountHash(email))
+
+		err := s.purgeAccountIfDue(email, now)
+		if err == redis.Nil || err == errNotDue {
+			continue
+		}
+		if err != nil {
+			lg.Errorf("purge account: %s", err) // log and continue
+			continue
+		}
+		lg.Infof("successfully deleted account")
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
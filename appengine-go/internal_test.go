@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPurgeAccountsCronHandler(t *testing.T) {
+	s, f := newTestServer(t)
+	now := time.Now().Unix()
+
+	const (
+		due      = "due@example.com"
+		notDue   = "notdue@example.com"
+		active   = "active@example.com"
+		canceled = "canceled@example.com"
+	)
+	putTestAccount(t, s, due, Account{Deletion: &PendingDeletion{Requested: now - 10, Purge: now - 1}})
+	putTestAccount(t, s, notDue, Account{Deletion: &PendingDeletion{Requested: now, Purge: now + 3600}})
+	putTestAccount(t, s, active, Account{})
+	token := putTestAPIToken(t, s, due, ScopeAccountRead)
+	if err := s.redis.Set(unsubTokenKey(due), "unsub", 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.PurgeAccountsCronHandler(rec, httptest.NewRequest("GET", "/internal/purge-accounts", nil), nil)
+	if rec.Code != 200 {
+		t.Fatalf("status: got %d, want 200", rec.Code)
+	}
+
+	for _, k := range []string{accountKey(due), apiTokensKey(due), apiTokenKey(hashAPIToken(token))} {
+		if n := s.redis.Exists(k).Val(); n != 0 {
+			t.Errorf("%s not deleted", k)
+		}
+	}
+	for _, k := range []string{accountKey(notDue), accountKey(active), unsubTokenKey(due)} {
+		if n := s.redis.Exists(k).Val(); n != 1 {
+			t.Errorf("%s deleted", k)
+		}
+	}
+
+	// An undo that happens after the cron job read the account must win.
+	putTestAccount(t, s, canceled, Account{Deletion: &PendingDeletion{Requested: now - 10, Purge: now - 1}})
+	f.mu.Lock()
+	f.beforeExec = func() {
+		f.beforeExec = nil
+		f.set(accountKey(canceled), string(mustMarshalJSON(Account{})))
+	}
+	f.mu.Unlock()
+	if err := s.purgeAccountIfDue(canceled, now); err != errNotDue {
+		t.Errorf("purge after undo: got %v, want errNotDue", err)
+	}
+	if n := s.redis.Exists(accountKey(canceled)).Val(); n != 1 {
+		t.Errorf("account deleted after undo")
+	}
+}
@@ -1,39 +1,43 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
 	"time"
 
 	"github.com/go-redis/redis"
 )
 
 // Get songs from cache. Returns nil if no cached data is available or on error.
-func (s *Server) getSongsFromCache(service Service, email string) []Song {
+func (s *Server) getSongsFromCache(ctx context.Context, service Service, email string) []Song {
 	b, err := s.redis.Get(libraryCacheKey(service, email)).Bytes()
 	if err == redis.Nil {
+		libraryCacheTotal.Inc("miss")
 		return nil
 	}
 	if err != nil {
-		log.Printf("GET library cache: %s", err)
+		loggerFrom(ctx).Errorf("GET library cache: %s", err)
+		libraryCacheTotal.Inc("error")
 		return nil
 	}
 
 	songs := make([]Song, 0) // `make` so that it's not nil for the return value
 	if err := json.Unmarshal(b, &songs); err != nil {
-		log.Printf("json-unmarshal songs: %s", err)
+		loggerFrom(ctx).Errorf("json-unmarshal songs: %s", err)
+		libraryCacheTotal.Inc("error")
 		return nil
 	}
 
+	libraryCacheTotal.Inc("hit")
 	return songs
 }
 
-func (s *Server) putSongsToCache(service Service, email string, songs []Song) {
+func (s *Server) putSongsToCache(ctx context.Context, service Service, email string, songs []Song) {
 	b := mustMarshalJSON(songs)
 
 	err := s.redis.Set(libraryCacheKey(service, email), string(b), 6*24*time.Hour).Err()
 	if err != nil {
-		log.Printf("SET library cache: %s", err)
+		loggerFrom(ctx).Errorf("SET library cache: %s", err)
 		return
 	}
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Severity string
+
+// https://cloud.google.com/logging/docs/reference/v2/rest/v2/LogEntry#LogSeverity
+const (
+	SeverityDebug   Severity = "DEBUG"
+	SeverityInfo    Severity = "INFO"
+	SeverityWarning Severity = "WARNING"
+	SeverityError   Severity = "ERROR"
+)
+
+// Logger is a leveled logger with structured fields. In prod, it emits one
+// JSON object per line, in the format understood by Cloud Logging. In dev, it
+// emits human-readable lines.
+type Logger struct {
+	mu     *sync.Mutex // shared by derived loggers
+	w      io.Writer
+	json   bool
+	fields []logField
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+func newLogger(w io.Writer, jsonFormat bool) *Logger {
+	return &Logger{
+		mu:   &sync.Mutex{},
+		w:    w,
+		json: jsonFormat,
+	}
+}
+
+// rootLogger is the logger used outside of requests, and the base for
+// request loggers.
+var rootLogger = newLogger(os.Stderr, !isDev())
+
+// With returns a logger with additional fields. The arguments are
+// alternating keys and values; keys must be strings.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if len(keyvals)%2 != 0 {
+		panic("odd number of arguments")
+	}
+	fields := make([]logField, len(l.fields), len(l.fields)+len(keyvals)/2)
+	copy(fields, l.fields)
+	for i := 0; i < len(keyvals); i += 2 {
+		fields = append(fields, logField{keyvals[i].(string), keyvals[i+1]})
+	}
+	return &Logger{
+		mu:     l.mu,
+		w:      l.w,
+		json:   l.json,
+		fields: fields,
+	}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.output(SeverityDebug, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.output(SeverityInfo, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.output(SeverityWarning, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.output(SeverityError, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) output(sev Severity, msg string) {
+	now := time.Now()
+	_, file, line, ok := runtime.Caller(2)
+	if !ok {
+		file, line = "???", 0
+	}
+	file = filepath.Base(file)
+
+	var buf bytes.Buffer
+	if l.json {
+		// https://cloud.google.com/logging/docs/agent/configuration#special-fields
+		m := make(map[string]interface{}, len(l.fields)+4)
+		for _, f := range l.fields {
+			m[f.key] = f.value
+		}
+		m["severity"] = sev
+		m["message"] = msg
+		m["time"] = now.Format(time.RFC3339Nano)
+		m["logging.googleapis.com/sourceLocation"] = map[string]string{
+			"file": file,
+			"line": strconv.Itoa(line),
+		}
+		b, err := json.Marshal(m)
+		if err != nil {
+			b = mustMarshalJSON(map[string]interface{}{
+				"severity": SeverityError,
+				"message":  fmt.Sprintf("json-marshal log entry: %s; message: %s", err, msg),
+			})
+		}
+		buf.Write(b)
+	} else {
+		fmt.Fprintf(&buf, "%s %-7s %s:%d: %s", now.Format("2006/01/02 15:04:05"), sev, file, line, msg)
+		for _, f := range l.fields {
+			v := fmt.Sprint(f.value)
+			if strings.ContainsAny(v, " \t\n\"=") || v == "" {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(&buf, " %s=%s", f.key, v)
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+type loggerKey struct{}
+
+func contextWithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the logger for the context, or the root logger if the
+// context has none.
+func loggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return rootLogger
+}
+
+// accountHash identifies an account in logs without logging the email
+// address.
+func accountHash(email string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(h[:6])
+}
+
+const headerRequestID = "x-request-id"
+
+func generateRequestID() string {
+	p := make([]byte, 8)
+	if _, err := rand.Read(p); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(p)
+}
+
+// RequestLogger adds a request ID to each request and attaches a logger
+// carrying the request ID to the request's context. The trace ID from App
+// Engine, if present, is used as the request ID, so that log entries are
+// grouped with the request log in Cloud Logging.
+func RequestLogger(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l := rootLogger
+
+		// https://cloud.google.com/trace/docs/setup#force-trace
+		var id string
+		if trace := r.Header.Get("X-Cloud-Trace-Context"); trace != "" {
+			id = strings.SplitN(trace, "/", 2)[0]
+			l = l.With("logging.googleapis.com/trace", fmt.Sprintf("projects/%s/traces/%s", ProjectID, id))
+		}
+		if id == "" {
+			id = generateRequestID()
+		}
+		l = l.With("requestID", id)
+
+		w.Header().Set(headerRequestID, id)
+		h.ServeHTTP(w, r.WithContext(contextWithLogger(r.Context(), l)))
+	})
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"flag"
-	"log"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -15,21 +18,27 @@ import (
 )
 
 type Server struct {
-	email  EmailClient
-	config Config
-	tasks  TasksClient
-	redis  *redis.Client
-	http   *http.Client
+	email   EmailClient
+	config  Config
+	tasks   TasksClient
+	redis   *redis.Client
+	http    *http.Client
+	spotify *SpotifyOAuth
+
+	musicBrainz *MusicBrainz
 
 	identityCookie, stateCookie *securecookie.SecureCookie
+	artworkKey                  []byte
 }
 
+var exportAccount = flag.String("export-account", "", "write the data export for the account with the given `email` to stdout and exit")
+
 func main() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	flag.Parse()
 
 	if err := run(context.Background()); err != nil {
-		log.Fatal(err)
+		rootLogger.Errorf("%s", err)
+		os.Exit(1)
 	}
 }
 
@@ -42,9 +51,20 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	// Fail the deploy, rather than start an instance that can never be
+	// ready.
+	if err := config.validate(); err != nil {
+		return fmt.Errorf("invalid config: %s", err)
+	}
 	if ds != nil {
 		ds.Close() // no longer needed
 	}
+	if err := loadReleaseDateZones(); err != nil {
+		return err
+	}
+	if config.ReissueRules != nil {
+		reissueRules = config.ReissueRules
+	}
 
 	tasks, err := newTasksClient(ctx, config.TasksSecret)
 	if err != nil {
@@ -55,29 +75,95 @@ func run(ctx context.Context) error {
 	redisc := newRedis(net.JoinHostPort(config.RedisHost, config.RedisPort), config.RedisTLS)
 	defer redisc.Close()
 
+	httpc := &http.Client{Timeout: 30 * time.Second}
+
 	s := &Server{
-		email:  newEmailClient(config.SendgridAPIKey),
-		config: config,
-		tasks:  tasks,
-		redis:  redisc,
-		http:   &http.Client{Timeout: 30 * time.Second},
+		email:   &MetricsEmailClient{newEmailClient(config.SendgridAPIKey)},
+		config:  config,
+		tasks:   tasks,
+		redis:   redisc,
+		http:    httpc,
+		spotify: newSpotifyOAuth(httpc, config.SpotifyClientID, config.SpotifyClientSecret),
+
+		musicBrainz: newMusicBrainz(httpc, redisc, config.MusicBrainzBaseURL),
 
 		identityCookie: identityCookieCodec(config.CookieSecret),
 		stateCookie:    stateCookieCodec(config.CookieSecret),
+		artworkKey:     artworkSigningKey(config.CookieSecret),
+	}
+
+	if *exportAccount != "" {
+		return s.exportAccountCommand(ctx, os.Stdout, *exportAccount)
+	}
+
+	router := newRouter()
+	s.registerRoutes(router)
+
+	if err := validateAPIOperations(apiOperations, router.Routes()); err != nil {
+		return fmt.Errorf("openapi: %s", err)
+	}
+
+	if isDev() {
+		router.ServeFiles("/static/*filepath", http.Dir("static"))
+	}
+
+	PORT := os.Getenv("PORT")
+	if PORT == "" {
+		PORT = devPort
+	}
+
+	// Cancelled after shutdown, so that requests still in flight after the
+	// shutdown deadline observe cancellation.
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := &http.Server{
+		Addr:              ":" + PORT,
+		Handler:           RequestLogger(OldHostsRedirect(RequireSameOrigin(Gzip(router)))),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		// Long enough for task handlers, which may fetch large libraries. App
+		// Engine's own deadline for task requests is 10 minutes.
+		WriteTimeout: 10 * time.Minute,
+		IdleTimeout:  2 * time.Minute,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
 
-	router := httprouter.New()
+	rootLogger.Infof("listening on port %s", PORT)
+	return serve(srv, cancelRequests)
+}
 
+// registerRoutes registers the server's routes. Each route must be
+// documented in apiOperations.
+func (s *Server) registerRoutes(router Router) {
 	router.GET("/api/v1/account", s.AccountHandler)
 	router.POST("/api/v1/passphrase", s.PassphraseHandler)
 	router.POST("/api/v1/login", s.LoginHandler)
 	router.DELETE("/api/v1/account", s.DeleteAccountHandler)
 	router.DELETE("/api/v1/account/connection", s.DeleteAccountConnectionHandler)
-	router.PUT("/api/v1/account/email-notifications", s.SetEmailsEnabledHandler)
+	router.GET("/api/v1/account/export", s.ExportAccountHandler)
+	router.PATCH("/api/v1/account/settings", s.UpdateSettingsHandler)
 	router.GET("/api/v1/birthdays", s.BirthdaysHandler)
+	router.GET("/api/v1/tokens", s.APITokensHandler)
+	router.POST("/api/v1/tokens", s.CreateAPITokenHandler)
+	router.DELETE("/api/v1/tokens/:id", s.RevokeAPITokenHandler)
+	router.GET("/api/v1/mutes", s.MutesHandler)
+	router.POST("/api/v1/mutes/artists", s.MuteArtistHandler)
+	router.DELETE("/api/v1/mutes/artists/:id", s.UnmuteArtistHandler)
+	router.POST("/api/v1/mutes/albums", s.MuteAlbumHandler)
+	router.DELETE("/api/v1/mutes/albums/:id", s.UnmuteAlbumHandler)
+	router.GET("/api/v1/openapi.json", s.OpenAPIHandler)
 
 	router.GET("/internal/cron/daily-email", RequireCronHeader(s.DailyEmailCronHandler))
-	router.POST("/internal/task/daily-email", RequireTasksSecret(config.TasksSecret, s.DailyEmailTaskHandler))
+	router.POST("/internal/task/daily-email", RequireTasksSecret(s.config.TasksSecret, s.DailyEmailTaskHandler))
+	router.POST("/internal/task/musicbrainz", RequireTasksSecret(s.config.TasksSecret, s.MusicBrainzTaskHandler))
+	router.POST("/internal/task/artwork-color", RequireTasksSecret(s.config.TasksSecret, s.ArtworkColorTaskHandler))
+	router.GET("/internal/cron/purge-accounts", RequireCronHeader(s.PurgeAccountsCronHandler))
+	router.GET("/metrics", RequireBearerSecret(s.config.MetricsSecret, s.MetricsHandler))
+	router.GET("/healthz", s.HealthzHandler)
+	router.GET("/readyz", s.ReadyzHandler)
 
 	router.GET("/connect/spotify", s.ConnectSpotifyHandler)
 	router.GET("/auth/spotify", s.AuthSpotifyHandler)
@@ -91,19 +177,51 @@ func run(ctx context.Context) error {
 	// https://security.stackexchange.com/questions/115964/email-unsubscribe-handling-security
 	router.GET("/unsub", s.UnsubHandler)
 	router.POST("/unsub", s.UnsubHandler)
+	router.GET("/undo-delete", s.UndoDeleteHandler)
+	router.POST("/undo-delete", s.UndoDeleteHandler)
+	router.GET("/mute", s.MuteFromEmailHandler)
+	router.POST("/mute", s.MuteFromEmailHandler)
 	router.GET("/email-preview", s.PreviewEmailHandler)
+	router.GET("/artwork", s.ArtworkHandler)
 	router.GET("/terms", s.TermsHandler)
+}
 
-	if isDev() {
-		router.ServeFiles("/static/*filepath", http.Dir("static"))
+// shutdownTimeout is the time allowed for in-flight requests to complete
+// after a shutdown signal is received.
+const shutdownTimeout = 25 * time.Second
+
+// serve serves until the server fails or a SIGTERM or SIGINT is received. On
+// a signal, it stops accepting new connections and waits up to
+// shutdownTimeout for in-flight requests to complete, after which it cancels
+// the request contexts via cancelRequests and closes remaining connections.
+func serve(srv *http.Server, cancelRequests context.CancelFunc) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.ListenAndServe()
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sig)
+
+	select {
+	case err := <-errc:
+		return err
+	case v := <-sig:
+		rootLogger.Infof("received %s: shutting down", v)
 	}
 
-	PORT := os.Getenv("PORT")
-	if PORT == "" {
-		PORT = devPort
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(ctx)
+	cancelRequests()
+	if err != nil {
+		srv.Close()
+		return fmt.Errorf("shutdown: %s", err)
 	}
-	log.Printf("listening on port %s", PORT)
-	return http.ListenAndServe(":"+PORT, OldHostsRedirect(router))
+	rootLogger.Infof("shutdown complete")
+	return nil
 }
 
 func RequireCronHeader(h httprouter.Handle) httprouter.Handle {
@@ -126,6 +244,19 @@ func RequireTasksSecret(wantSecret string, h httprouter.Handle) httprouter.Handl
 	})
 }
 
+// RequireBearerSecret requires the request to have the secret as a bearer
+// token. Requests are always rejected if the secret is empty.
+func RequireBearerSecret(wantSecret string, h httprouter.Handle) httprouter.Handle {
+	return httprouter.Handle(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		got := bearerToken(r)
+		if wantSecret != "" && subtle.ConstantTimeCompare([]byte(got), []byte(wantSecret)) == 1 {
+			h(w, r, p)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+}
+
 func OldHostsRedirect(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Host == "birthdays.casa" {
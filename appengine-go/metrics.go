@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A minimal metrics registry that is exposed in the Prometheus text format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+//
+// NOTE: metrics are per-instance.
+
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+type collector interface {
+	writeText(w io.Writer)
+}
+
+var metrics = &MetricsRegistry{}
+
+var (
+	fetchSongsTotal = metrics.Counter("albumday_fetch_songs_total",
+		"Library fetches from music services.", "service", "outcome")
+	fetchSongsDuration = metrics.Histogram("albumday_fetch_songs_duration_seconds",
+		"Duration of library fetches from music services.", slowBuckets, "service")
+	spotifySyncTotal = metrics.Counter("albumday_spotify_sync_total",
+		"Spotify library syncs.", "kind")
+	libraryCacheTotal = metrics.Counter("albumday_library_cache_total",
+		"Library cache lookups.", "result")
+	artworkCacheTotal = metrics.Counter("albumday_artwork_cache_total",
+		"Artwork proxy cache lookups.", "result")
+	musicBrainzLookupsTotal = metrics.Counter("albumday_musicbrainz_lookups_total",
+		"Release date lookups from MusicBrainz.", "result")
+	emailSendTotal = metrics.Counter("albumday_email_send_total",
+		"Emails sent via the email client.", "result")
+	dailyEmailTasksTotal = metrics.Counter("albumday_daily_email_tasks_total",
+		"Daily email task outcomes.", "outcome", "reason")
+	httpRequestDuration = metrics.Histogram("albumday_http_request_duration_seconds",
+		"Duration of HTTP requests, by route.", defaultBuckets, "route", "method", "code")
+)
+
+var (
+	defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	slowBuckets    = []float64{.1, .25, .5, 1, 2.5, 5, 10, 25, 60}
+)
+
+func (m *MetricsRegistry) register(c collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+func (m *MetricsRegistry) WriteText(w io.Writer) {
+	m.mu.Lock()
+	collectors := append([]collector(nil), m.collectors...)
+	m.mu.Unlock()
+
+	for _, c := range collectors {
+		c.writeText(w)
+	}
+}
+
+type CounterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	n           float64
+}
+
+func (m *MetricsRegistry) Counter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}
+	m.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("%s: want %d label values, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+	k := strings.Join(labelValues, "\x00")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[k]
+	if !ok {
+		v = &counterValue{labelValues: labelValues}
+		c.values[k] = v
+	}
+	v.n++
+}
+
+func (c *CounterVec) writeText(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	for _, k := range sortedKeys(c.values) {
+		v := c.values[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, v.labelValues), formatFloat(v.n))
+	}
+}
+
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // per bucket, non-cumulative
+	sum         float64
+	count       uint64
+}
+
+func (m *MetricsRegistry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+	m.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(x float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("%s: want %d label values, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+	k := strings.Join(labelValues, "\x00")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[k]
+	if !ok {
+		v = &histogramValue{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[k] = v
+	}
+	if i := sort.SearchFloat64s(h.buckets, x); i < len(h.buckets) {
+		v.counts[i]++
+	}
+	v.sum += x
+	v.count++
+}
+
+func (h *HistogramVec) writeText(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, k := range sortedKeys(h.values) {
+		v := h.values[k]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(bucketLabels, append(append([]string(nil), v.labelValues...), formatFloat(upper))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(bucketLabels, append(append([]string(nil), v.labelValues...), "+Inf")), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, v.labelValues), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, v.labelValues), v.count)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]*counterValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramValue:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	default:
+		panic("unreachable")
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, names[i], labelValueReplacer.Replace(values[i]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.WriteText(w)
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -11,26 +11,24 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"golang.org/x/oauth2"
 )
 
-func init() {
-	for _, name := range timeZoneNames {
-		locations = append(locations, mustLoadLocation(name))
-	}
-}
-
 type Song struct {
-	Artist string
+	Artist string // credit for the album's artists, e.g. "Mark Ronson & Miley Cyrus"
 	Album  string
 	Title  string
 
+	Artists       []string // the album's artists; or nil, in libraries cached before this field was added
+	ArtistsListed bool     // whether Artists is the service's list of the album's artists, rather than a single credit that may name several
+	TrackArtists  []string // the song's artists, if known and different from the album's; or nil
+	Compilation   bool     // whether the album is a "Various Artists" compilation
+
 	Release ReleaseDate
 
 	Link       string // or ""
 	AlbumLink  string // or ""
 	ArtworkURL string // or ""
+	ISRC       string // or ""
 
 	PlayCount   int // or 0
 	Loved       *bool
@@ -38,9 +36,35 @@ type Song struct {
 }
 
 type ReleaseDate struct {
-	Year  int        `json:"year"`
-	Month time.Month `json:"month"`
-	Day   int        `json:"day"`
+	Year      int           `json:"year"`
+	Month     time.Month    `json:"month"` // or 0 if Precision is PrecisionYear
+	Day       int           `json:"day"`   // or 0 if Precision is PrecisionYear or PrecisionMonth
+	Precision DatePrecision `json:"precision"`
+
+	// Ambiguous is whether the calendar date was inferred from a
+	// timestamp that is plausibly a different date in another region.
+	Ambiguous bool `json:"ambiguous"`
+}
+
+type DatePrecision string
+
+const (
+	PrecisionDay   DatePrecision = "day"
+	PrecisionMonth DatePrecision = "month"
+	PrecisionYear  DatePrecision = "year"
+)
+
+// precision returns the date's precision. Dates in libraries cached before
+// the Precision field was added have only day or month precision, inferred
+// from the Day field.
+func (r ReleaseDate) precision() DatePrecision {
+	if r.Precision != "" {
+		return r.Precision
+	}
+	if r.Day != 0 {
+		return PrecisionDay
+	}
+	return PrecisionMonth
 }
 
 func (r ReleaseDate) Hash() string {
@@ -55,43 +79,7 @@ func mustLoadLocation(name string) *time.Location {
 	return loc
 }
 
-var (
-	timeZoneNames = [...]string{
-		"America/Chicago",
-		"America/Denver",
-		"America/Los_Angeles",
-		"America/New_York",
-		"America/Phoenix",
-		"Asia/Calcutta",
-		"Etc/GMT",
-	}
-
-	locations []*time.Location // see init()
-
-	defaultLocation = mustLoadLocation("Etc/GMT")
-)
-
-func determineReleaseDate(unix int64) ReleaseDate {
-	t := time.Unix(unix, 0)
-
-	for _, loc := range locations {
-		t = t.In(loc)
-		if (t.Hour() == 0 && t.Minute() == 0) || (t.Hour() == 12 && t.Minute() == 0) {
-			return ReleaseDate{
-				Year:  t.Year(),
-				Month: t.Month(),
-				Day:   t.Day(),
-			}
-		}
-	}
-
-	t = t.In(defaultLocation)
-	return ReleaseDate{
-		Year:  t.Year(),
-		Month: t.Month(),
-		Day:   t.Day(),
-	}
-}
+var defaultLocation = mustLoadLocation("Etc/GMT")
 
 func ptrBool(b bool) *bool {
 	return &b
@@ -102,8 +90,8 @@ type ScrobbleSong struct {
 	ArtistName   string        `json:"artistName"`
 	Title        string        `json:"title"`
 	TotalTime    time.Duration `json:"totalTime"`
-	Year         int           `json:"year"`
-	ReleaseDate  int64         `json:"releaseDate"` // unix seconds
+	Year         int           `json:"year"`        // or 0
+	ReleaseDate  int64         `json:"releaseDate"` // unix seconds; or 0
 	LastPlayed   int64         `json:"lastPlayed"`  // unix seconds
 	PlayCount    int           `json:"playCount"`
 	Added        int64         `json:"added"` // unix seconds
@@ -159,15 +147,29 @@ func fetchScrobble(ctx context.Context, c *http.Client, username string) ([]Song
 	}
 }
 
+// transformScrobbleSong transforms the song. Songs without a release date
+// are kept, with a year-precision or zero Release, so that their release
+// date can be looked up.
 func transformScrobbleSong(s ScrobbleSong) (Song, bool) {
-	if s.ArtistName == "" || s.AlbumTitle == "" || s.Title == "" || s.ReleaseDate == 0 {
+	if s.ArtistName == "" || s.AlbumTitle == "" || s.Title == "" {
 		return Song{}, false
 	}
+
+	var rel ReleaseDate
+	switch {
+	case s.ReleaseDate != 0:
+		rel = determineReleaseDate(s.ReleaseDate, appleStorefront(s.TrackViewURL))
+	case s.Year > 0:
+		rel = ReleaseDate{Year: s.Year, Precision: PrecisionYear}
+	}
+
 	return Song{
 		Artist:      s.ArtistName,
 		Album:       s.AlbumTitle,
 		Title:       s.Title,
-		Release:     determineReleaseDate(s.ReleaseDate),
+		Artists:     []string{s.ArtistName},
+		Compilation: isVariousArtists(s.ArtistName),
+		Release:     rel,
 		Link:        s.TrackViewURL,
 		AlbumLink:   scrobbleAlbumURL(s.TrackViewURL),
 		ArtworkURL:  scrobbleArtworkURL(s.ArtworkHash),
@@ -196,85 +198,55 @@ func scrobbleAlbumURL(trackViewURL string) string {
 	return u.String()
 }
 
-type AccessTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	Scope       string `json:"scope"`
-	ExpiresIn   int    `json:"expires_in"`
-}
-
-func fetchSpotifyAccessToken(ctx context.Context, c *http.Client, refreshToken, clientID, clientSecret string) (*oauth2.Token, error) {
-	params := url.Values{}
-	params.Set("grant_type", "refresh_token")
-	params.Set("refresh_token", refreshToken)
-	body := strings.NewReader(params.Encode())
-
-	req, err := http.NewRequest("POST", "https://accounts.spotify.com/api/token", body)
-	if err != nil {
-		return nil, err
-	}
-	req = req.WithContext(ctx)
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	cred := base64.StdEncoding.EncodeToString([]byte(clientID + ":" + clientSecret))
-	req.Header.Set("Authorization", "Basic "+cred)
-
-	rsp, err := c.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("do spotify request: %s", err)
-	}
-	defer drainAndClose(rsp.Body)
-
-	if rsp.StatusCode != 200 {
-		return nil, StatusError{rsp.StatusCode}
-	}
-
-	var a AccessTokenResponse
-	if err := json.NewDecoder(rsp.Body).Decode(&a); err != nil {
-		return nil, fmt.Errorf("json-decode access token response: %s", err)
-	}
-
-	tok := &oauth2.Token{
-		AccessToken:  a.AccessToken,
-		TokenType:    a.TokenType,
-		RefreshToken: refreshToken,
-		Expiry:       time.Now().Add(time.Duration(a.ExpiresIn) * time.Second),
-	}
-	return tok, nil
-}
-
 // https://developer.spotify.com/documentation/web-api/reference-beta/#endpoint-get-users-saved-tracks
-func fetchSpotify(ctx context.Context, c *http.Client, refreshToken, clientID, clientSecret string) ([]Song, error) {
-	tok, err := fetchSpotifyAccessToken(ctx, c, refreshToken, clientID, clientSecret)
+//
+// Fetches the saved tracks, most recently added first, stopping before the
+// first track for which stop returns true; stop may be nil to fetch all.
+// Returns the tracks, the total number of saved tracks, and the refresh
+// token to use subsequently, which differs from the supplied refresh token
+// if Spotify rotated it. The refresh token is returned even if fetching the
+// tracks fails.
+func fetchSpotify(ctx context.Context, c *http.Client, oauth *SpotifyOAuth, refreshToken string, stop func(SpotifySavedTrack) bool) ([]SpotifySavedTrack, int, string, error) {
+	tok, err := oauth.Refresh(ctx, refreshToken)
 	if err != nil {
-		return nil, fmt.Errorf("fetch access token: %w", err)
+		return nil, 0, refreshToken, fmt.Errorf("fetch access token: %w", err)
 	}
 
-	var allSongs []Song
+	var all []SpotifySavedTrack
+	total := -1
 	fetchURL := "https://api.spotify.com/v1/me/tracks?limit=50"
 
 	for fetchURL != "" {
-		songs, nextURL, err := fetchSpotifyOnePage(ctx, c, fetchURL, tok.AccessToken)
+		page, err := fetchSpotifyOnePage(ctx, c, fetchURL, tok.AccessToken)
 		if err != nil {
-			return nil, fmt.Errorf("fetch spotify one page: %w", err)
+			return nil, 0, tok.RefreshToken, fmt.Errorf("fetch spotify one page: %w", err)
+		}
+		if total == -1 {
+			total = page.Total // as of the first page
 		}
-		allSongs = append(allSongs, songs...)
-		fetchURL = nextURL
+		for _, t := range page.Items {
+			if stop != nil && stop(t) {
+				return all, total, tok.RefreshToken, nil
+			}
+			all = append(all, t)
+		}
+		fetchURL = page.Next
 	}
 
-	return allSongs, nil
+	return all, total, tok.RefreshToken, nil
 }
 
-func fetchSpotifyOnePage(ctx context.Context, client *http.Client, url string, accessToken string) (songs []Song, nextURL string, err error) {
+func fetchSpotifyOnePage(ctx context.Context, client *http.Client, url string, accessToken string) (SpotifyResponse, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, "", err
+		return SpotifyResponse{}, err
 	}
 	req = req.WithContext(ctx)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
 	rsp, err := client.Do(req)
 	if err != nil {
-		return nil, "", fmt.Errorf("do request: %s", err)
+		return SpotifyResponse{}, fmt.Errorf("do request: %s", err)
 	}
 	defer drainAndClose(rsp.Body)
 
@@ -282,46 +254,45 @@ func fetchSpotifyOnePage(ctx context.Context, client *http.Client, url string, a
 	case 200:
 		// continue below
 	case 401, 403:
-		return nil, "", ConnectionErrPermission
+		return SpotifyResponse{}, ConnectionErrPermission
 	case 404:
-		return nil, "", ConnectionErrNotFound
+		return SpotifyResponse{}, ConnectionErrNotFound
 	default:
-		return nil, "", ConnectionErrGeneric
+		return SpotifyResponse{}, ConnectionErrGeneric
 	}
 
 	var s SpotifyResponse
 	if err := json.NewDecoder(rsp.Body).Decode(&s); err != nil {
-		return nil, "", fmt.Errorf("json-decode spotify response: %s", err)
-	}
-
-	var ret []Song
-	for _, t := range s.Items {
-		r, ok := transformSpotifyTrack(t.Track)
-		if !ok {
-			continue
-		}
-		ret = append(ret, r)
+		return SpotifyResponse{}, fmt.Errorf("json-decode spotify response: %s", err)
 	}
-	return ret, s.Next, nil
+	return s, nil
 }
 
 type SpotifyResponse struct {
-	Next  string              `json:"next"` // possibly ""
+	Next  string              `json:"next"`  // possibly ""
+	Total int                 `json:"total"` // total number of saved tracks
 	Items []SpotifySavedTrack `json:"items"`
 }
 
 type SpotifySavedTrack struct {
-	AddedAt string       `json:"added_at"`
+	AddedAt string       `json:"added_at"` // e.g. "2016-10-24T15:03:07Z"
 	Track   SpotifyTrack `json:"track"`
 }
 
 type SpotifyTrack struct {
+	ID           string              `json:"id"`
 	Album        SpotifyAlbum        `json:"album"`
+	Artists      []SpotifyArtist     `json:"artists"`
+	ExternalIDs  SpotifyExternalIDs  `json:"external_ids"`
 	ExternalURLs SpotifyExternalURLs `json:"external_urls"`
 	Name         string              `json:"name"` // The name of the track.
 	TrackNumber  int                 `json:"track_number"`
 }
 
+type SpotifyExternalIDs struct {
+	ISRC string `json:"isrc"` // possibly ""
+}
+
 type SpotifyExternalURLs struct {
 	Spotify string `json:"spotify"` // possibly ""
 }
@@ -345,39 +316,106 @@ type SpotifyArtist struct {
 	Name string `json:"name"`
 }
 
+// albumArtists returns the album's artists.
+func (s Song) albumArtists() []string {
+	if len(s.Artists) == 0 {
+		return []string{s.Artist}
+	}
+	return s.Artists
+}
+
+// albumArtist returns the artist that identifies the song's album. Spotify
+// lists an album's artists, so it's the first of them. Scrobble only has a
+// credit that may name several artists, such as "Max Richter, KiKi Layne &
+// Robert Ziegler", so it's the primary artist parsed from the credit. A
+// credit can't be split reliably, since band names such as "Earth, Wind &
+// Fire" contain the separators, so this is only a fallback.
+func (s Song) albumArtist() string {
+	if s.ArtistsListed && len(s.Artists) > 0 {
+		return s.Artists[0]
+	}
+	return primaryArtist(s.Artist)
+}
+
+// joinArtists formats the artists as a joint credit, e.g. "A, B & C".
+func joinArtists(artists []string) string {
+	switch len(artists) {
+	case 0:
+		return ""
+	case 1:
+		return artists[0]
+	default:
+		return strings.Join(artists[:len(artists)-1], ", ") + " & " + artists[len(artists)-1]
+	}
+}
+
+// isVariousArtists reports whether the artist name is the placeholder used
+// for compilations.
+func isVariousArtists(artist string) bool {
+	n := normalizeName(artist)
+	return n == "various artists" || n == "various"
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func transformSpotifyTrack(t SpotifyTrack) (Song, bool) {
-	if len(t.Album.Artists) == 0 {
+	var artists []string
+	for _, a := range t.Album.Artists {
+		if a.Name != "" {
+			artists = append(artists, a.Name)
+		}
+	}
+	if len(artists) == 0 {
 		return Song{}, false
 	}
-	artist := t.Album.Artists[0]
 
-	if t.Name == "" || artist.Name == "" || t.Album.Name == "" {
+	if t.Name == "" || t.Album.Name == "" {
 		return Song{}, false
 	}
 
-	// check acceptable release date & precision
-	if t.Album.ReleaseDate == "" {
-		return Song{}, false
+	var trackArtists []string
+	for _, a := range t.Artists {
+		if a.Name != "" {
+			trackArtists = append(trackArtists, a.Name)
+		}
 	}
-	if t.Album.ReleaseDatePrecision != "month" && t.Album.ReleaseDatePrecision != "day" {
-		return Song{}, false
+	if equalStrings(trackArtists, artists) {
+		trackArtists = nil
 	}
-	rel, ok := parseSpotifyReleaseDate(t.Album.ReleaseDate, t.Album.ReleaseDatePrecision)
-	if !ok {
-		return Song{}, false
+
+	// A missing or unparseable release date is left zero, so that it can
+	// be looked up.
+	var rel ReleaseDate
+	if t.Album.ReleaseDate != "" && (t.Album.ReleaseDatePrecision == "year" || t.Album.ReleaseDatePrecision == "month" || t.Album.ReleaseDatePrecision == "day") {
+		rel, _ = parseSpotifyReleaseDate(t.Album.ReleaseDate, t.Album.ReleaseDatePrecision)
 	}
 
 	return Song{
-		Artist:      artist.Name,
-		Album:       t.Album.Name,
-		Title:       t.Name,
-		Release:     rel,
-		Link:        t.ExternalURLs.Spotify,
-		AlbumLink:   t.Album.ExternalURLs.Spotify,
-		ArtworkURL:  spotifyArtworkURL(t.Album.Images),
-		PlayCount:   0,
-		Loved:       nil,
-		TrackNumber: t.TrackNumber,
+		Artist:        joinArtists(artists),
+		Album:         t.Album.Name,
+		Title:         t.Name,
+		Artists:       artists,
+		ArtistsListed: true,
+		TrackArtists:  trackArtists,
+		Compilation:   isVariousArtists(artists[0]),
+		Release:       rel,
+		Link:          t.ExternalURLs.Spotify,
+		AlbumLink:     t.Album.ExternalURLs.Spotify,
+		ArtworkURL:    spotifyArtworkURL(t.Album.Images),
+		ISRC:          t.ExternalIDs.ISRC,
+		PlayCount:     0,
+		Loved:         nil,
+		TrackNumber:   t.TrackNumber,
 	}, true
 }
 
@@ -393,13 +431,24 @@ func spotifyArtworkURL(images []SpotifyImage) string {
 }
 
 func parseSpotifyReleaseDate(date, precision string) (ReleaseDate, bool) {
-	if precision != "month" && precision != "day" {
+	if precision != "year" && precision != "month" && precision != "day" {
 		panic("bad precision " + precision)
 	}
 	if date == "" {
 		panic("empty date")
 	}
 	switch precision {
+	case "year":
+		year, err := strconv.Atoi(date)
+		if err != nil {
+			return ReleaseDate{}, false
+		}
+		return ReleaseDate{
+			Year:      year,
+			Month:     0,
+			Day:       0,
+			Precision: PrecisionYear,
+		}, true
 	case "month":
 		c := strings.Split(date, "-")
 		if len(c) != 2 {
@@ -414,9 +463,10 @@ func parseSpotifyReleaseDate(date, precision string) (ReleaseDate, bool) {
 			return ReleaseDate{}, false
 		}
 		return ReleaseDate{
-			Year:  year,
-			Month: time.Month(month),
-			Day:   0,
+			Year:      year,
+			Month:     time.Month(month),
+			Day:       0,
+			Precision: PrecisionMonth,
 		}, true
 	case "day":
 		c := strings.Split(date, "-")
@@ -436,22 +486,98 @@ func parseSpotifyReleaseDate(date, precision string) (ReleaseDate, bool) {
 			return ReleaseDate{}, false
 		}
 		return ReleaseDate{
-			Year:  year,
-			Month: time.Month(month),
-			Day:   day,
+			Year:      year,
+			Month:     time.Month(month),
+			Day:       day,
+			Precision: PrecisionDay,
 		}, true
 	default:
 		panic("not reachable")
 	}
 }
 
-func FetchSongs(ctx context.Context, c *http.Client, conn Connection, config Config) ([]Song, error) {
+// FetchSongs fetches the songs in the connection's library. The returned
+// Connection reflects any change to the connection's credentials that
+// occurred during the fetch, such as a rotated refresh token, and is valid
+// even if err != nil.
+//
+// For Spotify, lib is the library returned by the previous fetch, or nil,
+// and the returned library should be passed to the next fetch; see
+// syncSpotify. For other services, lib is ignored and the returned library
+// is nil.
+func FetchSongs(ctx context.Context, c *http.Client, spotify *SpotifyOAuth, conn Connection, lib *SpotifyLibrary) ([]Song, Connection, *SpotifyLibrary, error) {
 	switch conn.Service {
 	case Spotify:
-		return fetchSpotify(ctx, c, conn.RefreshToken, config.SpotifyClientID, config.SpotifyClientSecret)
+		lib, refreshToken, err := syncSpotify(ctx, c, spotify, conn.RefreshToken, lib, time.Now())
+		conn.RefreshToken = refreshToken
+		if err != nil {
+			return nil, conn, nil, err
+		}
+		return lib.songs(), conn, lib, nil
 	case Scrobble:
-		return fetchScrobble(ctx, c, conn.Username)
+		songs, err := fetchScrobble(ctx, c, conn.Username)
+		return songs, conn, nil, err
 	default:
 		panic("unreachable")
 	}
 }
+
+func fetchOutcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var cerr ConnectionErrReason
+	if errors.As(err, &cerr) {
+		return string(cerr)
+	}
+	return "error"
+}
+
+// fetchSongs is like FetchSongs, and additionally persists changes to the
+// connection's credentials, enriches the songs' release dates from cached
+// lookups and enqueues the uncached lookups, and prefers original release
+// dates over reissue dates.
+func (s *Server) fetchSongs(ctx context.Context, email string, conn Connection) ([]Song, error) {
+	lg := loggerFrom(ctx).With("service", conn.Service)
+
+	var lib *SpotifyLibrary
+	if conn.Service == Spotify {
+		var err error
+		lib, err = s.getSpotifyLibrary(email)
+		if err != nil {
+			lg.Errorf("get spotify library: %s", err) // fall back to a full sync
+		}
+	}
+
+	start := time.Now()
+	songs, updated, lib, err := FetchSongs(ctx, s.http, s.spotify, conn, lib)
+	fetchSongsDuration.Observe(time.Since(start).Seconds(), string(conn.Service))
+	fetchSongsTotal.Inc(string(conn.Service), fetchOutcome(err))
+
+	if updated.Conn != conn.Conn {
+		lg.Infof("connection credentials changed")
+		if err := UpdateEntity(s.redis, accountKey(email), &Account{}, func(v interface{}) interface{} {
+			a := v.(*Account)
+			if a.Connection != nil && a.Connection.Service == updated.Service && a.Connection.Conn == conn.Conn {
+				a.Connection.Conn = updated.Conn
+			}
+			return a
+		}); err != nil {
+			lg.Warningf("update connection credentials: %s", err) // only log
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if lib != nil {
+		if err := s.putSpotifyLibrary(email, lib); err != nil {
+			lg.Errorf("put spotify library: %s", err) // only log
+		}
+	}
+	songs, uncached := s.enrichSongs(ctx, songs)
+	if len(uncached) > 0 {
+		s.enqueueMusicBrainzLookups(ctx, email, conn.Service, uncached)
+	}
+	return preferOriginalReleases(songs), nil
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Release dates from music services are sometimes missing or imprecise:
+// Scrobble songs may lack a release date, and Spotify may only know the
+// year or month. Such songs are enriched with the original release date of
+// the album's release group from MusicBrainz.
+// https://musicbrainz.org/doc/MusicBrainz_API
+//
+// Lookups are slow because of MusicBrainz's rate limit, so they don't
+// happen while fetching a library. Fetching applies cached lookups, and
+// enqueues a task (see MusicBrainzTaskHandler) to look up the rest. When
+// the task finds new release dates, it clears the account's library cache
+// so that the next request applies them.
+
+const defaultMusicBrainzBaseURL = "https://musicbrainz.org/ws/2"
+
+// MusicBrainz requires a meaningful User-Agent with contact information.
+// https://musicbrainz.org/doc/MusicBrainz_API/Rate_Limiting
+const musicBrainzUserAgent = AppName + " (https://" + AppDomain + "; " + SupportEmail + ")"
+
+// musicBrainzInterval is the minimum interval between requests to
+// MusicBrainz. Its rate limit is one request per second per client, and
+// all instances share the client's IP address, so the interval is
+// coordinated through Redis.
+const musicBrainzInterval = time.Second
+
+const musicBrainzRateLimitKey = "musicbrainz_ratelimit"
+
+// musicBrainzMinScore is the minimum search score, out of 100, for a
+// release group to be considered a match.
+const musicBrainzMinScore = 90
+
+// musicBrainzTaskBudget bounds the time spent on lookups in a task. Albums
+// not looked up in time are enqueued in another task. It's a variable for
+// tests.
+var musicBrainzTaskBudget = 3 * time.Minute
+
+// maxMusicBrainzTaskAlbums is the maximum number of albums in a task.
+const maxMusicBrainzTaskAlbums = 100
+
+const (
+	musicBrainzFoundTTL    = 30 * 24 * time.Hour
+	musicBrainzNotFoundTTL = 7 * 24 * time.Hour
+)
+
+// musicBrainzCacheKey returns the key for the lookup of the album by the
+// artist, which is the album artist of the songs (see Song.albumArtist).
+// Editions are looked up separately, as their release dates differ.
+func musicBrainzCacheKey(artist, album string) string {
+	h := sha256.Sum256([]byte(normalizeName(artist) + "\x00" + normalizeName(album)))
+	return fmt.Sprintf("musicbrainz:%s", hex.EncodeToString(h[:16]))
+}
+
+// musicBrainzPendingKey is set while a lookup task for the account is
+// pending, so that fetches don't enqueue duplicate tasks.
+func musicBrainzPendingKey(email string) string {
+	return fmt.Sprintf("musicbrainz_pending:%s", email)
+}
+
+// MusicBrainzResult is the cached result of a lookup.
+type MusicBrainzResult struct {
+	Release *ReleaseDate `json:"release"` // or nil if not found
+}
+
+type MusicBrainz struct {
+	http     *http.Client
+	redis    *redis.Client
+	baseURL  string
+	interval time.Duration
+}
+
+func newMusicBrainz(c *http.Client, redisc *redis.Client, baseURL string) *MusicBrainz {
+	if baseURL == "" {
+		baseURL = defaultMusicBrainzBaseURL
+	}
+	return &MusicBrainz{
+		http:     c,
+		redis:    redisc,
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		interval: musicBrainzInterval,
+	}
+}
+
+// wait blocks until a request may be made without exceeding the rate
+// limit. A request may be made by the instance that sets the rate limit
+// key, which expires after the interval.
+func (m *MusicBrainz) wait(ctx context.Context) error {
+	for {
+		ok, err := m.redis.SetNX(musicBrainzRateLimitKey, 1, m.interval).Result()
+		if err != nil {
+			return fmt.Errorf("SETNX musicbrainz rate limit: %s", err)
+		}
+		if ok {
+			return nil
+		}
+
+		d, err := m.redis.PTTL(musicBrainzRateLimitKey).Result()
+		if err != nil {
+			return fmt.Errorf("PTTL musicbrainz rate limit: %s", err)
+		}
+		if d <= 0 || d > m.interval {
+			d = m.interval / 10 // expired meanwhile, or no expiration
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *MusicBrainz) get(ctx context.Context, path string, v url.Values, dst interface{}) error {
+	if err := m.wait(ctx); err != nil {
+		return err
+	}
+
+	v.Set("fmt", "json")
+	req, err := http.NewRequest("GET", m.baseURL+path+"?"+v.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("new musicbrainz request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", musicBrainzUserAgent)
+	req.Header.Set("Accept", "application/json")
+
+	rsp, err := m.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("do musicbrainz request: %s", err)
+	}
+	defer drainAndClose(rsp.Body)
+
+	if rsp.StatusCode == 404 {
+		return errMusicBrainzNotFound
+	}
+	if !is2xxStatus(rsp.StatusCode) {
+		return StatusError{rsp.StatusCode}
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(dst); err != nil {
+		return fmt.Errorf("json-decode musicbrainz response: %s", err)
+	}
+	return nil
+}
+
+var errMusicBrainzNotFound = errors.New("musicbrainz: not found")
+
+type MusicBrainzArtistCredit struct {
+	Name   string `json:"name"`
+	Artist struct {
+		Name string `json:"name"`
+	} `json:"artist"`
+}
+
+type MusicBrainzReleaseGroup struct {
+	ID               string                    `json:"id"`
+	Title            string                    `json:"title"`
+	PrimaryType      string                    `json:"primary-type"`       // e.g. "Album", "Single"; possibly ""
+	FirstReleaseDate string                    `json:"first-release-date"` // "YYYY", "YYYY-MM", "YYYY-MM-DD", or ""
+	Score            int                       `json:"score"`              // only in search results
+	ArtistCredit     []MusicBrainzArtistCredit `json:"artist-credit"`
+}
+
+type MusicBrainzSearchResponse struct {
+	ReleaseGroups []MusicBrainzReleaseGroup `json:"release-groups"`
+}
+
+type MusicBrainzISRCResponse struct {
+	Recordings []struct {
+		Releases []struct {
+			ReleaseGroup MusicBrainzReleaseGroup `json:"release-group"`
+		} `json:"releases"`
+	} `json:"recordings"`
+}
+
+// lookupISRC returns the release group of the album, among the release
+// groups with a recording with the ISRC.
+func (m *MusicBrainz) lookupISRC(ctx context.Context, isrc, album string) (MusicBrainzReleaseGroup, bool, error) {
+	v := url.Values{}
+	v.Set("inc", "releases release-groups")
+
+	var rsp MusicBrainzISRCResponse
+	err := m.get(ctx, "/isrc/"+url.PathEscape(isrc), v, &rsp)
+	if err == errMusicBrainzNotFound {
+		return MusicBrainzReleaseGroup{}, false, nil
+	}
+	if err != nil {
+		return MusicBrainzReleaseGroup{}, false, err
+	}
+
+	for _, rec := range rsp.Recordings {
+		for _, rel := range rec.Releases {
+			if normalizeName(rel.ReleaseGroup.Title) == normalizeName(album) && rel.ReleaseGroup.FirstReleaseDate != "" {
+				return rel.ReleaseGroup, true, nil
+			}
+		}
+	}
+	return MusicBrainzReleaseGroup{}, false, nil
+}
+
+// searchReleaseGroup returns the release group of the album by the artist.
+func (m *MusicBrainz) searchReleaseGroup(ctx context.Context, artist, album string) (MusicBrainzReleaseGroup, bool, error) {
+	v := url.Values{}
+	v.Set("query", fmt.Sprintf("releasegroup:%s AND artist:%s", luceneQuote(album), luceneQuote(artist)))
+	v.Set("limit", "5")
+
+	var rsp MusicBrainzSearchResponse
+	if err := m.get(ctx, "/release-group", v, &rsp); err != nil {
+		return MusicBrainzReleaseGroup{}, false, err
+	}
+
+	for _, rg := range rsp.ReleaseGroups {
+		if rg.Score < musicBrainzMinScore || rg.FirstReleaseDate == "" {
+			continue
+		}
+		if normalizeName(rg.Title) != normalizeName(album) || !rg.creditsArtist(artist) {
+			continue
+		}
+		return rg, true, nil
+	}
+	return MusicBrainzReleaseGroup{}, false, nil
+}
+
+func (rg MusicBrainzReleaseGroup) creditsArtist(artist string) bool {
+	n := normalizeName(artist)
+	for _, c := range rg.ArtistCredit {
+		if normalizeName(c.Name) == n || normalizeName(c.Artist.Name) == n {
+			return true
+		}
+	}
+	return false
+}
+
+// luceneQuote quotes s as a phrase in a Lucene query.
+func luceneQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// parseMusicBrainzDate parses a date of the form "YYYY", "YYYY-MM", or
+// "YYYY-MM-DD".
+func parseMusicBrainzDate(date string) (ReleaseDate, bool) {
+	c := strings.Split(date, "-")
+	if len(c) == 0 || len(c) > 3 {
+		return ReleaseDate{}, false
+	}
+	var n [3]int
+	for i := range c {
+		v, err := strconv.Atoi(c[i])
+		if err != nil || v <= 0 {
+			return ReleaseDate{}, false
+		}
+		n[i] = v
+	}
+	if n[1] > 12 || n[2] > 31 {
+		return ReleaseDate{}, false
+	}
+
+	r := ReleaseDate{Year: n[0], Month: time.Month(n[1]), Day: n[2]}
+	switch len(c) {
+	case 1:
+		r.Precision = PrecisionYear
+	case 2:
+		r.Precision = PrecisionMonth
+	case 3:
+		r.Precision = PrecisionDay
+	}
+	return r, true
+}
+
+// lookupRelease returns the original release date of the album, trying
+// the songs' ISRCs before searching by artist and album.
+func (m *MusicBrainz) lookupRelease(ctx context.Context, artist, album string, isrcs []string) (*ReleaseDate, error) {
+	for _, isrc := range isrcs {
+		rg, ok, err := m.lookupISRC(ctx, isrc, album)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if r, ok := parseMusicBrainzDate(rg.FirstReleaseDate); ok {
+				return &r, nil
+			}
+		}
+	}
+
+	rg, ok, err := m.searchReleaseGroup(ctx, artist, album)
+	if err != nil || !ok {
+		return nil, err
+	}
+	if r, ok := parseMusicBrainzDate(rg.FirstReleaseDate); ok {
+		return &r, nil
+	}
+	return nil, nil
+}
+
+// maxISRCLookups is the maximum number of ISRCs per album looked up before
+// falling back to search.
+const maxISRCLookups = 1
+
+// needsEnrichment reports whether the song's release date is missing or
+// less precise than a day, or may be a reissue's rather than the
+// original's.
+func needsEnrichment(s Song) bool {
+	return s.Release.Year == 0 || s.Release.precision() != PrecisionDay || isReissue(s.Album)
+}
+
+// preferRelease reports whether the release date from MusicBrainz should
+// replace the song's release date. It replaces a missing date, and a less
+// precise date that it is consistent with. An earlier year is assumed to
+// be the original release of a reissue.
+func preferRelease(have, mb ReleaseDate) bool {
+	switch {
+	case have.Year == 0:
+		return true
+	case mb.Year < have.Year:
+		return true
+	case mb.Year > have.Year:
+		return false
+	}
+	hp, mp := have.precision(), mb.precision()
+	switch {
+	case hp == PrecisionYear:
+		return mp != PrecisionYear
+	case hp == PrecisionMonth:
+		return mp == PrecisionDay && mb.Month == have.Month
+	default:
+		return false
+	}
+}
+
+// MusicBrainzAlbum is an album to look up.
+type MusicBrainzAlbum struct {
+	Artist string   `json:"artist"`
+	Album  string   `json:"album"` // base title; see baseAlbumTitle
+	ISRCs  []string `json:"isrcs"`
+}
+
+func (a MusicBrainzAlbum) cacheKey() string {
+	return musicBrainzCacheKey(a.Artist, a.Album)
+}
+
+// enrichSongs fills in missing and imprecise release dates from cached
+// MusicBrainz lookups, and drops the songs whose release date remains
+// unknown. It returns the albums that need enrichment but haven't been
+// looked up.
+func (s *Server) enrichSongs(ctx context.Context, songs []Song) ([]Song, []MusicBrainzAlbum) {
+	lg := loggerFrom(ctx)
+
+	type album struct {
+		MusicBrainzAlbum
+		songs []int // indexes into songs
+	}
+	var keys []string
+	albums := make(map[string]*album)
+	for i, song := range songs {
+		if !needsEnrichment(song) {
+			continue
+		}
+		base, _ := baseAlbumTitle(song.Album)
+		k := musicBrainzCacheKey(song.albumArtist(), base)
+		a, ok := albums[k]
+		if !ok {
+			a = &album{MusicBrainzAlbum: MusicBrainzAlbum{Artist: song.albumArtist(), Album: base}}
+			albums[k] = a
+			keys = append(keys, k)
+		}
+		if song.ISRC != "" && len(a.ISRCs) < maxISRCLookups {
+			a.ISRCs = append(a.ISRCs, song.ISRC)
+		}
+		a.songs = append(a.songs, i)
+	}
+
+	var vals []interface{}
+	if len(keys) > 0 {
+		var err error
+		vals, err = s.redis.MGet(keys...).Result()
+		if err != nil {
+			lg.Errorf("MGET musicbrainz cache: %s", err)
+			vals = make([]interface{}, len(keys)) // treat as uncached
+		}
+	}
+
+	var uncached []MusicBrainzAlbum
+	for i, k := range keys {
+		a := albums[k]
+		str, ok := vals[i].(string)
+		if !ok {
+			uncached = append(uncached, a.MusicBrainzAlbum)
+			continue
+		}
+		var res MusicBrainzResult
+		mustUnmarshalJSON([]byte(str), &res)
+		if res.Release == nil {
+			continue
+		}
+		for _, i := range a.songs {
+			if preferRelease(songs[i].Release, *res.Release) {
+				songs[i].Release = *res.Release
+			}
+		}
+	}
+
+	ret := songs[:0]
+	for _, song := range songs {
+		if song.Release.Year != 0 {
+			ret = append(ret, song)
+		}
+	}
+	return ret, uncached
+}
+
+// MusicBrainzTask is the payload of a task that looks up albums for an
+// account.
+type MusicBrainzTask struct {
+	Email   string             `json:"email"`
+	Service Service            `json:"service"`
+	Albums  []MusicBrainzAlbum `json:"albums"`
+}
+
+// enqueueMusicBrainzLookups enqueues a task to look up the albums, unless
+// one is already pending for the account.
+func (s *Server) enqueueMusicBrainzLookups(ctx context.Context, email string, service Service, albums []MusicBrainzAlbum) {
+	lg := loggerFrom(ctx)
+
+	if len(albums) > maxMusicBrainzTaskAlbums {
+		albums = albums[:maxMusicBrainzTaskAlbums]
+	}
+	// The key expires in case the task is lost; the task deletes it when
+	// done.
+	ok, err := s.redis.SetNX(musicBrainzPendingKey(email), 1, 2*musicBrainzTaskBudget).Result()
+	if err != nil {
+		lg.Errorf("SETNX musicbrainz pending: %s", err)
+		return
+	}
+	if !ok {
+		return // already pending
+	}
+	if err := s.tasks.PostJSONTask(ctx, "/internal/task/musicbrainz", MusicBrainzTask{email, service, albums}); err != nil {
+		lg.Errorf("post JSON task: %s", err)
+		if err := s.redis.Del(musicBrainzPendingKey(email)).Err(); err != nil {
+			lg.Errorf("DEL musicbrainz pending: %s", err) // only log
+		}
+	}
+}
+
+// lookupAlbums looks up and caches the release dates of the uncached
+// albums. It stops when the budget is exhausted, and returns the number of
+// release dates found and the albums that weren't looked up in time. It
+// returns an error if MusicBrainz is unavailable.
+func (s *Server) lookupAlbums(ctx context.Context, albums []MusicBrainzAlbum, budget time.Duration) (int, []MusicBrainzAlbum, error) {
+	lg := loggerFrom(ctx)
+
+	lookupCtx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	found := 0
+	for i, a := range albums {
+		k := a.cacheKey()
+		n, err := s.redis.Exists(k).Result()
+		if err != nil {
+			return found, nil, fmt.Errorf("EXISTS musicbrainz cache: %s", err)
+		}
+		if n > 0 {
+			musicBrainzLookupsTotal.Inc("cached")
+			continue
+		}
+
+		rel, err := s.musicBrainz.lookupRelease(lookupCtx, a.Artist, a.Album, a.ISRCs)
+		if err != nil {
+			if lookupCtx.Err() != nil && ctx.Err() == nil {
+				musicBrainzLookupsTotal.Inc("skipped")
+				lg.Infof("musicbrainz budget exhausted: looked up %d of %d albums", i, len(albums))
+				return found, albums[i:], nil
+			}
+			musicBrainzLookupsTotal.Inc("error")
+			return found, nil, err
+		}
+
+		res := MusicBrainzResult{Release: rel}
+		ttl := musicBrainzFoundTTL
+		if rel == nil {
+			ttl = musicBrainzNotFoundTTL
+			musicBrainzLookupsTotal.Inc("not found")
+		} else {
+			found++
+			musicBrainzLookupsTotal.Inc("found")
+		}
+		if err := s.redis.Set(k, mustMarshalJSON(res), ttl).Err(); err != nil {
+			return found, nil, fmt.Errorf("SET musicbrainz cache: %s", err)
+		}
+	}
+	return found, nil, nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMusicBrainz serves canned MusicBrainz responses by path, and records
+// the requests.
+type fakeMusicBrainz struct {
+	mu       sync.Mutex
+	requests []string    // paths
+	times    []time.Time // of requests
+	status   int         // if non-zero, the status for all requests
+	isrc     map[string]string
+	search   string // response for /release-group
+}
+
+func (f *fakeMusicBrainz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r.URL.Path)
+	f.times = append(f.times, time.Now())
+	f.mu.Unlock()
+
+	if r.Header.Get("User-Agent") != musicBrainzUserAgent {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/isrc/"):
+		rsp, ok := f.isrc[strings.TrimPrefix(r.URL.Path, "/isrc/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(rsp))
+	case r.URL.Path == "/release-group":
+		w.Write([]byte(f.search))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeMusicBrainz) paths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+const (
+	testISRCResponse = `{"recordings": [{"releases": [
+		{"release-group": {"id": "1", "title": "Rumours (Super Deluxe)", "first-release-date": "2013-01-29"}},
+		{"release-group": {"id": "2", "title": "Rumours", "first-release-date": "1977-02-04"}}
+	]}]}`
+	testSearchResponse = `{"release-groups": [
+		{"id": "3", "title": "Blue", "score": 100, "first-release-date": "1971-06-22", "artist-credit": [{"name": "Someone Else"}]},
+		{"id": "4", "title": "Blue", "score": 100, "first-release-date": "1971-06-22", "artist-credit": [{"name": "Joni Mitchell", "artist": {"name": "Joni Mitchell"}}]}
+	]}`
+	testEmptySearchResponse = `{"release-groups": []}`
+)
+
+func newTestMusicBrainz(t *testing.T, s *Server, f *fakeMusicBrainz) {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	s.musicBrainz = newMusicBrainz(srv.Client(), s.redis, srv.URL)
+	s.musicBrainz.interval = time.Millisecond
+}
+
+func cachedRelease(t *testing.T, s *Server, a MusicBrainzAlbum) (MusicBrainzResult, bool) {
+	t.Helper()
+	b, err := s.redis.Get(a.cacheKey()).Bytes()
+	if err != nil {
+		return MusicBrainzResult{}, false
+	}
+	var res MusicBrainzResult
+	mustUnmarshalJSON(b, &res)
+	return res, true
+}
+
+func TestLookupAlbums(t *testing.T) {
+	rumours := MusicBrainzAlbum{Artist: "Fleetwood Mac", Album: "Rumours", ISRCs: []string{"USWB10000001"}}
+	blue := MusicBrainzAlbum{Artist: "Joni Mitchell", Album: "Blue"}
+
+	t.Run("isrc", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		f := &fakeMusicBrainz{isrc: map[string]string{"USWB10000001": testISRCResponse}}
+		newTestMusicBrainz(t, s, f)
+
+		found, _, err := s.lookupAlbums(context.Background(), []MusicBrainzAlbum{rumours}, time.Minute)
+		if err != nil || found != 1 {
+			t.Fatalf("got %d, %v; want 1, nil", found, err)
+		}
+		res, ok := cachedRelease(t, s, rumours)
+		if want := (ReleaseDate{Year: 1977, Month: 2, Day: 4, Precision: PrecisionDay}); !ok || res.Release == nil || *res.Release != want {
+			t.Errorf("cached %+v, %v; want %+v", res.Release, ok, want)
+		}
+		if got := f.paths(); !equalStrings(got, []string{"/isrc/USWB10000001"}) {
+			t.Errorf("requests: got %q", got)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		f := &fakeMusicBrainz{search: testSearchResponse}
+		newTestMusicBrainz(t, s, f)
+
+		found, _, err := s.lookupAlbums(context.Background(), []MusicBrainzAlbum{blue}, time.Minute)
+		if err != nil || found != 1 {
+			t.Fatalf("got %d, %v; want 1, nil", found, err)
+		}
+		res, ok := cachedRelease(t, s, blue)
+		if want := (ReleaseDate{Year: 1971, Month: 6, Day: 22, Precision: PrecisionDay}); !ok || res.Release == nil || *res.Release != want {
+			t.Errorf("cached %+v, %v; want %+v", res.Release, ok, want)
+		}
+	})
+
+	t.Run("isrc not found falls back to search", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		f := &fakeMusicBrainz{search: testEmptySearchResponse}
+		newTestMusicBrainz(t, s, f)
+
+		if _, _, err := s.lookupAlbums(context.Background(), []MusicBrainzAlbum{rumours}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.paths(); !equalStrings(got, []string{"/isrc/USWB10000001", "/release-group"}) {
+			t.Errorf("requests: got %q", got)
+		}
+	})
+
+	t.Run("not found is cached", func(t *testing.T) {
+		s, fr := newTestServer(t)
+		f := &fakeMusicBrainz{search: testEmptySearchResponse}
+		newTestMusicBrainz(t, s, f)
+
+		for i := 0; i < 2; i++ {
+			found, _, err := s.lookupAlbums(context.Background(), []MusicBrainzAlbum{blue}, time.Minute)
+			if err != nil || found != 0 {
+				t.Fatalf("got %d, %v; want 0, nil", found, err)
+			}
+		}
+		if got := f.paths(); len(got) != 1 {
+			t.Errorf("requests: got %q, want 1 request", got)
+		}
+		res, ok := cachedRelease(t, s, blue)
+		if !ok || res.Release != nil {
+			t.Errorf("cached %+v, %v; want not found", res.Release, ok)
+		}
+		if ttl := fr.ttl(blue.cacheKey()); ttl <= musicBrainzNotFoundTTL-time.Minute || ttl > musicBrainzNotFoundTTL {
+			t.Errorf("TTL: got %s, want %s", ttl, musicBrainzNotFoundTTL)
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		f := &fakeMusicBrainz{status: http.StatusServiceUnavailable}
+		newTestMusicBrainz(t, s, f)
+
+		_, _, err := s.lookupAlbums(context.Background(), []MusicBrainzAlbum{blue, rumours}, time.Minute)
+		if err != (StatusError{http.StatusServiceUnavailable}) {
+			t.Errorf("got %v, want 503 error", err)
+		}
+		if got := f.paths(); len(got) != 1 {
+			t.Errorf("requests: got %q, want 1 request", got)
+		}
+		if _, ok := cachedRelease(t, s, blue); ok {
+			t.Errorf("error result was cached")
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		s, _ := newTestServer(t)
+		f := &fakeMusicBrainz{search: testSearchResponse}
+		newTestMusicBrainz(t, s, f)
+		s.musicBrainz.interval = time.Second
+
+		other := MusicBrainzAlbum{Artist: "Joni Mitchell", Album: "Court and Spark"}
+		found, remaining, err := s.lookupAlbums(context.Background(), []MusicBrainzAlbum{blue, other}, 100*time.Millisecond)
+		if err != nil || found != 1 {
+			t.Fatalf("got %d, %v; want 1, nil", found, err)
+		}
+		if len(remaining) != 1 || remaining[0].Album != other.Album {
+			t.Errorf("remaining: got %+v", remaining)
+		}
+		if _, ok := cachedRelease(t, s, other); ok {
+			t.Errorf("album after the budget was cached")
+		}
+	})
+}
+
+func TestMusicBrainzRateLimitShared(t *testing.T) {
+	s, _ := newTestServer(t)
+	f := &fakeMusicBrainz{search: testEmptySearchResponse}
+	newTestMusicBrainz(t, s, f)
+	const interval = 50 * time.Millisecond
+	s.musicBrainz.interval = interval
+
+	// Two instances share the rate limit through Redis.
+	other := *s.musicBrainz
+	var wg sync.WaitGroup
+	for _, m := range []*MusicBrainz{s.musicBrainz, &other} {
+		wg.Add(1)
+		go func(m *MusicBrainz) {
+			defer wg.Done()
+			for i := 0; i < 2; i++ {
+				if _, _, err := m.searchReleaseGroup(context.Background(), "a", "b"); err != nil {
+					t.Error(err)
+				}
+			}
+		}(m)
+	}
+	wg.Wait()
+
+	if len(f.times) != 4 {
+		t.Fatalf("got %d requests, want 4", len(f.times))
+	}
+	for i := 1; i < len(f.times); i++ {
+		// allow for the resolution of the fake Redis's expiration
+		if d := f.times[i].Sub(f.times[i-1]); d < interval-5*time.Millisecond {
+			t.Errorf("request %d was %s after the previous one, want at least %s", i, d, interval)
+		}
+	}
+}
+
+func TestEnrichSongs(t *testing.T) {
+	s, _ := newTestServer(t)
+	ctx := context.Background()
+
+	cached := ReleaseDate{Year: 1977, Month: 2, Day: 4, Precision: PrecisionDay}
+	if err := s.redis.Set(musicBrainzCacheKey("Fleetwood Mac", "Rumours"), mustMarshalJSON(MusicBrainzResult{&cached}), 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	songs := []Song{
+		{Artist: "Fleetwood Mac", Album: "Rumours", Title: "Dreams", Release: ReleaseDate{Year: 1977, Precision: PrecisionYear}},
+		{Artist: "Joni Mitchell", Album: "Blue", Title: "River", ISRC: "X"},
+		{Artist: "Radiohead", Album: "OK Computer", Title: "Airbag", Release: ReleaseDate{Year: 1997, Month: 5, Day: 21, Precision: PrecisionDay}},
+	}
+
+	got, uncached := s.enrichSongs(ctx, songs)
+	if len(got) != 2 || got[0].Release != cached || got[1].Album != "OK Computer" {
+		t.Errorf("songs: got %+v", got)
+	}
+	if len(uncached) != 1 || uncached[0].Album != "Blue" || !equalStrings(uncached[0].ISRCs, []string{"X"}) {
+		t.Errorf("uncached: got %+v", uncached)
+	}
+
+	// Enqueueing is deduplicated while a task is pending.
+	for i := 0; i < 2; i++ {
+		s.enqueueMusicBrainzLookups(ctx, "a@example.com", Scrobble, uncached)
+	}
+	tasks := s.tasks.(*testTasksClient).tasks
+	if len(tasks) != 1 || tasks[0].Path != "/internal/task/musicbrainz" {
+		t.Errorf("tasks: got %+v", tasks)
+	}
+}
+
+func TestMusicBrainzTaskHandler(t *testing.T) {
+	const email = "a@example.com"
+	blue := MusicBrainzAlbum{Artist: "Joni Mitchell", Album: "Blue"}
+	task := string(mustMarshalJSON(MusicBrainzTask{email, Scrobble, []MusicBrainzAlbum{blue}}))
+
+	setup := func(t *testing.T, f *fakeMusicBrainz) *Server {
+		s, _ := newTestServer(t)
+		newTestMusicBrainz(t, s, f)
+		for _, k := range []string{libraryCacheKey(Scrobble, email), musicBrainzPendingKey(email)} {
+			if err := s.redis.Set(k, "1", 0).Err(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s
+	}
+	exists := func(s *Server, k string) bool {
+		return s.redis.Exists(k).Val() == 1
+	}
+
+	t.Run("found", func(t *testing.T) {
+		s := setup(t, &fakeMusicBrainz{search: testSearchResponse})
+		rec := httptest.NewRecorder()
+		s.MusicBrainzTaskHandler(rec, httptest.NewRequest("POST", "/internal/task/musicbrainz", strings.NewReader(task)), nil)
+		if rec.Code != 200 {
+			t.Fatalf("status: got %d, want 200", rec.Code)
+		}
+		if exists(s, libraryCacheKey(Scrobble, email)) {
+			t.Errorf("library cache not cleared")
+		}
+		if exists(s, musicBrainzPendingKey(email)) {
+			t.Errorf("pending key not cleared")
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		defer func(d time.Duration) { musicBrainzTaskBudget = d }(musicBrainzTaskBudget)
+		musicBrainzTaskBudget = 500 * time.Millisecond // EXPIRE has a resolution of seconds
+
+		s := setup(t, &fakeMusicBrainz{search: testEmptySearchResponse})
+		s.musicBrainz.interval = time.Second
+		court := MusicBrainzAlbum{Artist: "Joni Mitchell", Album: "Court and Spark"}
+		task := string(mustMarshalJSON(MusicBrainzTask{email, Scrobble, []MusicBrainzAlbum{blue, court}}))
+
+		rec := httptest.NewRecorder()
+		s.MusicBrainzTaskHandler(rec, httptest.NewRequest("POST", "/internal/task/musicbrainz", strings.NewReader(task)), nil)
+		if rec.Code != 200 {
+			t.Fatalf("status: got %d, want 200", rec.Code)
+		}
+		// Nothing was found, so the library cache is kept, but the rest
+		// of the albums are looked up in another task.
+		if !exists(s, libraryCacheKey(Scrobble, email)) {
+			t.Errorf("library cache cleared")
+		}
+		if !exists(s, musicBrainzPendingKey(email)) {
+			t.Errorf("pending key cleared while another task is pending")
+		}
+		tasks := s.tasks.(*testTasksClient).tasks
+		if len(tasks) != 1 || tasks[0].Path != "/internal/task/musicbrainz" {
+			t.Fatalf("tasks: got %+v", tasks)
+		}
+		if albums := tasks[0].Payload.(MusicBrainzTask).Albums; len(albums) != 1 || albums[0].Album != court.Album {
+			t.Errorf("next task albums: got %+v", albums)
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		s := setup(t, &fakeMusicBrainz{status: http.StatusServiceUnavailable})
+		rec := httptest.NewRecorder()
+		s.MusicBrainzTaskHandler(rec, httptest.NewRequest("POST", "/internal/task/musicbrainz", strings.NewReader(task)), nil)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("status: got %d, want 503", rec.Code)
+		}
+		if !exists(s, libraryCacheKey(Scrobble, email)) || !exists(s, musicBrainzPendingKey(email)) {
+			t.Errorf("keys cleared on error")
+		}
+	})
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Muted artists and albums are excluded from birthdays and emails.
+//
+// Each mute list is a hash from mute ID to the JSON-encoded MutedArtist or
+// MutedAlbum. The ID is derived from the normalized names, so muting the
+// same artist or album twice is idempotent.
+
+func mutedArtistsKey(email string) string {
+	return fmt.Sprintf("muted_artists:%s", email)
+}
+
+func mutedAlbumsKey(email string) string {
+	return fmt.Sprintf("muted_albums:%s", email)
+}
+
+// maxMutes is the maximum number of entries in each mute list.
+const maxMutes = 1000
+
+type MutedArtist struct {
+	ID     string `json:"id"`
+	Artist string `json:"artist"`
+}
+
+type MutedAlbum struct {
+	ID     string `json:"id"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+}
+
+type Mutes struct {
+	Artists []MutedArtist `json:"artists"`
+	Albums  []MutedAlbum  `json:"albums"`
+}
+
+// normalizeName normalizes an artist or album name for matching: case and
+// whitespace differences are ignored.
+func normalizeName(s string) string {
+	return strings.Join(strings.Fields(strings.ToLower(s)), " ")
+}
+
+func artistMuteKey(artist string) string {
+	return normalizeName(artist)
+}
+
+// albumMuteKey returns the key that identifies the album for mutes. Editions
+// of an album share the key, as they are one item in birthdays (see
+// albumGroupKey), so muting one edition mutes them all.
+func albumMuteKey(artist, album string) string {
+	base, _ := baseAlbumTitle(album)
+	return normalizeName(artist) + "\x00" + normalizeName(base)
+}
+
+func muteID(muteKey string) string {
+	h := sha256.Sum256([]byte(muteKey))
+	return hex.EncodeToString(h[:8])
+}
+
+func (s *Server) getMutes(email string) (Mutes, error) {
+	m := Mutes{
+		Artists: make([]MutedArtist, 0),
+		Albums:  make([]MutedAlbum, 0),
+	}
+
+	artists, err := s.redis.HVals(mutedArtistsKey(email)).Result()
+	if err != nil {
+		return Mutes{}, fmt.Errorf("HVALS muted artists: %s", err)
+	}
+	for _, v := range artists {
+		var a MutedArtist
+		mustUnmarshalJSON([]byte(v), &a)
+		m.Artists = append(m.Artists, a)
+	}
+
+	albums, err := s.redis.HVals(mutedAlbumsKey(email)).Result()
+	if err != nil {
+		return Mutes{}, fmt.Errorf("HVALS muted albums: %s", err)
+	}
+	for _, v := range albums {
+		var a MutedAlbum
+		mustUnmarshalJSON([]byte(v), &a)
+		m.Albums = append(m.Albums, a)
+	}
+
+	sort.Slice(m.Artists, func(i, j int) bool {
+		return normalizeName(m.Artists[i].Artist) < normalizeName(m.Artists[j].Artist)
+	})
+	sort.Slice(m.Albums, func(i, j int) bool {
+		return albumMuteKey(m.Albums[i].Artist, m.Albums[i].Album) < albumMuteKey(m.Albums[j].Artist, m.Albums[j].Album)
+	})
+	return m, nil
+}
+
+// muteAlbum adds the album to the account's muted albums.
+func (s *Server) muteAlbum(email, artist, album string) (MutedAlbum, error) {
+	m := MutedAlbum{
+		ID:     muteID(albumMuteKey(artist, album)),
+		Artist: artist,
+		Album:  album,
+	}
+	if err := s.redis.HSet(mutedAlbumsKey(email), m.ID, mustMarshalJSON(m)).Err(); err != nil {
+		return MutedAlbum{}, fmt.Errorf("HSET muted albums: %s", err)
+	}
+	return m, nil
+}
+
+// filterMuted returns the songs that are not by muted artists or in muted
+// albums.
+func (m Mutes) filterMuted(songs []Song) []Song {
+	if len(m.Artists) == 0 && len(m.Albums) == 0 {
+		return songs
+	}
+
+	artists := make(map[string]bool, len(m.Artists))
+	for _, a := range m.Artists {
+		artists[artistMuteKey(a.Artist)] = true
+	}
+	albums := make(map[string]bool, len(m.Albums))
+	for _, a := range m.Albums {
+		albums[albumMuteKey(a.Artist, a.Album)] = true
+	}
+
+	ret := make([]Song, 0, len(songs))
+	for _, s := range songs {
+		if songMuted(s, artists, albums) {
+			continue
+		}
+		ret = append(ret, s)
+	}
+	return ret
+}
+
+// songMuted reports whether the song is muted. A song is muted if any of the
+// album's credited artists is muted, or if its album is muted.
+func songMuted(s Song, artists, albums map[string]bool) bool {
+	primary := s.albumArtist()
+	if artists[artistMuteKey(s.Artist)] || artists[artistMuteKey(primary)] {
+		return true
+	}
+	for _, a := range s.albumArtists() {
+		if artists[artistMuteKey(a)] {
+			return true
+		}
+	}
+	return albums[albumMuteKey(s.Artist, s.Album)] || albums[albumMuteKey(primary, s.Album)]
+}
+
+func (s *Server) MutesHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	m, err := s.getMutes(email)
+	if err != nil {
+		lg.Errorf("get mutes: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		lg.Errorf("write response: %s", err)
+	}
+}
+
+// checkMuteLimit writes an error response and returns false if the mute
+// list at key is full.
+func (s *Server) checkMuteLimit(w http.ResponseWriter, r *http.Request, key string) bool {
+	n, err := s.redis.HLen(key).Result()
+	if err != nil {
+		loggerFrom(r.Context()).Errorf("HLEN mutes: %s", err)
+		writeInternalError(w)
+		return false
+	}
+	if n >= maxMutes {
+		writeAPIError(w, http.StatusConflict, APIError{
+			Code:    ErrCodeTooManyMutes,
+			Message: fmt.Sprintf("at most %d mutes allowed", maxMutes),
+		})
+		return false
+	}
+	return true
+}
+
+func (s *Server) MuteArtistHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	artist := strings.TrimSpace(r.FormValue("artist"))
+	if artist == "" {
+		writeBadRequest(w, "artist required")
+		return
+	}
+
+	if !s.checkMuteLimit(w, r, mutedArtistsKey(email)) {
+		return
+	}
+
+	m := MutedArtist{
+		ID:     muteID(artistMuteKey(artist)),
+		Artist: artist,
+	}
+	if err := s.redis.HSet(mutedArtistsKey(email), m.ID, mustMarshalJSON(m)).Err(); err != nil {
+		lg.Errorf("HSET muted artists: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		lg.Errorf("write response: %s", err)
+	}
+}
+
+func (s *Server) MuteAlbumHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	artist := strings.TrimSpace(r.FormValue("artist"))
+	if artist == "" {
+		writeBadRequest(w, "artist required")
+		return
+	}
+	album := strings.TrimSpace(r.FormValue("album"))
+	if album == "" {
+		writeBadRequest(w, "album required")
+		return
+	}
+
+	if !s.checkMuteLimit(w, r, mutedAlbumsKey(email)) {
+		return
+	}
+
+	m, err := s.muteAlbum(email, artist, album)
+	if err != nil {
+		lg.Errorf("mute album: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		lg.Errorf("write response: %s", err)
+	}
+}
+
+func (s *Server) UnmuteArtistHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.unmute(w, r, p, mutedArtistsKey)
+}
+
+func (s *Server) UnmuteAlbumHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.unmute(w, r, p, mutedAlbumsKey)
+}
+
+func (s *Server) unmute(w http.ResponseWriter, r *http.Request, p httprouter.Params, keyFunc func(string) string) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	n, err := s.redis.HDel(keyFunc(email), p.ByName("id")).Result()
+	if err != nil {
+		lg.Errorf("HDEL mutes: %s", err)
+		writeInternalError(w)
+		return
+	}
+	if n == 0 {
+		writeNotFound(w, "no such mute")
+		return
+	}
+}
+
+// muteAlbumURL returns the link, for use in emails, that mutes the album
+// for the account. The link is authenticated by the unsubscribe token.
+func muteAlbumURL(email, unsubToken string, a Album) string {
+	v := url.Values{}
+	v.Set("email", email)
+	v.Set("token", unsubToken)
+	v.Set("artist", a.Artist)
+	v.Set("album", a.Album)
+	return "https://" + AppDomain + "/mute?" + v.Encode()
+}
+
+// MuteFromEmailHandler mutes an album from a link in an email. A GET renders
+// a confirmation page, and only the POST from that page mutes the album.
+func (s *Server) MuteFromEmailHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "missing email", http.StatusBadRequest)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+
+	artist := strings.TrimSpace(r.FormValue("artist"))
+	album := strings.TrimSpace(r.FormValue("album"))
+	if artist == "" || album == "" {
+		http.Error(w, "missing artist or album", http.StatusBadRequest)
+		return
+	}
+
+	lg = lg.With("account", accountHash(email))
+
+	wantToken, err := s.redis.Get(unsubTokenKey(email)).Result()
+	if err == redis.Nil {
+		http.Error(w, "no such account", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		lg.Errorf("GET unsub token: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if !tokenEqual(token, wantToken) {
+		lg.Warningf("mute token mismatch")
+		http.Error(w, "token mismatch", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		if err := confirmTmpl.Execute(w, ConfirmTmplArgs{
+			AppName: AppName,
+			Title:   "Mute album",
+			Message: fmt.Sprintf("Stop showing %s by %s in your emails and feed?", album, artist),
+			Action:  "/mute",
+			Fields:  map[string]string{"email": email, "token": token, "artist": artist, "album": album},
+			Button:  "Mute album",
+		}); err != nil {
+			lg.Errorf("execute confirm template: %s", err)
+		}
+		return
+	}
+
+	n, err := s.redis.HLen(mutedAlbumsKey(email)).Result()
+	if err != nil {
+		lg.Errorf("HLEN muted albums: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if n >= maxMutes {
+		http.Error(w, fmt.Sprintf("at most %d albums can be muted", maxMutes), http.StatusConflict)
+		return
+	}
+
+	if _, err := s.muteAlbum(email, artist, album); err != nil {
+		lg.Errorf("mute album: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "muted %s by %s; manage muted albums at https://%s/settings\n", album, artist, AppDomain)
+}
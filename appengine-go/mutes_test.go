@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMuteFromEmailHandler(t *testing.T) {
+	s, _ := newTestServer(t)
+	const email = "a@example.com"
+	const token = "unsub-token"
+	putTestAccount(t, s, email, Account{})
+	if err := s.redis.Set(unsubTokenKey(email), token, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	muted := func(t *testing.T) int64 {
+		n, err := s.redis.HLen(mutedAlbumsKey(email)).Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	form := url.Values{"email": {email}, "token": {token}, "artist": {"Fleetwood Mac"}, "album": {"Rumours"}}
+
+	// GET renders a confirmation page without muting.
+	rec := httptest.NewRecorder()
+	s.MuteFromEmailHandler(rec, httptest.NewRequest("GET", "/mute?"+form.Encode(), nil), nil)
+	if rec.Code != 200 {
+		t.Fatalf("GET: status: got %d, want 200", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{`method="POST"`, `action="/mute"`, `value="Rumours"`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("GET: body missing %s: %s", want, body)
+		}
+	}
+	if n := muted(t); n != 0 {
+		t.Errorf("GET muted %d albums", n)
+	}
+
+	// A bad token is rejected.
+	bad := url.Values{"email": {email}, "token": {"wrong"}, "artist": {"Fleetwood Mac"}, "album": {"Rumours"}}
+	req := httptest.NewRequest("POST", "/mute", strings.NewReader(bad.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	s.MuteFromEmailHandler(rec, req, nil)
+	if rec.Code != 403 {
+		t.Errorf("bad token: status: got %d, want 403", rec.Code)
+	}
+
+	// POST mutes.
+	req = httptest.NewRequest("POST", "/mute", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	s.MuteFromEmailHandler(rec, req, nil)
+	if rec.Code != 200 {
+		t.Fatalf("POST: status: got %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if n := muted(t); n != 1 {
+		t.Errorf("POST: got %d muted albums, want 1", n)
+	}
+}
+
+func TestSongMuted(t *testing.T) {
+	ewf := Song{Artist: "Earth, Wind & Fire", Album: "Gratitude", Artists: []string{"Earth, Wind & Fire"}, ArtistsListed: true}
+	sg := Song{Artist: "Simon & Garfunkel", Album: "Bookends", Artists: []string{"Simon & Garfunkel"}, ArtistsListed: true}
+	voices := Song{Artist: "Max Richter, KiKi Layne & Robert Ziegler", Album: "Voices", Artists: []string{"Max Richter, KiKi Layne & Robert Ziegler"}}
+
+	tests := []struct {
+		song    Song
+		artists []string
+		albums  [][2]string
+		want    bool
+	}{
+		{ewf, []string{"Earth"}, nil, false},
+		{ewf, []string{"earth, wind & fire"}, nil, true},
+		{ewf, nil, [][2]string{{"Earth", "Gratitude"}}, false},
+		{ewf, nil, [][2]string{{"Earth, Wind & Fire", "Gratitude"}}, true},
+		{sg, []string{"Simon"}, nil, false},
+		{sg, []string{"Simon & Garfunkel"}, nil, true},
+		// Scrobble songs fall back to the primary artist of the credit.
+		{voices, []string{"Max Richter"}, nil, true},
+		{voices, nil, [][2]string{{"Max Richter", "Voices"}}, true},
+		{voices, []string{"KiKi Layne"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		artists := make(map[string]bool)
+		for _, a := range tt.artists {
+			artists[artistMuteKey(a)] = true
+		}
+		albums := make(map[string]bool)
+		for _, a := range tt.albums {
+			albums[albumMuteKey(a[0], a[1])] = true
+		}
+		if got := songMuted(tt.song, artists, albums); got != tt.want {
+			t.Errorf("songMuted(%q, artists %q, albums %q): got %v, want %v", tt.song.Artist, tt.artists, tt.albums, got, tt.want)
+		}
+	}
+}
+
+func TestFilterMutedEditions(t *testing.T) {
+	song := func(album string) Song {
+		return Song{Artist: "Fleetwood Mac", Album: album, Artists: []string{"Fleetwood Mac"}, ArtistsListed: true}
+	}
+	songs := []Song{
+		song("Rumours"),
+		song("Rumours (Super Deluxe)"),
+		song("Rumours - Remastered"),
+		song("Tusk"),
+	}
+
+	for _, muted := range []string{"Rumours", "Rumours (Super Deluxe)"} {
+		m := Mutes{Albums: []MutedAlbum{{Artist: "Fleetwood Mac", Album: muted}}}
+		got := m.filterMuted(songs)
+		if len(got) != 1 || got[0].Album != "Tusk" {
+			t.Errorf("muted %q: got %+v", muted, got)
+		}
+	}
+
+	// The editions have the same mute ID, so muting each is idempotent.
+	if a, b := muteID(albumMuteKey("Fleetwood Mac", "Rumours")), muteID(albumMuteKey("Fleetwood Mac", "Rumours (Deluxe)")); a != b {
+		t.Errorf("mute IDs differ: %s, %s", a, b)
+	}
+}
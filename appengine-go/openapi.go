@@ -0,0 +1,875 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The OpenAPI 3 document for the server, served at /api/v1/openapi.json.
+// https://spec.openapis.org/oas/v3.0.3
+//
+// Schemas are generated by reflection from the Go types used in the request
+// and response bodies, so they can't drift from the types. The list of
+// operations is checked against the registered routes at startup and in
+// tests (see validateAPIOperations), so that every route is documented.
+//
+// The generated document is checked in as openapi.json, and a test fails if
+// it differs, so that API changes show up in review. To regenerate it, run:
+//
+//	go test -run TestOpenAPIDocument -update
+
+type apiOperation struct {
+	Method    string
+	Path      string // in httprouter syntax
+	Summary   string
+	Security  []string // names of security schemes; any one suffices
+	Params    []apiParam
+	Body      *apiBody
+	Responses []apiResponse
+}
+
+type apiParam struct {
+	Name        string
+	In          string // "query" | "path" | "form"
+	Description string
+	Required    bool
+	Type        reflect.Type
+}
+
+type apiBody struct {
+	ContentType string
+	Type        reflect.Type
+}
+
+type apiResponse struct {
+	Code        int
+	Description string
+	ContentType string       // or "" for no body
+	Type        reflect.Type // or nil for binary content
+}
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeHTML = "text/html"
+	contentTypeText = "text/plain"
+	contentTypeForm = "application/x-www-form-urlencoded"
+	contentTypeJPEG = "image/jpeg"
+)
+
+// Security scheme names.
+const (
+	securityIdentityCookie = "identityCookie"
+	securityAPIToken       = "apiToken"
+	securityCron           = "appEngineCron"
+	securityTasksSecret    = "tasksSecret"
+	securityMetricsSecret  = "metricsSecret"
+)
+
+func typeOf(v interface{}) reflect.Type {
+	return reflect.TypeOf(v)
+}
+
+func jsonResponse(code int, description string, v interface{}) apiResponse {
+	return apiResponse{code, description, contentTypeJSON, typeOf(v)}
+}
+
+func emptyResponse(code int, description string) apiResponse {
+	return apiResponse{Code: code, Description: description}
+}
+
+func htmlResponse(code int, description string) apiResponse {
+	return apiResponse{code, description, contentTypeHTML, typeOf("")}
+}
+
+func textResponse(code int, description string) apiResponse {
+	return apiResponse{code, description, contentTypeText, typeOf("")}
+}
+
+func imageResponse(code int, description string) apiResponse {
+	return apiResponse{code, description, contentTypeJPEG, nil}
+}
+
+// errorResponse is an error response with the JSON envelope.
+func errorResponse(code int, description string) apiResponse {
+	return jsonResponse(code, description, APIErrorResponse{})
+}
+
+var (
+	errResponseBadRequest   = errorResponse(http.StatusBadRequest, "Bad request.")
+	errResponseUnauthorized = errorResponse(http.StatusUnauthorized, "Not logged in.")
+	errResponseInternal     = errorResponse(http.StatusInternalServerError, "Internal error.")
+)
+
+var apiOperations = []apiOperation{
+	{
+		Method:   "GET",
+		Path:     "/api/v1/account",
+		Summary:  "Get the account.",
+		Security: []string{securityIdentityCookie, securityAPIToken},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The account. Connection credentials are omitted.", AccountResponse{}),
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "No such account."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/api/v1/passphrase",
+		Summary: "Email a login code to the address.",
+		Params: []apiParam{
+			{"email", "form", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The login code was sent."),
+			errResponseBadRequest,
+			errResponseInternal,
+		},
+	},
+	{
+		Method:  "POST",
+		Path:    "/api/v1/login",
+		Summary: "Log in with a login code, creating the account if necessary. Cancels a pending account deletion.",
+		Params: []apiParam{
+			{"email", "form", "", true, typeOf("")},
+			{"passphrase", "form", "The login code.", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "Logged in; the identity cookie is set."),
+			errResponseBadRequest,
+			errorResponse(http.StatusForbidden, "Bad login code."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "DELETE",
+		Path:     "/api/v1/account",
+		Summary:  "Schedule deletion of the account, after a grace period.",
+		Security: []string{securityIdentityCookie},
+		Responses: []apiResponse{
+			textResponse(http.StatusOK, "Deletion was scheduled; the identity cookie is cleared."),
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "No such account."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "DELETE",
+		Path:     "/api/v1/account/connection",
+		Summary:  "Remove the account's music service connection.",
+		Security: []string{securityIdentityCookie},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The connection was removed."),
+			emptyResponse(http.StatusNoContent, "The account has no connection."),
+			errResponseUnauthorized,
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "GET",
+		Path:     "/api/v1/account/export",
+		Summary:  "Download the account's data.",
+		Security: []string{securityIdentityCookie},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The account's data, as an attachment.", AccountExport{}),
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "No such account."),
+			errorResponse(http.StatusTooManyRequests, "Exported too recently; see the Retry-After header."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "PATCH",
+		Path:     "/api/v1/account/settings",
+		Summary:  "Update some or all of the account's settings. Fields not in the body are unchanged.",
+		Security: []string{securityIdentityCookie},
+		Body:     &apiBody{contentTypeJSON, typeOf(AccountSettings{})},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The updated settings.", AccountSettings{}),
+			errResponseBadRequest,
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "No such account."),
+			errorResponse(http.StatusUnprocessableEntity, "Invalid or unknown fields; the details are a list of field errors."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "GET",
+		Path:     "/api/v1/birthdays",
+		Summary:  "Get the album birthdays on the days of the timestamps. If there are none, the result includes the next day with birthdays.",
+		Security: []string{securityIdentityCookie, securityAPIToken},
+		Params: []apiParam{
+			{"timestamp", "query", "Unix seconds; at most 10.", true, typeOf([]int64(nil))},
+			{"timeZone", "query", "IANA time zone name.", false, typeOf("")},
+			{"cache", "query", `"on" (default) or "off".`, false, typeOf("")},
+		},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "Birthday items, by timestamp, and the number of matching albums omitted by the account's settings.", BirthdayResponse{}),
+			errResponseBadRequest,
+			errResponseUnauthorized,
+			errorResponse(http.StatusPreconditionFailed, "No music service connected."),
+			errorResponse(http.StatusUnprocessableEntity, "The music service profile is private or doesn't exist."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "GET",
+		Path:     "/api/v1/tokens",
+		Summary:  "List personal API tokens.",
+		Security: []string{securityIdentityCookie},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The tokens, oldest first.", []APIToken{}),
+			errResponseUnauthorized,
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "POST",
+		Path:     "/api/v1/tokens",
+		Summary:  "Create a personal API token.",
+		Security: []string{securityIdentityCookie},
+		Params: []apiParam{
+			{"name", "form", "1 to 100 characters.", true, typeOf("")},
+			{"scope", "form", "", true, typeOf([]TokenScope(nil))},
+		},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusCreated, "The token. The secret is only returned here.", CreateAPITokenResponse{}),
+			errResponseBadRequest,
+			errResponseUnauthorized,
+			errorResponse(http.StatusConflict, "Too many tokens."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "DELETE",
+		Path:     "/api/v1/tokens/:id",
+		Summary:  "Revoke a personal API token.",
+		Security: []string{securityIdentityCookie},
+		Params: []apiParam{
+			{"id", "path", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The token was revoked."),
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "No such token."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "GET",
+		Path:     "/api/v1/mutes",
+		Summary:  "List muted artists and albums, which are excluded from birthdays and emails.",
+		Security: []string{securityIdentityCookie},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The mutes.", Mutes{}),
+			errResponseUnauthorized,
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "POST",
+		Path:     "/api/v1/mutes/artists",
+		Summary:  "Mute an artist. Names are matched ignoring case and whitespace.",
+		Security: []string{securityIdentityCookie},
+		Params: []apiParam{
+			{"artist", "form", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusCreated, "The muted artist.", MutedArtist{}),
+			errResponseBadRequest,
+			errResponseUnauthorized,
+			errorResponse(http.StatusConflict, "Too many muted artists."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "DELETE",
+		Path:     "/api/v1/mutes/artists/:id",
+		Summary:  "Unmute an artist.",
+		Security: []string{securityIdentityCookie},
+		Params: []apiParam{
+			{"id", "path", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The artist was unmuted."),
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "No such mute."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "POST",
+		Path:     "/api/v1/mutes/albums",
+		Summary:  "Mute an album. Names are matched ignoring case and whitespace.",
+		Security: []string{securityIdentityCookie},
+		Params: []apiParam{
+			{"artist", "form", "", true, typeOf("")},
+			{"album", "form", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			jsonResponse(http.StatusCreated, "The muted album.", MutedAlbum{}),
+			errResponseBadRequest,
+			errResponseUnauthorized,
+			errorResponse(http.StatusConflict, "Too many muted albums."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:   "DELETE",
+		Path:     "/api/v1/mutes/albums/:id",
+		Summary:  "Unmute an album.",
+		Security: []string{securityIdentityCookie},
+		Params: []apiParam{
+			{"id", "path", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The album was unmuted."),
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "No such mute."),
+			errResponseInternal,
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/api/v1/openapi.json",
+		Summary: "This document.",
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The OpenAPI document.", map[string]interface{}{}),
+		},
+	},
+
+	{
+		Method:   "GET",
+		Path:     "/internal/cron/daily-email",
+		Summary:  "Enqueue daily email tasks for all accounts.",
+		Security: []string{securityCron},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "Tasks were enqueued."),
+			emptyResponse(http.StatusUnauthorized, "Not a cron request."),
+			emptyResponse(http.StatusInternalServerError, "Internal error."),
+		},
+	},
+	{
+		Method:   "POST",
+		Path:     "/internal/task/daily-email",
+		Summary:  "Send the daily email for an account.",
+		Security: []string{securityTasksSecret},
+		Body:     &apiBody{contentTypeJSON, typeOf(DailyEmailTask{})},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The email was sent."),
+			emptyResponse(http.StatusCreated, "The email was sent."),
+			emptyResponse(http.StatusNoContent, "No email was sent, and the task should not be retried."),
+			emptyResponse(http.StatusUnauthorized, "Bad tasks secret."),
+			emptyResponse(http.StatusInternalServerError, "Internal error; the task should be retried."),
+		},
+	},
+	{
+		Method:   "POST",
+		Path:     "/internal/task/musicbrainz",
+		Summary:  "Look up the release dates of albums for an account.",
+		Security: []string{securityTasksSecret},
+		Body:     &apiBody{contentTypeJSON, typeOf(MusicBrainzTask{})},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The albums were looked up, or the time budget ran out and the rest were enqueued in another task."),
+			emptyResponse(http.StatusNoContent, "Bad payload; the task should not be retried."),
+			emptyResponse(http.StatusUnauthorized, "Bad tasks secret."),
+			emptyResponse(http.StatusServiceUnavailable, "MusicBrainz or Redis is unavailable; the task should be retried."),
+		},
+	},
+	{
+		Method:   "POST",
+		Path:     "/internal/task/artwork-color",
+		Summary:  "Compute the dominant colors of album artworks.",
+		Security: []string{securityTasksSecret},
+		Body:     &apiBody{contentTypeJSON, typeOf(ArtworkColorTask{})},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "The colors were computed, or the time budget ran out."),
+			emptyResponse(http.StatusNoContent, "Bad payload; the task should not be retried."),
+			emptyResponse(http.StatusUnauthorized, "Bad tasks secret."),
+			emptyResponse(http.StatusServiceUnavailable, "Redis is unavailable; the task should be retried."),
+		},
+	},
+	{
+		Method:   "GET",
+		Path:     "/internal/cron/purge-accounts",
+		Summary:  "Purge accounts whose deletion grace period has ended.",
+		Security: []string{securityCron},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "Accounts were purged."),
+			emptyResponse(http.StatusUnauthorized, "Not a cron request."),
+			emptyResponse(http.StatusInternalServerError, "Internal error."),
+		},
+	},
+	{
+		Method:   "GET",
+		Path:     "/metrics",
+		Summary:  "Metrics, in the Prometheus text format.",
+		Security: []string{securityMetricsSecret},
+		Responses: []apiResponse{
+			textResponse(http.StatusOK, "The metrics."),
+			emptyResponse(http.StatusUnauthorized, "Bad metrics secret."),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/healthz",
+		Summary: "Liveness check.",
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The server is up.", HealthResponse{}),
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/readyz",
+		Summary: "Readiness check.",
+		Responses: []apiResponse{
+			jsonResponse(http.StatusOK, "The server is ready.", HealthResponse{}),
+			jsonResponse(http.StatusServiceUnavailable, "A required dependency is unavailable.", HealthResponse{}),
+		},
+	},
+
+	{
+		Method:   "GET",
+		Path:     "/connect/spotify",
+		Summary:  "Start connecting Spotify. Redirects to Spotify's authorization page.",
+		Security: []string{securityIdentityCookie},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusFound, "Redirect to Spotify."),
+			errResponseUnauthorized,
+			errResponseInternal,
+		},
+	},
+	{
+		Method:  "GET",
+		Path:    "/auth/spotify",
+		Summary: "Spotify authorization callback. Redirects to the feed page, which reports success or failure.",
+		Params: []apiParam{
+			{"code", "query", "", false, typeOf("")},
+			{"state", "query", "", false, typeOf("")},
+			{"error", "query", "", false, typeOf("")},
+		},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusFound, "Redirect to the feed page."),
+		},
+	},
+	{
+		Method:   "POST",
+		Path:     "/connect/scrobble",
+		Summary:  "Connect a scrobble profile.",
+		Security: []string{securityIdentityCookie},
+		Params: []apiParam{
+			{"username", "form", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			emptyResponse(http.StatusOK, "Connected."),
+			errResponseBadRequest,
+			errResponseUnauthorized,
+			errorResponse(http.StatusNotFound, "The profile doesn't exist."),
+			errorResponse(http.StatusConflict, "The profile is private."),
+			errResponseInternal,
+		},
+	},
+
+	webPageOperation("/", "Landing page, or the feed if logged in."),
+	webPageOperation("/start", "Login page."),
+	webPageOperation("/feed", "Feed page."),
+	webPageOperation("/settings", "Settings page."),
+	{
+		Method:  "GET",
+		Path:    "/logout",
+		Summary: "Log out. Redirects to the landing page.",
+		Responses: []apiResponse{
+			emptyResponse(http.StatusFound, "Redirect to the landing page."),
+		},
+	},
+	tokenPageOperation("GET", "/unsub", "Unsubscribe from daily emails."),
+	tokenPageOperation("POST", "/unsub", "Unsubscribe from daily emails (RFC 8058 one-click)."),
+	confirmPageOperation("/undo-delete", "Confirmation page for undoing a pending account deletion."),
+	tokenPageOperation("POST", "/undo-delete", "Undo a pending account deletion."),
+	muteOperation("GET"),
+	muteOperation("POST"),
+	webPageOperation("/email-preview", "Preview of the daily email."),
+	{
+		Method:  "GET",
+		Path:    "/artwork",
+		Summary: "Album artwork, resized and re-encoded as JPEG. URLs are signed; see the artwork field of birthday items.",
+		Params: []apiParam{
+			{"url", "query", "URL of the original artwork.", true, typeOf("")},
+			{"size", "query", "Maximum width and height in pixels: 180 or 64.", true, typeOf(0)},
+			{"sig", "query", "Signature of the url and size.", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			imageResponse(http.StatusOK, "The artwork."),
+			textResponse(http.StatusBadRequest, "Missing or invalid parameters."),
+			textResponse(http.StatusForbidden, "Invalid signature."),
+			textResponse(http.StatusBadGateway, "Fetching or decoding the original artwork failed."),
+		},
+	},
+	webPageOperation("/terms", "Terms page."),
+}
+
+func webPageOperation(path, summary string) apiOperation {
+	return apiOperation{
+		Method:  "GET",
+		Path:    path,
+		Summary: summary,
+		Responses: []apiResponse{
+			htmlResponse(http.StatusOK, "The page."),
+		},
+	}
+}
+
+// tokenPageOperation is for web pages authenticated by a token in an email
+// link.
+func tokenPageOperation(method, path, summary string) apiOperation {
+	return apiOperation{
+		Method:  method,
+		Path:    path,
+		Summary: summary,
+		Params: []apiParam{
+			{"email", "query", "", true, typeOf("")},
+			{"token", "query", "", true, typeOf("")},
+		},
+		Responses: []apiResponse{
+			textResponse(http.StatusOK, "Done."),
+			textResponse(http.StatusBadRequest, "Missing parameter."),
+			textResponse(http.StatusForbidden, "Bad token."),
+			textResponse(http.StatusNotFound, "No such account."),
+			textResponse(http.StatusInternalServerError, "Internal error."),
+		},
+	}
+}
+
+// confirmPageOperation is for the GET of an email link whose POST changes
+// the account. It renders a form that POSTs the parameters.
+func confirmPageOperation(path, summary string) apiOperation {
+	op := tokenPageOperation("GET", path, summary)
+	op.Responses[0] = htmlResponse(http.StatusOK, "A form that POSTs the parameters.")
+	return op
+}
+
+// muteOperation is for the "mute this album" link in emails. The GET
+// renders a confirmation page that POSTs the parameters.
+func muteOperation(method string) apiOperation {
+	var op apiOperation
+	if method == "GET" {
+		op = confirmPageOperation("/mute", "Confirmation page for muting an album.")
+	} else {
+		op = tokenPageOperation(method, "/mute", "Mute an album.")
+		op.Responses = append(op.Responses, textResponse(http.StatusConflict, "Too many muted albums."))
+	}
+	op.Params = append(op.Params,
+		apiParam{"artist", "query", "", true, typeOf("")},
+		apiParam{"album", "query", "", true, typeOf("")},
+	)
+	return op
+}
+
+// enumValues are the allowed values for named string types, by type.
+var enumValues = map[reflect.Type][]string{
+	typeOf(Service("")):             servicesStrings(),
+	typeOf(ReleaseMatch("")):        {string(MatchNone), string(MatchDay), string(MatchLeapDay), string(MatchMonth), string(MatchMonthAnyDay), string(MatchMonthWeekly), string(MatchYear)},
+	typeOf(LeapDayRule("")):         {string(LeapDayNone), string(LeapDayFeb28), string(LeapDayMar1)},
+	typeOf(MonthRule("")):           {string(MonthFirstDay), string(MonthAnyDay), string(MonthWeekly)},
+	typeOf(DatePrecision("")):       {string(PrecisionDay), string(PrecisionMonth), string(PrecisionYear)},
+	typeOf(SortMode("")):            {string(SortMostPlayed), string(SortOldestFirst), string(SortNewestFirst)},
+	typeOf(TokenScope("")):          {string(ScopeAccountRead), string(ScopeBirthdaysRead)},
+	typeOf(ConnectionErrReason("")): {string(ConnectionErrGeneric), string(ConnectionErrPermission), string(ConnectionErrNotFound)},
+	typeOf(APIErrorCode("")): {
+		string(ErrCodeBadRequest), string(ErrCodeUnauthorized), string(ErrCodeBadPassphrase),
+		string(ErrCodeInvalidFields), string(ErrCodeForbidden), string(ErrCodeNotFound), string(ErrCodeTooManyTokens), string(ErrCodeTooManyMutes),
+		string(ErrCodeRateLimited), string(ErrCodeInternal), string(ErrCodeConnectionRequired),
+		string(ErrCodeConnectionPermission), string(ErrCodeConnectionNotFound), string(ErrCodeConnectionGeneric),
+	},
+}
+
+func servicesStrings() []string {
+	var ret []string
+	for _, s := range AllServices {
+		ret = append(ret, string(s))
+	}
+	return ret
+}
+
+// schemaGenerator generates JSON schemas for Go types, following the rules
+// of encoding/json. Named struct types are added to the components and
+// referenced.
+type schemaGenerator struct {
+	components map[string]interface{}
+}
+
+type jsonSchema = map[string]interface{}
+
+func (g *schemaGenerator) schema(t reflect.Type) jsonSchema {
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if _, ok := s["$ref"]; ok {
+			return jsonSchema{"allOf": []interface{}{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := t.Name()
+		if _, ok := g.components[name]; !ok {
+			g.components[name] = nil // placeholder for recursive types
+			g.components[name] = g.structSchema(t)
+		}
+		return jsonSchema{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return jsonSchema{"type": "string", "format": "byte"}
+		}
+		s := jsonSchema{"type": "array", "items": g.schema(t.Elem())}
+		if t.Kind() == reflect.Slice {
+			s["nullable"] = true
+		}
+		return s
+	case reflect.Map:
+		return jsonSchema{"type": "object", "additionalProperties": g.schema(t.Elem()), "nullable": true}
+	case reflect.Interface:
+		return jsonSchema{}
+	case reflect.String:
+		s := jsonSchema{"type": "string"}
+		if values, ok := enumValues[t]; ok {
+			s["enum"] = values
+		}
+		return s
+	case reflect.Bool:
+		return jsonSchema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return jsonSchema{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return jsonSchema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return jsonSchema{"type": "number"}
+	default:
+		panic(fmt.Sprintf("no schema for type %s", t))
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) jsonSchema {
+	properties := make(map[string]interface{})
+	var required []string
+	g.addFields(t, properties, &required)
+	sort.Strings(required)
+
+	s := jsonSchema{"type": "object", "properties": properties}
+	if len(required) != 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx != -1 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				g.addFields(ft, properties, required) // promoted fields
+				continue
+			}
+		}
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// openAPIPath converts an httprouter path to an OpenAPI path.
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") || strings.HasPrefix(p, "*") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func buildOpenAPI(ops []apiOperation) map[string]interface{} {
+	g := &schemaGenerator{components: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+
+	for _, op := range ops {
+		o := map[string]interface{}{
+			"summary":     op.Summary,
+			"operationId": op.Method + " " + op.Path,
+		}
+
+		var security []interface{}
+		for _, name := range op.Security {
+			security = append(security, map[string]interface{}{name: []string{}})
+		}
+		if len(security) != 0 {
+			o["security"] = security
+		}
+
+		var params []interface{}
+		formProperties := make(map[string]interface{})
+		var formRequired []string
+		for _, p := range op.Params {
+			s := g.schema(p.Type)
+			if p.Description != "" {
+				s["description"] = p.Description
+			}
+			if p.In == "form" {
+				formProperties[p.Name] = s
+				if p.Required {
+					formRequired = append(formRequired, p.Name)
+				}
+				continue
+			}
+			params = append(params, map[string]interface{}{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required,
+				"schema":   s,
+			})
+		}
+		if len(params) != 0 {
+			o["parameters"] = params
+		}
+
+		if len(formProperties) != 0 {
+			s := jsonSchema{"type": "object", "properties": formProperties}
+			if len(formRequired) != 0 {
+				s["required"] = formRequired
+			}
+			o["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{contentTypeForm: map[string]interface{}{"schema": s}},
+			}
+		} else if op.Body != nil {
+			o["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{op.Body.ContentType: map[string]interface{}{"schema": g.schema(op.Body.Type)}},
+			}
+		}
+
+		responses := make(map[string]interface{})
+		for _, rsp := range op.Responses {
+			r := map[string]interface{}{"description": rsp.Description}
+			if rsp.ContentType != "" {
+				s := jsonSchema{"type": "string", "format": "binary"}
+				if rsp.Type != nil {
+					s = g.schema(rsp.Type)
+				}
+				r["content"] = map[string]interface{}{rsp.ContentType: map[string]interface{}{"schema": s}}
+			}
+			responses[strconv.Itoa(rsp.Code)] = r
+		}
+		o["responses"] = responses
+
+		p := openAPIPath(op.Path)
+		if paths[p] == nil {
+			paths[p] = make(map[string]interface{})
+		}
+		paths[p][strings.ToLower(op.Method)] = o
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   AppName,
+			"version": "1",
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": "https://" + AppHost},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.components,
+			"securitySchemes": map[string]interface{}{
+				securityIdentityCookie: map[string]interface{}{
+					"type": "apiKey",
+					"in":   "cookie",
+					"name": cookieNameIdentity,
+				},
+				securityAPIToken: map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "Personal API token, with the scope required by the operation.",
+				},
+				securityCron: map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": "X-Appengine-Cron",
+				},
+				securityTasksSecret: map[string]interface{}{
+					"type": "apiKey",
+					"in":   "header",
+					"name": headerTasksSecret,
+				},
+				securityMetricsSecret: map[string]interface{}{
+					"type":   "http",
+					"scheme": "bearer",
+				},
+			},
+		},
+	}
+}
+
+// validateAPIOperations checks that the operations match the registered
+// routes exactly.
+func validateAPIOperations(ops []apiOperation, routes []string) error {
+	documented := make(map[string]bool)
+	for _, op := range ops {
+		k := op.Method + " " + op.Path
+		if documented[k] {
+			return fmt.Errorf("duplicate operation %s", k)
+		}
+		documented[k] = true
+	}
+
+	registered := make(map[string]bool)
+	for _, r := range routes {
+		registered[r] = true
+		if !documented[r] {
+			return fmt.Errorf("route %s is not documented", r)
+		}
+	}
+	for k := range documented {
+		if !registered[k] {
+			return fmt.Errorf("documented operation %s is not a registered route", k)
+		}
+	}
+	return nil
+}
+
+var openAPIDocument = mustMarshalJSON(buildOpenAPI(apiOperations))
+
+func (s *Server) OpenAPIHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update openapi.json")
+
+const openAPIFile = "openapi.json"
+
+func TestOpenAPIRoutes(t *testing.T) {
+	s, _ := newTestServer(t)
+	router := newRouter()
+	s.registerRoutes(router)
+	if err := validateAPIOperations(apiOperations, router.Routes()); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestOpenAPIDocument checks that the generated document matches the
+// checked-in openapi.json.
+func TestOpenAPIDocument(t *testing.T) {
+	got, err := json.MarshalIndent(buildOpenAPI(apiOperations), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	if *update {
+		if err := ioutil.WriteFile(openAPIFile, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(openAPIFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("generated document differs from %s; if the change is intended, run: go test -run TestOpenAPIDocument -update", openAPIFile)
+	}
+}
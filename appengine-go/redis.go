@@ -2,6 +2,8 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
+	"reflect"
 
 	"github.com/go-redis/redis"
 )
@@ -15,13 +17,41 @@ func newRedis(addr string, cfg *tls.Config) *redis.Client {
 	})
 }
 
+// updateEntityAttempts is the number of times UpdateEntity tries to apply
+// an update before giving up due to concurrent modifications.
+const updateEntityAttempts = 10
+
+// UpdateEntity atomically applies update to the JSON entity stored at key.
+// vType must be a pointer to a value of the entity's type; update receives
+// it after it is populated, and returns the value to store. update may be
+// called more than once if the key is concurrently modified, so it should
+// not have side effects other than on its argument and on variables it
+// overwrites on each call. Returns redis.Nil if the key does not exist.
 func UpdateEntity(c *redis.Client, key string, vType interface{}, update func(v interface{}) interface{}) error {
-	// TODO: needs transaction
-	b, err := c.Get(key).Bytes()
-	if err != nil {
+	zero := reflect.Zero(reflect.TypeOf(vType).Elem())
+
+	txf := func(tx *redis.Tx) error {
+		b, err := tx.Get(key).Bytes()
+		if err != nil {
+			return err
+		}
+		reflect.ValueOf(vType).Elem().Set(zero) // clear any previous attempt
+		mustUnmarshalJSON(b, vType)
+		updated := mustMarshalJSON(update(vType))
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, updated, 0)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < updateEntityAttempts; i++ {
+		err := c.Watch(txf, key)
+		if err == redis.TxFailedErr {
+			continue // concurrently modified; retry
+		}
 		return err
 	}
-	mustUnmarshalJSON(b, vType)
-	updated := mustMarshalJSON(update(vType))
-	return c.Set(key, updated, 0).Err()
+	return fmt.Errorf("update %s: too many concurrent modifications", key)
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Reissues, such as remasters and deluxe editions, carry the reissue's
+// release date rather than the original's. Their album titles usually
+// mark the edition in a suffix, e.g. "Rumours (Super Deluxe)" or
+// "Abbey Road - Remastered 2019". Editions of the same base album use the
+// earliest known release date, and keep their own title for display.
+
+// A ReissueRule recognizes a reissue marker in an album title suffix.
+type ReissueRule struct {
+	Name    string
+	Pattern *regexp.Regexp // matched against the suffix, without brackets or dash
+}
+
+// defaultReissueRules are the rules for recognizing reissues, unless the
+// config has rules.
+var defaultReissueRules = []ReissueRule{
+	{"remaster", regexp.MustCompile(`(?i)\bre-?master(ed)?\b`)},
+	{"deluxe", regexp.MustCompile(`(?i)\bdeluxe\b`)},
+	{"anniversary", regexp.MustCompile(`(?i)\banniversary\b`)},
+	{"expanded", regexp.MustCompile(`(?i)\bexpanded\b`)},
+	{"reissue", regexp.MustCompile(`(?i)\bre-?issue(d)?\b`)},
+	{"legacy", regexp.MustCompile(`(?i)\blegacy edition\b`)},
+	{"special", regexp.MustCompile(`(?i)\b(special|collector'?s|definitive|bonus tracks?) (edition|version)\b`)},
+}
+
+// reissueRules are the rules for recognizing reissues. A title suffix that
+// matches any rule is stripped to obtain the base album title. They are set
+// from the config at startup, before serving.
+var reissueRules = defaultReissueRules
+
+// parseReissueRules parses rules from JSON of the form
+//
+//	[{"name": "remaster", "pattern": "(?i)\\bre-?master(ed)?\\b"}, ...]
+//
+// where each pattern is a regular expression in Go's syntax.
+func parseReissueRules(s string) ([]ReissueRule, error) {
+	var raw []struct {
+		Name    string `json:"name"`
+		Pattern string `json:"pattern"`
+	}
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("json-unmarshal reissue rules: %s", err)
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("no reissue rules")
+	}
+	rules := make([]ReissueRule, len(raw))
+	for i, r := range raw {
+		if r.Name == "" {
+			return nil, fmt.Errorf("reissue rule %d: missing name", i)
+		}
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("reissue rule %s: %s", r.Name, err)
+		}
+		if re.MatchString("") {
+			return nil, fmt.Errorf("reissue rule %s: pattern matches the empty string", r.Name)
+		}
+		rules[i] = ReissueRule{r.Name, re}
+	}
+	return rules, nil
+}
+
+// titleSuffixRegexp matches a bracketed or dash-separated suffix of an
+// album title.
+var titleSuffixRegexp = regexp.MustCompile(`^(.+?)\s*(?:\(([^()]*)\)|\[([^\[\]]*)\]|\s-\s([^-]*))$`)
+
+// reissueRule returns the rule that recognizes the suffix as a reissue
+// marker, or nil.
+func reissueRule(suffix string) *ReissueRule {
+	for i := range reissueRules {
+		if reissueRules[i].Pattern.MatchString(suffix) {
+			return &reissueRules[i]
+		}
+	}
+	return nil
+}
+
+// baseAlbumTitle returns the album title without reissue markers, and
+// whether any were removed. For example, "Rumours (Super Deluxe)" is
+// "Rumours".
+func baseAlbumTitle(album string) (string, bool) {
+	base := strings.TrimSpace(album)
+	stripped := false
+	for {
+		m := titleSuffixRegexp.FindStringSubmatch(base)
+		if m == nil {
+			break
+		}
+		suffix := m[2] + m[3] + m[4] // only one is non-empty
+		if reissueRule(suffix) == nil {
+			break
+		}
+		base = strings.TrimSpace(m[1])
+		stripped = true
+	}
+	return base, stripped
+}
+
+// isReissue reports whether the album title marks a reissue.
+func isReissue(album string) bool {
+	_, ok := baseAlbumTitle(album)
+	return ok
+}
+
+// earlierRelease returns the release date that is more likely the
+// original of the two: the one in the earlier year, or in the same year,
+// the more precise or else the earlier one.
+func earlierRelease(a, b ReleaseDate) ReleaseDate {
+	if a.Year != b.Year {
+		if a.Year < b.Year {
+			return a
+		}
+		return b
+	}
+	if pa, pb := precisionRank(a.precision()), precisionRank(b.precision()); pa != pb {
+		if pa > pb {
+			return a
+		}
+		return b
+	}
+	if compareReleaseDates(a, b) <= 0 {
+		return a
+	}
+	return b
+}
+
+func precisionRank(p DatePrecision) int {
+	switch p {
+	case PrecisionDay:
+		return 2
+	case PrecisionMonth:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// editionGroupKey returns the key by which editions of the same base
+// album are grouped.
+func editionGroupKey(s Song) string {
+	base, _ := baseAlbumTitle(s.Album)
+	return normalizeName(s.albumArtist()) + "\x00" + normalizeName(base)
+}
+
+// preferOriginalReleases sets the release date of the songs in each group
+// of editions of a base album to the earliest release date in the group.
+// Compilations are not grouped.
+func preferOriginalReleases(songs []Song) []Song {
+	earliest := make(map[string]ReleaseDate)
+	hasReissue := make(map[string]bool)
+	for _, s := range songs {
+		if s.Compilation {
+			continue
+		}
+		k := editionGroupKey(s)
+		if r, ok := earliest[k]; ok {
+			earliest[k] = earlierRelease(r, s.Release)
+		} else {
+			earliest[k] = s.Release
+		}
+		if isReissue(s.Album) {
+			hasReissue[k] = true
+		}
+	}
+
+	for i := range songs {
+		if songs[i].Compilation {
+			continue
+		}
+		k := editionGroupKey(songs[i])
+		if hasReissue[k] {
+			songs[i].Release = earliest[k]
+		}
+	}
+	return songs
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBaseAlbumTitle(t *testing.T) {
+	tests := []struct {
+		album    string
+		base     string
+		stripped bool
+	}{
+		{"Rumours", "Rumours", false},
+		{"Rumours (Super Deluxe)", "Rumours", true},
+		{"Abbey Road - Remastered 2019", "Abbey Road", true},
+		{"Abbey Road (Remastered)", "Abbey Road", true},
+		{"Abbey Road (Re-master)", "Abbey Road", true},
+		{"Nevermind (20th Anniversary Edition)", "Nevermind", true},
+		{"Blue [Expanded Edition]", "Blue", true},
+		{"Pet Sounds (Reissue)", "Pet Sounds", true},
+		{"Songs in the Key of Life (Legacy Edition)", "Songs in the Key of Life", true},
+		{"Thriller (Special Edition)", "Thriller", true},
+		{"Led Zeppelin IV (Collector's Edition)", "Led Zeppelin IV", true},
+		{"Purple Rain (Bonus Tracks Version)", "Purple Rain", true},
+		{"Rumours (Deluxe) [Remastered]", "Rumours", true},
+		{"  Rumours (Deluxe)  ", "Rumours", true},
+
+		// Suffixes that aren't reissue markers are kept.
+		{"Live at Leeds (Live)", "Live at Leeds (Live)", false},
+		{"Help! (Original Motion Picture Soundtrack)", "Help! (Original Motion Picture Soundtrack)", false},
+		{"Sgt. Pepper's Lonely Hearts Club Band - Take 9", "Sgt. Pepper's Lonely Hearts Club Band - Take 9", false},
+		{"Remastered", "Remastered", false},
+		{"Deluxe", "Deluxe", false},
+		{"Masterpiece (Live)", "Masterpiece (Live)", false},
+		{"Re-Mastering the Classics", "Re-Mastering the Classics", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		base, stripped := baseAlbumTitle(tt.album)
+		if base != tt.base || stripped != tt.stripped {
+			t.Errorf("baseAlbumTitle(%q): got %q, %v; want %q, %v", tt.album, base, stripped, tt.base, tt.stripped)
+		}
+	}
+}
+
+func TestEarlierRelease(t *testing.T) {
+	day := func(y, m, d int) ReleaseDate {
+		return ReleaseDate{Year: y, Month: time.Month(m), Day: d, Precision: PrecisionDay}
+	}
+	month := func(y, m int) ReleaseDate {
+		return ReleaseDate{Year: y, Month: time.Month(m), Precision: PrecisionMonth}
+	}
+	year := func(y int) ReleaseDate {
+		return ReleaseDate{Year: y, Precision: PrecisionYear}
+	}
+
+	tests := []struct {
+		a, b, want ReleaseDate
+	}{
+		{day(1977, 2, 4), day(2013, 1, 29), day(1977, 2, 4)},
+		{day(2013, 1, 29), day(1977, 2, 4), day(1977, 2, 4)},
+		{year(1977), day(2013, 1, 29), year(1977)},
+		// in the same year, the more precise date
+		{year(1977), day(1977, 2, 4), day(1977, 2, 4)},
+		{month(1977, 2), year(1977), month(1977, 2)},
+		{month(1977, 12), day(1977, 2, 4), day(1977, 2, 4)},
+		// else the earlier date
+		{day(1977, 3, 1), day(1977, 2, 4), day(1977, 2, 4)},
+		{month(1977, 3), month(1977, 2), month(1977, 2)},
+		{day(1977, 2, 4), day(1977, 2, 4), day(1977, 2, 4)},
+	}
+	for _, tt := range tests {
+		if got := earlierRelease(tt.a, tt.b); got != tt.want {
+			t.Errorf("earlierRelease(%+v, %+v): got %+v, want %+v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestPreferOriginalReleases(t *testing.T) {
+	original := ReleaseDate{Year: 1977, Month: 2, Day: 4, Precision: PrecisionDay}
+	deluxe := ReleaseDate{Year: 2013, Month: 1, Day: 29, Precision: PrecisionDay}
+	remaster := ReleaseDate{Year: 2004, Precision: PrecisionYear}
+	other := ReleaseDate{Year: 1979, Month: 10, Day: 12, Precision: PrecisionDay}
+
+	song := func(artist, album string, rel ReleaseDate) Song {
+		return Song{Artist: artist, Album: album, Release: rel}
+	}
+
+	tests := []struct {
+		name  string
+		songs []Song
+		want  []ReleaseDate
+	}{
+		{
+			"reissues get the original's date",
+			[]Song{
+				song("Fleetwood Mac", "Rumours (Super Deluxe)", deluxe),
+				song("Fleetwood Mac", "Rumours", original),
+				song("Fleetwood Mac", "Rumours - Remastered", remaster),
+			},
+			[]ReleaseDate{original, original, original},
+		},
+		{
+			"reissue without the original keeps its date",
+			[]Song{song("Fleetwood Mac", "Rumours (Super Deluxe)", deluxe)},
+			[]ReleaseDate{deluxe},
+		},
+		{
+			// Two albums with the same title and no reissue marker may be
+			// different albums.
+			"no reissue",
+			[]Song{
+				song("Fleetwood Mac", "Tusk", other),
+				song("Fleetwood Mac", "Tusk", original),
+			},
+			[]ReleaseDate{other, original},
+		},
+		{
+			"different artists",
+			[]Song{
+				song("Fleetwood Mac", "Rumours (Deluxe)", deluxe),
+				song("Someone Else", "Rumours", original),
+			},
+			[]ReleaseDate{deluxe, original},
+		},
+		{
+			"compilations are not grouped",
+			[]Song{
+				{Artist: "Various Artists", Album: "Hits (Remastered)", Release: deluxe, Compilation: true},
+				{Artist: "Various Artists", Album: "Hits", Release: original, Compilation: true},
+			},
+			[]ReleaseDate{deluxe, original},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := preferOriginalReleases(tt.songs)
+			for i := range got {
+				if got[i].Release != tt.want[i] {
+					t.Errorf("song %d (%s): got %+v, want %+v", i, got[i].Album, got[i].Release, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseReissueRules(t *testing.T) {
+	rules, err := parseReissueRules(`[{"name": "remaster", "pattern": "(?i)\\bremaster(ed)?\\b"}, {"name": "tour", "pattern": "(?i)\\btour edition\\b"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(r []ReissueRule) { reissueRules = r }(reissueRules)
+	reissueRules = rules
+
+	for album, want := range map[string]string{
+		"Abbey Road (Remastered)":    "Abbey Road",
+		"Midnights (Tour Edition)":   "Midnights",
+		"Rumours (Super Deluxe)":     "Rumours (Super Deluxe)", // not in the rules
+		"Midnights (Tour)":           "Midnights (Tour)",
+		"Midnights - Tour Edition 2": "Midnights",
+	} {
+		if got, _ := baseAlbumTitle(album); got != want {
+			t.Errorf("baseAlbumTitle(%q): got %q, want %q", album, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		``,
+		`[]`,
+		`{}`,
+		`[{"name": "", "pattern": "x"}]`,
+		`[{"name": "bad", "pattern": "("}]`,
+		`[{"name": "empty", "pattern": ".*"}]`,
+	} {
+		if _, err := parseReissueRules(bad); err == nil {
+			t.Errorf("parseReissueRules(%q): no error", bad)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scrobble provides release dates as unix timestamps, which are the
+// release's calendar date at midnight, or sometimes noon, in the time zone
+// of the region the release was published for. The calendar date is
+// inferred by finding the UTC offsets at which the timestamp is midnight
+// or noon. When the candidates disagree, the storefront's time zones, and
+// then the regions most releases are published for, break the tie.
+
+// utcOffsets are the UTC offsets, in minutes, in use by IANA time zones
+// since 1970, including daylight saving time offsets, in increasing order.
+// They are computed from the zone data at startup; see loadReleaseDateZones.
+var utcOffsets = fallbackUTCOffsets
+
+// fallbackUTCOffsets are the UTC offsets computed from the zone data as of
+// 2026, for when the zone data can't be listed, such as when it's embedded
+// in the binary (time/tzdata) rather than installed.
+var fallbackUTCOffsets = []int{
+	-720, -660, -630, -600, -570, -540, -510, -480, -420, -360, -300, -270,
+	-240, -225, -210, -180, -150, -120, -90, -60, 0, 60, 120, 180, 210,
+	240, 270, 300, 330, 345, 360, 390, 420, 450, 480, 510, 525, 540, 570,
+	585, 600, 630, 660, 690, 720, 750, 765, 780, 825, 840,
+}
+
+// zoneSources are the directories that may have the system's zone data.
+// They are the same as the time package's.
+var zoneSources = []string{
+	"/usr/share/zoneinfo/",
+	"/usr/share/lib/zoneinfo/",
+	"/usr/lib/locale/TZ/",
+}
+
+// goZoneinfoZip is the zone data in the Go installation, if any.
+var goZoneinfoZip = filepath.Join(runtime.GOROOT(), "lib", "time", "zoneinfo.zip")
+
+// zoneNames returns the names of the time zones with distinct histories
+// since 1970. Like the time package, it first uses $ZONEINFO, which is a
+// zip file or directory of zone data, then the system's zone data, and
+// then the Go installation's zoneinfo.zip. In a directory, it reads
+// zone1970.tab; in a zip file, it lists all zones.
+// https://data.iana.org/time-zones/tz-link.html
+func zoneNames() ([]string, error) {
+	dirs := zoneSources
+	if z := os.Getenv("ZONEINFO"); z != "" {
+		if strings.HasSuffix(z, ".zip") {
+			return zipZoneNames(z)
+		}
+		dirs = append([]string{z}, dirs...)
+	}
+
+	for _, dir := range dirs {
+		f, err := os.Open(filepath.Join(dir, "zone1970.tab"))
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+
+		var names []string
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := sc.Text()
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			// codes, coordinates, TZ, comments
+			fields := strings.Split(line, "\t")
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("bad line in %s: %q", f.Name(), line)
+			}
+			names = append(names, fields[2])
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("read %s: %s", f.Name(), err)
+		}
+		return names, nil
+	}
+
+	return zipZoneNames(goZoneinfoZip)
+}
+
+func zipZoneNames(path string) ([]string, error) {
+	z, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("no zone data: %s", err)
+	}
+	defer z.Close()
+	var names []string
+	for _, f := range z.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			names = append(names, f.Name)
+		}
+	}
+	return names, nil
+}
+
+// zoneOffsetSample is the interval at which zones' offsets are sampled.
+// Offsets, such as daylight saving time, are in effect for longer.
+const zoneOffsetSample = 7 * 24 * time.Hour
+
+// zoneOffsets returns the UTC offsets, in minutes, in use by the zones
+// between the times, in increasing order. Offsets that aren't a multiple
+// of 15 minutes, such as Liberia's -0:44:30 until 1972, are omitted, as
+// releases aren't published at such offsets.
+func zoneOffsets(names []string, from, to time.Time) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, name := range names {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return nil, err
+		}
+		for t := from; t.Before(to); t = t.Add(zoneOffsetSample) {
+			_, off := t.In(loc).Zone()
+			if off%(15*60) == 0 {
+				seen[off/60] = true
+			}
+		}
+	}
+	offsets := make([]int, 0, len(seen))
+	for off := range seen {
+		offsets = append(offsets, off)
+	}
+	sort.Ints(offsets)
+	return offsets, nil
+}
+
+// storefrontTimeZones are the time zones of Apple Music storefronts, by
+// storefront code. Storefronts not in the map provide no hint.
+var storefrontTimeZones = map[string][]string{
+	"us": {"America/New_York", "America/Chicago", "America/Denver", "America/Phoenix", "America/Los_Angeles", "America/Anchorage", "Pacific/Honolulu"},
+	"ca": {"America/St_Johns", "America/Halifax", "America/Toronto", "America/Winnipeg", "America/Edmonton", "America/Vancouver"},
+	"mx": {"America/Mexico_City", "America/Tijuana"},
+	"br": {"America/Sao_Paulo", "America/Manaus"},
+	"ar": {"America/Argentina/Buenos_Aires"},
+	"gb": {"Europe/London"},
+	"ie": {"Europe/Dublin"},
+	"pt": {"Europe/Lisbon"},
+	"fr": {"Europe/Paris"},
+	"de": {"Europe/Berlin"},
+	"es": {"Europe/Madrid"},
+	"it": {"Europe/Rome"},
+	"nl": {"Europe/Amsterdam"},
+	"be": {"Europe/Brussels"},
+	"ch": {"Europe/Zurich"},
+	"at": {"Europe/Vienna"},
+	"se": {"Europe/Stockholm"},
+	"no": {"Europe/Oslo"},
+	"dk": {"Europe/Copenhagen"},
+	"fi": {"Europe/Helsinki"},
+	"pl": {"Europe/Warsaw"},
+	"ru": {"Europe/Moscow"},
+	"tr": {"Europe/Istanbul"},
+	"za": {"Africa/Johannesburg"},
+	"in": {"Asia/Kolkata"},
+	"sg": {"Asia/Singapore"},
+	"hk": {"Asia/Hong_Kong"},
+	"tw": {"Asia/Taipei"},
+	"cn": {"Asia/Shanghai"},
+	"kr": {"Asia/Seoul"},
+	"jp": {"Asia/Tokyo"},
+	"au": {"Australia/Perth", "Australia/Darwin", "Australia/Adelaide", "Australia/Brisbane", "Australia/Sydney"},
+	"nz": {"Pacific/Auckland"},
+}
+
+// defaultTimeZones are the time zones whose dates are preferred when
+// there is no storefront hint, in order of preference. Most releases in
+// libraries are published for these regions.
+var defaultTimeZones = []string{
+	"America/Chicago",
+	"America/Denver",
+	"America/Los_Angeles",
+	"America/New_York",
+	"America/Phoenix",
+	"Europe/London",
+	"Europe/Berlin",
+	"Asia/Kolkata",
+	"Asia/Tokyo",
+	"Etc/GMT",
+}
+
+// storefrontLocations and defaultLocations are loaded from the names
+// above by loadReleaseDateZones.
+var (
+	storefrontLocations = make(map[string][]*time.Location)
+	defaultLocations    []*time.Location
+)
+
+// loadReleaseDateZones computes utcOffsets and loads the locations above.
+// If the zone data can't be listed, utcOffsets is fallbackUTCOffsets.
+// It returns an error if a location can't be loaded.
+func loadReleaseDateZones() error {
+	offsets, err := systemUTCOffsets()
+	if err != nil {
+		rootLogger.Warningf("compute UTC offsets: %s; using the built-in offsets", err)
+		offsets = fallbackUTCOffsets
+	}
+	utcOffsets = offsets
+
+	storefronts := make(map[string][]*time.Location)
+	for sf, names := range storefrontTimeZones {
+		for _, name := range names {
+			loc, err := time.LoadLocation(name)
+			if err != nil {
+				return fmt.Errorf("load storefront time zone: %s", err)
+			}
+			storefronts[sf] = append(storefronts[sf], loc)
+		}
+	}
+	var defaults []*time.Location
+	for _, name := range defaultTimeZones {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return fmt.Errorf("load default time zone: %s", err)
+		}
+		defaults = append(defaults, loc)
+	}
+	storefrontLocations, defaultLocations = storefronts, defaults
+	return nil
+}
+
+// systemUTCOffsets returns the UTC offsets in use since 1970, and for the
+// next years, by the zones in the zone data.
+func systemUTCOffsets() ([]int, error) {
+	names, err := zoneNames()
+	if err != nil {
+		return nil, err
+	}
+	return zoneOffsets(names,
+		time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(time.Now().Year()+2, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// appleStorefront returns the storefront code in an Apple Music or iTunes
+// URL, e.g. "gb" for "https://music.apple.com/gb/album/...", or "".
+func appleStorefront(link string) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return ""
+	}
+	seg := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	if len(seg) != 2 {
+		return ""
+	}
+	return strings.ToLower(seg)
+}
+
+// releaseCandidate is a calendar date at which a timestamp is midnight or
+// noon at a UTC offset.
+type releaseCandidate struct {
+	date     FullDate
+	offset   int // minutes
+	midnight bool
+}
+
+func releaseCandidates(t time.Time) []releaseCandidate {
+	var ret []releaseCandidate
+	for _, off := range utcOffsets {
+		lt := t.In(time.FixedZone("", off*60))
+		if lt.Minute() != 0 || lt.Second() != 0 || (lt.Hour() != 0 && lt.Hour() != 12) {
+			continue
+		}
+		ret = append(ret, releaseCandidate{
+			date:     FullDate{Year: lt.Year(), Month: lt.Month(), Day: lt.Day()},
+			offset:   off,
+			midnight: lt.Hour() == 0,
+		})
+	}
+	return ret
+}
+
+// offsetIn returns the UTC offset, in minutes, of loc at t.
+func offsetIn(t time.Time, loc *time.Location) int {
+	_, off := t.In(loc).Zone()
+	return off / 60
+}
+
+// pickCandidate returns the first candidate, preferring midnight over
+// noon, whose offset is in use at t by one of the locations, in order.
+func pickCandidate(t time.Time, cs []releaseCandidate, locs []*time.Location) (releaseCandidate, bool) {
+	for _, midnight := range []bool{true, false} {
+		for _, loc := range locs {
+			off := offsetIn(t, loc)
+			for _, c := range cs {
+				if c.midnight == midnight && c.offset == off {
+					return c, true
+				}
+			}
+		}
+	}
+	return releaseCandidate{}, false
+}
+
+// determineReleaseDate returns the calendar date of the release at the
+// unix timestamp. storefront is the Apple Music storefront the release
+// was obtained from, or "".
+func determineReleaseDate(unix int64, storefront string) ReleaseDate {
+	t := time.Unix(unix, 0)
+	cs := releaseCandidates(t)
+
+	dates := make(map[FullDate]bool)
+	midnightDates := make(map[FullDate]bool)
+	for _, c := range cs {
+		dates[c.date] = true
+		if c.midnight {
+			midnightDates[c.date] = true
+		}
+	}
+
+	c, ok := pickCandidate(t, cs, storefrontLocations[storefront])
+	hinted := ok
+	if !ok {
+		c, ok = pickCandidate(t, cs, defaultLocations)
+	}
+	if !ok && len(cs) != 0 {
+		c, ok = cs[0], true
+		for _, cc := range cs {
+			if cc.midnight {
+				c = cc
+				break
+			}
+		}
+	}
+
+	var date FullDate
+	var ambiguous bool
+	if ok {
+		date = c.date
+		// Ambiguous if another date is equally plausible, unless the
+		// storefront decided.
+		if hinted {
+			ambiguous = false
+		} else if c.midnight {
+			ambiguous = len(midnightDates) > 1
+		} else {
+			ambiguous = len(midnightDates) != 0 || len(dates) > 1
+		}
+	} else {
+		lt := t.In(defaultLocation)
+		date = FullDate{Year: lt.Year(), Month: lt.Month(), Day: lt.Day()}
+		ambiguous = true
+	}
+
+	return ReleaseDate{
+		Year:      date.Year,
+		Month:     date.Month,
+		Day:       date.Day,
+		Precision: PrecisionDay,
+		Ambiguous: ambiguous,
+	}
+}
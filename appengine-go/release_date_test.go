@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDetermineReleaseDate(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, min int) int64 {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC).Unix()
+	}
+
+	tests := []struct {
+		name       string
+		unix       int64
+		storefront string
+		want       FullDate
+		ambiguous  bool
+	}{
+		// Midnight in Los Angeles (PDT), which is noon at +5.
+		{"pacific", utc(2020, 8, 1, 7, 0), "us", FullDate{2020, 8, 1}, false},
+		{"pacific, no storefront", utc(2020, 8, 1, 7, 0), "", FullDate{2020, 8, 1}, false},
+		{"pacific, unknown storefront", utc(2020, 8, 1, 7, 0), "zz", FullDate{2020, 8, 1}, false},
+
+		// Midnight in New York: EDT in summer and EST in winter.
+		{"eastern summer", utc(2020, 8, 1, 4, 0), "us", FullDate{2020, 8, 1}, false},
+		{"eastern winter", utc(2021, 1, 15, 5, 0), "us", FullDate{2021, 1, 15}, false},
+		{"eastern winter, no storefront", utc(2021, 1, 15, 5, 0), "", FullDate{2021, 1, 15}, false},
+
+		// Midnight UTC, which is noon at -12 and +12 on different dates.
+		// London is on BST in August, so the storefront doesn't decide.
+		{"utc", utc(2020, 8, 1, 0, 0), "", FullDate{2020, 8, 1}, false},
+		{"utc, gb summer", utc(2020, 8, 1, 0, 0), "gb", FullDate{2020, 8, 1}, false},
+		{"utc, gb winter", utc(2020, 1, 10, 0, 0), "gb", FullDate{2020, 1, 10}, false},
+
+		// Midnight in London (BST).
+		{"london summer", utc(2020, 7, 31, 23, 0), "gb", FullDate{2020, 8, 1}, false},
+		{"london summer, no storefront", utc(2020, 7, 31, 23, 0), "", FullDate{2020, 8, 1}, false},
+
+		// Midnight in Tokyo, which is noon at -3.
+		{"tokyo", utc(2020, 7, 31, 15, 0), "jp", FullDate{2020, 8, 1}, false},
+		{"tokyo, no storefront", utc(2020, 7, 31, 15, 0), "", FullDate{2020, 8, 1}, false},
+
+		// Midnight in India, at a half-hour offset.
+		{"india", utc(2020, 7, 31, 18, 30), "in", FullDate{2020, 8, 1}, false},
+		{"india, no storefront", utc(2020, 7, 31, 18, 30), "", FullDate{2020, 8, 1}, false},
+
+		// Midnight in Nepal, at +5:45, which no storefront or default zone
+		// uses.
+		{"nepal", utc(2020, 7, 31, 18, 15), "", FullDate{2020, 8, 1}, false},
+
+		// Midnight at -12 and at +12 are different dates. Without a
+		// storefront, it's noon UTC, and ambiguous; New Zealand (NZST, +12)
+		// decides.
+		{"dateline", utc(2020, 8, 1, 12, 0), "", FullDate{2020, 8, 1}, true},
+		{"dateline, nz", utc(2020, 8, 1, 12, 0), "nz", FullDate{2020, 8, 2}, false},
+		{"dateline, us", utc(2020, 8, 1, 12, 0), "us", FullDate{2020, 8, 1}, true},
+
+		// Midnight at -10 (Honolulu) and at +14 (Kiribati) are different
+		// dates, and it's noon in Berlin (CEST).
+		{"honolulu", utc(2020, 8, 1, 10, 0), "us", FullDate{2020, 8, 1}, false},
+		{"honolulu, no storefront", utc(2020, 8, 1, 10, 0), "", FullDate{2020, 8, 1}, true},
+		{"honolulu, de", utc(2020, 8, 1, 10, 0), "de", FullDate{2020, 8, 1}, false},
+
+		// Noon in Sydney (AEST), which is midnight at -2 on the same date.
+		{"sydney noon", utc(2020, 8, 1, 2, 0), "au", FullDate{2020, 8, 1}, false},
+
+		// Midnight in Sydney (AEDT, +11) in January, which is noon at -1 on
+		// the previous date.
+		{"sydney summer", utc(2020, 1, 9, 13, 0), "au", FullDate{2020, 1, 10}, false},
+		{"sydney summer, no storefront", utc(2020, 1, 9, 13, 0), "", FullDate{2020, 1, 10}, false},
+
+		// Midnight in Caracas at -4:30, in use from 2007 to 2016, which is
+		// noon at +7:30 on the same date.
+		{"caracas", utc(2010, 6, 1, 4, 30), "", FullDate{2010, 6, 1}, false},
+
+		// Neither midnight nor noon at any offset: the date in UTC.
+		{"no candidates", utc(2020, 8, 1, 0, 7), "us", FullDate{2020, 8, 1}, true},
+		{"no candidates, late", utc(2020, 8, 1, 23, 50), "", FullDate{2020, 8, 1}, true},
+
+		// Leap day.
+		{"leap day", utc(2020, 2, 29, 5, 0), "us", FullDate{2020, 2, 29}, false},
+		{"leap day, london", utc(2020, 2, 29, 0, 0), "gb", FullDate{2020, 2, 29}, false},
+
+		// Before 1970.
+		{"1967", utc(1967, 6, 1, 5, 0), "us", FullDate{1967, 6, 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := determineReleaseDate(tt.unix, tt.storefront)
+			want := ReleaseDate{
+				Year:      tt.want.Year,
+				Month:     tt.want.Month,
+				Day:       tt.want.Day,
+				Precision: PrecisionDay,
+				Ambiguous: tt.ambiguous,
+			}
+			if got != want {
+				t.Errorf("determineReleaseDate(%d, %q): got %+v, want %+v", tt.unix, tt.storefront, got, want)
+			}
+		})
+	}
+}
+
+func TestUTCOffsets(t *testing.T) {
+	has := make(map[int]bool)
+	for i, off := range utcOffsets {
+		has[off] = true
+		if i > 0 && off <= utcOffsets[i-1] {
+			t.Errorf("offsets not increasing at %d", off)
+		}
+	}
+	for _, off := range []int{-12 * 60, -9*60 - 30, -4*60 - 30, -3*60 - 30, 0, 5*60 + 30, 5*60 + 45, 8*60 + 45, 12*60 + 45, 13*60 + 45, 14 * 60} {
+		if !has[off] {
+			t.Errorf("missing offset %d", off)
+		}
+	}
+	for _, off := range []int{-13 * 60, -44, 15 * 60} {
+		if has[off] {
+			t.Errorf("unexpected offset %d", off)
+		}
+	}
+}
+
+// withZoneData sets the zone data sources, and $ZONEINFO, until the test
+// ends.
+func withZoneData(t *testing.T, zoneinfo string, sources []string, zip string) {
+	oldZoneinfo, hadZoneinfo := os.LookupEnv("ZONEINFO")
+	oldSources, oldZip, oldOffsets := zoneSources, goZoneinfoZip, utcOffsets
+	t.Cleanup(func() {
+		if hadZoneinfo {
+			os.Setenv("ZONEINFO", oldZoneinfo)
+		} else {
+			os.Unsetenv("ZONEINFO")
+		}
+		zoneSources, goZoneinfoZip, utcOffsets = oldSources, oldZip, oldOffsets
+	})
+	if zoneinfo != "" {
+		os.Setenv("ZONEINFO", zoneinfo)
+	} else {
+		os.Unsetenv("ZONEINFO")
+	}
+	zoneSources, goZoneinfoZip = sources, zip
+}
+
+func hasZone(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestZoneNamesFromZip(t *testing.T) {
+	withZoneData(t, "", nil, goZoneinfoZip)
+
+	names, err := zoneNames()
+	if err != nil {
+		t.Skipf("no zoneinfo.zip: %s", err)
+	}
+	if !hasZone(names, "Asia/Kathmandu") {
+		t.Errorf("Asia/Kathmandu not in %d names", len(names))
+	}
+}
+
+func TestZoneNamesFromZONEINFO(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zoneinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tab := "# comment\nNP\t+2743+08519\tAsia/Kathmandu\nIN\t+2232+08822\tAsia/Kolkata\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "zone1970.tab"), []byte(tab), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	withZoneData(t, dir, zoneSources, goZoneinfoZip)
+	names, err := zoneNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != "Asia/Kathmandu" || names[1] != "Asia/Kolkata" {
+		t.Errorf("got %q", names)
+	}
+
+	// $ZONEINFO may also be a zip file.
+	withZoneData(t, goZoneinfoZip, nil, "")
+	if names, err := zoneNames(); err != nil {
+		t.Skipf("no zoneinfo.zip: %s", err)
+	} else if !hasZone(names, "Asia/Kathmandu") {
+		t.Errorf("Asia/Kathmandu not in %d names", len(names))
+	}
+}
+
+func TestLoadReleaseDateZonesWithoutZoneList(t *testing.T) {
+	withZoneData(t, "", nil, filepath.Join(os.TempDir(), "no-such-zoneinfo.zip"))
+	utcOffsets = nil
+
+	if err := loadReleaseDateZones(); err != nil {
+		t.Fatal(err)
+	}
+	if len(utcOffsets) != len(fallbackUTCOffsets) {
+		t.Errorf("got %d offsets, want the %d built-in offsets", len(utcOffsets), len(fallbackUTCOffsets))
+	}
+	if got := determineReleaseDate(time.Date(2020, 7, 31, 18, 15, 0, 0, time.UTC).Unix(), ""); got.Day != 1 || got.Ambiguous {
+		t.Errorf("nepal: got %+v", got)
+	}
+}
+
+// The built-in offsets should be updated when the zone data adds offsets.
+func TestFallbackUTCOffsets(t *testing.T) {
+	offsets, err := systemUTCOffsets()
+	if err != nil {
+		t.Skipf("no zone data: %s", err)
+	}
+	if fmt.Sprint(offsets) != fmt.Sprint(fallbackUTCOffsets) {
+		t.Errorf("built-in offsets differ from the zone data's:\n%v", offsets)
+	}
+}
+
+// TestDetermineReleaseDateCatalog tests the release dates of albums in the
+// Apple Music catalog, in the catalog's releaseDate format: midnight in the
+// time zone of the storefront the release was published for.
+func TestDetermineReleaseDateCatalog(t *testing.T) {
+	tests := []struct {
+		album       string
+		releaseDate string // as in the catalog
+		storefront  string
+		want        FullDate
+		ambiguous   bool
+	}{
+		// United States: midnight Pacific, PDT or PST.
+		{"Taylor Swift — folklore", "2020-07-24T07:00:00Z", "us", FullDate{2020, 7, 24}, false},
+		{"Kendrick Lamar — DAMN.", "2017-04-14T07:00:00Z", "us", FullDate{2017, 4, 14}, false},
+		{"Adele — 25", "2015-11-20T08:00:00Z", "us", FullDate{2015, 11, 20}, false},
+		{"Fleetwood Mac — Rumours", "1977-02-04T08:00:00Z", "us", FullDate{1977, 2, 4}, false},
+		{"The Beatles — Abbey Road", "1969-09-26T07:00:00Z", "us", FullDate{1969, 9, 26}, false},
+		{"Taylor Swift — folklore, no storefront", "2020-07-24T07:00:00Z", "", FullDate{2020, 7, 24}, false},
+
+		// United Kingdom: GMT in winter and BST in summer.
+		{"Adele — 25", "2015-11-20T00:00:00Z", "gb", FullDate{2015, 11, 20}, false},
+		{"Arctic Monkeys — AM", "2013-09-08T23:00:00Z", "gb", FullDate{2013, 9, 9}, false},
+		{"Arctic Monkeys — AM, no storefront", "2013-09-08T23:00:00Z", "", FullDate{2013, 9, 9}, false},
+
+		// Germany (CEST) and Brazil (BRT).
+		{"Rammstein — Rammstein", "2019-05-16T22:00:00Z", "de", FullDate{2019, 5, 17}, false},
+		{"Anitta — Kisses", "2019-04-05T03:00:00Z", "br", FullDate{2019, 4, 5}, false},
+
+		// India, at +5:30.
+		{"A. R. Rahman — Rockstar", "2011-09-29T18:30:00Z", "in", FullDate{2011, 9, 30}, false},
+
+		// Japan.
+		{"Hikaru Utada — Hatsukoi", "2018-06-26T15:00:00Z", "jp", FullDate{2018, 6, 27}, false},
+		{"Hikaru Utada — Hatsukoi, no storefront", "2018-06-26T15:00:00Z", "", FullDate{2018, 6, 27}, false},
+
+		// Australia (AEST), which is noon at -2 on the previous day.
+		{"Tame Impala — Currents", "2015-07-16T14:00:00Z", "au", FullDate{2015, 7, 17}, false},
+
+		// New Zealand (NZST, +12): near the date line, midnight at +12 is
+		// midnight at -12 on the previous day, so only the storefront
+		// decides.
+		{"Lorde — Melodrama", "2017-06-15T12:00:00Z", "nz", FullDate{2017, 6, 16}, false},
+		{"Lorde — Melodrama, no storefront", "2017-06-15T12:00:00Z", "", FullDate{2017, 6, 15}, true},
+		{"Lorde — Melodrama, us", "2017-06-15T12:00:00Z", "us", FullDate{2017, 6, 15}, true},
+		// NZDT, +13, in the southern summer, which is midnight at -11.
+		{"BENEE — Hey u x", "2020-11-12T11:00:00Z", "nz", FullDate{2020, 11, 13}, false},
+		{"BENEE — Hey u x, no storefront", "2020-11-12T11:00:00Z", "", FullDate{2020, 11, 12}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.album, func(t *testing.T) {
+			rel, err := time.Parse(time.RFC3339, tt.releaseDate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := determineReleaseDate(rel.Unix(), tt.storefront)
+			want := ReleaseDate{
+				Year:      tt.want.Year,
+				Month:     tt.want.Month,
+				Day:       tt.want.Day,
+				Precision: PrecisionDay,
+				Ambiguous: tt.ambiguous,
+			}
+			if got != want {
+				t.Errorf("determineReleaseDate(%s, %q): got %+v, want %+v", tt.releaseDate, tt.storefront, got, want)
+			}
+		})
+	}
+}
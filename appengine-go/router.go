@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Router is an httprouter.Router that annotates each request's logger with
+// the matched route, and records request duration metrics by route.
+type Router struct {
+	*httprouter.Router
+	routes *[]string // "METHOD /path", in registration order
+}
+
+func newRouter() Router {
+	return Router{httprouter.New(), new([]string)}
+}
+
+// Routes returns the registered routes, in the form "METHOD /path".
+func (rt Router) Routes() []string {
+	return append([]string(nil), *rt.routes...)
+}
+
+func (rt Router) Handle(method, path string, h httprouter.Handle) {
+	handler := method + " " + path
+	*rt.routes = append(*rt.routes, handler)
+	rt.Router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ctx := r.Context()
+		l := loggerFrom(ctx).With("handler", handler)
+		if task := r.Header.Get("X-AppEngine-TaskName"); task != "" {
+			l = l.With("task", task)
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r.WithContext(contextWithLogger(ctx, l)), p)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequestDuration.Observe(time.Since(start).Seconds(), path, method, strconv.Itoa(rec.status))
+	})
+}
+
+// statusRecorder records the status code written to the ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (rt Router) GET(path string, h httprouter.Handle)    { rt.Handle("GET", path, h) }
+func (rt Router) POST(path string, h httprouter.Handle)   { rt.Handle("POST", path, h) }
+func (rt Router) PUT(path string, h httprouter.Handle)    { rt.Handle("PUT", path, h) }
+func (rt Router) PATCH(path string, h httprouter.Handle)  { rt.Handle("PATCH", path, h) }
+func (rt Router) DELETE(path string, h httprouter.Handle) { rt.Handle("DELETE", path, h) }
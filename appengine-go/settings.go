@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-redis/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+const maxSettingsBodySize = 64 << 10
+
+// settingsParser validates the JSON value for a settings field, and returns
+// a function that sets it.
+type settingsParser func(raw json.RawMessage) (func(*AccountSettings), error)
+
+// settingsFields are the AccountSettings fields that can be updated via the
+// settings API, by JSON name. Fields not in this map are rejected.
+var settingsFields = map[string]settingsParser{
+	"emailsEnabled": func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a boolean")
+		}
+		return func(s *AccountSettings) { s.EmailsEnabled = v }, nil
+	},
+	"emailFormat": func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		if v != EmailFormatHTML && v != EmailFormatText {
+			return nil, fmt.Errorf("must be %q or %q", EmailFormatHTML, EmailFormatText)
+		}
+		return func(s *AccountSettings) { s.EmailFormat = v }, nil
+	},
+	"excludeCompilations": func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a boolean")
+		}
+		return func(s *AccountSettings) { s.ExcludeCompilations = v }, nil
+	},
+	"yearReleases": func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a boolean")
+		}
+		return func(s *AccountSettings) { s.YearReleases = v }, nil
+	},
+	"minPlayCount":  intSettingsField(0, 100000, func(s *AccountSettings, v int) { s.MinPlayCount = v }),
+	"minLovedCount": intSettingsField(0, 1000, func(s *AccountSettings, v int) { s.MinLovedCount = v }),
+	"maxItems":      intSettingsField(0, 100, func(s *AccountSettings, v int) { s.MaxItems = v }),
+	"sortMode": func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v SortMode
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		if v != SortMostPlayed && v != SortOldestFirst && v != SortNewestFirst {
+			return nil, fmt.Errorf("must be %q, %q or %q", SortMostPlayed, SortOldestFirst, SortNewestFirst)
+		}
+		return func(s *AccountSettings) { s.SortMode = v }, nil
+	},
+	"leapDay": func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v LeapDayRule
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		if v != LeapDayNone && v != LeapDayFeb28 && v != LeapDayMar1 {
+			return nil, fmt.Errorf("must be %q, %q or %q", LeapDayNone, LeapDayFeb28, LeapDayMar1)
+		}
+		return func(s *AccountSettings) { s.LeapDay = v }, nil
+	},
+	"monthReleases": func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v MonthRule
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be a string")
+		}
+		if v != MonthFirstDay && v != MonthAnyDay && v != MonthWeekly {
+			return nil, fmt.Errorf("must be %q, %q or %q", MonthFirstDay, MonthAnyDay, MonthWeekly)
+		}
+		return func(s *AccountSettings) { s.MonthReleases = v }, nil
+	},
+}
+
+// intSettingsField returns the parser for an integer field with the
+// inclusive range [min, max].
+func intSettingsField(min, max int, set func(*AccountSettings, int)) settingsParser {
+	return func(raw json.RawMessage) (func(*AccountSettings), error) {
+		var v int
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		if v < min || v > max {
+			return nil, fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return func(s *AccountSettings) { set(s, v) }, nil
+	}
+}
+
+// parseSettingsPatch validates the partial AccountSettings document. It
+// returns the setters for the fields in the document, or the errors for
+// invalid and unknown fields.
+func parseSettingsPatch(patch map[string]json.RawMessage) ([]func(*AccountSettings), []FieldError) {
+	names := make([]string, 0, len(patch))
+	for name := range patch {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var setters []func(*AccountSettings)
+	var fieldErrs []FieldError
+	for _, name := range names {
+		parse, ok := settingsFields[name]
+		if !ok {
+			fieldErrs = append(fieldErrs, FieldError{name, "unknown field"})
+			continue
+		}
+		if string(patch[name]) == "null" {
+			fieldErrs = append(fieldErrs, FieldError{name, "must not be null"})
+			continue
+		}
+		set, err := parse(patch[name])
+		if err != nil {
+			fieldErrs = append(fieldErrs, FieldError{name, err.Error()})
+			continue
+		}
+		setters = append(setters, set)
+	}
+	return setters, fieldErrs
+}
+
+// UpdateSettingsHandler applies a partial AccountSettings document to the
+// account's settings, and responds with the updated settings.
+func (s *Server) UpdateSettingsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSettingsBodySize)).Decode(&patch); err != nil || patch == nil {
+		lg.Warningf("json-decode body: %v", err)
+		writeBadRequest(w, "body must be a JSON object")
+		return
+	}
+
+	setters, fieldErrs := parseSettingsPatch(patch)
+	if len(fieldErrs) != 0 {
+		writeAPIError(w, http.StatusUnprocessableEntity, APIError{
+			Code:    ErrCodeInvalidFields,
+			Message: "invalid settings",
+			Details: fieldErrs,
+		})
+		return
+	}
+
+	var updated AccountSettings
+	err := UpdateEntity(s.redis, accountKey(email), &Account{}, func(v interface{}) interface{} {
+		a := v.(*Account)
+		for _, set := range setters {
+			set(&a.Settings)
+		}
+		updated = a.Settings
+		return a
+	})
+	if err == redis.Nil {
+		writeNotFound(w, "no such account")
+		return
+	}
+	if err != nil {
+		lg.Errorf("update account: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		lg.Errorf("write response: %s", err)
+	}
+}
@@ -40,6 +40,12 @@ func mustMarshalJSON(v interface{}) []byte {
 	return b
 }
 
+func writeIndentedJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
 const ProjectID = "albumday"
 
 const SupportEmail = "littlerootorg@gmail.com"
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	spotifyAuthorizeURL = "https://accounts.spotify.com/authorize"
+	spotifyTokenURL     = "https://accounts.spotify.com/api/token"
+)
+
+// SpotifyOAuth is the client for Spotify's authorization code flow, with
+// PKCE. It is used both for the initial code exchange and for refreshing
+// access tokens.
+//
+// https://developer.spotify.com/documentation/general/guides/authorization-guide/
+type SpotifyOAuth struct {
+	http         *http.Client
+	clientID     string
+	clientSecret string
+}
+
+func newSpotifyOAuth(c *http.Client, clientID, clientSecret string) *SpotifyOAuth {
+	return &SpotifyOAuth{
+		http:         c,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+	}
+}
+
+// generateCodeVerifier returns a PKCE code verifier. See RFC 7636 section 4.1.
+func generateCodeVerifier() string {
+	p := make([]byte, 64)
+	if _, err := rand.Read(p); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(p)
+}
+
+// codeChallenge returns the S256 PKCE code challenge for the verifier.
+func codeChallenge(verifier string) string {
+	h := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func (o *SpotifyOAuth) AuthorizeURL(redirectURL, state, codeVerifier string) string {
+	v := url.Values{}
+	v.Set("client_id", o.clientID)
+	v.Set("response_type", "code")
+	v.Set("redirect_uri", redirectURL)
+	v.Set("state", state)
+	v.Set("scope", "user-library-read")
+	v.Set("show_dialog", "false")
+	v.Set("code_challenge_method", "S256")
+	v.Set("code_challenge", codeChallenge(codeVerifier))
+	return spotifyAuthorizeURL + "?" + v.Encode()
+}
+
+// Exchange exchanges an authorization code for tokens.
+func (o *SpotifyOAuth) Exchange(ctx context.Context, code, redirectURL, codeVerifier string) (*oauth2.Token, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("code_verifier", codeVerifier)
+	return o.token(ctx, v, "")
+}
+
+// Refresh obtains a new access token. The returned token's RefreshToken is
+// the rotated refresh token if Spotify returned one, or else the supplied
+// refresh token.
+func (o *SpotifyOAuth) Refresh(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	v := url.Values{}
+	v.Set("grant_type", "refresh_token")
+	v.Set("refresh_token", refreshToken)
+	return o.token(ctx, v, refreshToken)
+}
+
+type SpotifyTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	Scope        string `json:"scope"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"` // possibly "" on refresh
+}
+
+func (o *SpotifyOAuth) token(ctx context.Context, params url.Values, refreshToken string) (*oauth2.Token, error) {
+	req, err := http.NewRequest("POST", spotifyTokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	cred := base64.StdEncoding.EncodeToString([]byte(o.clientID + ":" + o.clientSecret))
+	req.Header.Set("Authorization", "Basic "+cred)
+
+	rsp, err := o.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do spotify request: %s", err)
+	}
+	defer drainAndClose(rsp.Body)
+
+	if rsp.StatusCode != 200 {
+		return nil, StatusError{rsp.StatusCode}
+	}
+
+	var t SpotifyTokenResponse
+	if err := json.NewDecoder(rsp.Body).Decode(&t); err != nil {
+		return nil, fmt.Errorf("json-decode token response: %s", err)
+	}
+
+	if t.RefreshToken != "" {
+		refreshToken = t.RefreshToken
+	}
+	return &oauth2.Token{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		RefreshToken: refreshToken,
+		Expiry:       time.Now().Add(time.Duration(t.ExpiresIn) * time.Second),
+	}, nil
+}
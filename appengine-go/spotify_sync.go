@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Spotify libraries are synced incrementally. The saved tracks are listed
+// most recently added first, so a sync fetches only the pages with tracks
+// added since the most recent track in the stored library. Removed tracks
+// can't be detected that way, so a full sync is done when the number of
+// tracks differs from Spotify's total, and periodically regardless.
+
+// spotifyFullSyncInterval is the maximum interval between full syncs.
+const spotifyFullSyncInterval = 7 * 24 * time.Hour
+
+// spotifyLibraryTTL is the expiry of a stored library, so that libraries of
+// accounts that stop syncing are removed. It's longer than the full sync
+// interval, since an older library is replaced by a full sync anyway.
+const spotifyLibraryTTL = 2 * spotifyFullSyncInterval
+
+func spotifyLibraryKey(email string) string {
+	return fmt.Sprintf("spotify_library:%s", email)
+}
+
+// SpotifyLibrary is the stored state of an account's saved Spotify tracks.
+type SpotifyLibrary struct {
+	Tracks       []SpotifyLibraryTrack `json:"tracks"`       // most recently added first
+	LastFullSync int64                 `json:"lastFullSync"` // unix seconds
+}
+
+type SpotifyLibraryTrack struct {
+	ID      string `json:"id"`
+	AddedAt string `json:"addedAt"` // as provided by Spotify, e.g. "2016-10-24T15:03:07Z"
+	Song    *Song  `json:"song"`    // or nil if the track has insufficient data
+}
+
+func (l *SpotifyLibrary) songs() []Song {
+	ret := make([]Song, 0, len(l.Tracks))
+	for _, t := range l.Tracks {
+		if t.Song != nil {
+			ret = append(ret, *t.Song)
+		}
+	}
+	return ret
+}
+
+func toSpotifyLibraryTracks(saved []SpotifySavedTrack) []SpotifyLibraryTrack {
+	ret := make([]SpotifyLibraryTrack, len(saved))
+	for i, t := range saved {
+		ret[i] = SpotifyLibraryTrack{ID: t.Track.ID, AddedAt: t.AddedAt}
+		if s, ok := transformSpotifyTrack(t.Track); ok {
+			ret[i].Song = &s
+		}
+	}
+	return ret
+}
+
+// syncSpotify returns the library updated with the changes since lib was
+// synced. lib may be nil, in which case a full sync is done. The refresh
+// token to use subsequently is returned even if err != nil.
+func syncSpotify(ctx context.Context, c *http.Client, oauth *SpotifyOAuth, refreshToken string, lib *SpotifyLibrary, now time.Time) (*SpotifyLibrary, string, error) {
+	if lib == nil || len(lib.Tracks) == 0 || now.Sub(time.Unix(lib.LastFullSync, 0)) >= spotifyFullSyncInterval {
+		return fullSyncSpotify(ctx, c, oauth, refreshToken, now)
+	}
+
+	// RFC 3339 UTC timestamps in the same format compare correctly as
+	// strings.
+	highWater := lib.Tracks[0].AddedAt
+	saved, total, refreshToken, err := fetchSpotify(ctx, c, oauth, refreshToken, func(t SpotifySavedTrack) bool {
+		return t.AddedAt <= highWater
+	})
+	if err != nil {
+		return nil, refreshToken, err
+	}
+
+	added := toSpotifyLibraryTracks(saved)
+	seen := make(map[string]bool, len(added))
+	for _, t := range added {
+		seen[t.ID] = true
+	}
+	tracks := added
+	for _, t := range lib.Tracks {
+		if !seen[t.ID] { // re-saved tracks move to the front
+			tracks = append(tracks, t)
+		}
+	}
+
+	if len(tracks) != total {
+		// tracks were removed since the last sync
+		return fullSyncSpotify(ctx, c, oauth, refreshToken, now)
+	}
+
+	spotifySyncTotal.Inc("incremental")
+	return &SpotifyLibrary{
+		Tracks:       tracks,
+		LastFullSync: lib.LastFullSync,
+	}, refreshToken, nil
+}
+
+func fullSyncSpotify(ctx context.Context, c *http.Client, oauth *SpotifyOAuth, refreshToken string, now time.Time) (*SpotifyLibrary, string, error) {
+	saved, _, refreshToken, err := fetchSpotify(ctx, c, oauth, refreshToken, nil)
+	if err != nil {
+		return nil, refreshToken, err
+	}
+	spotifySyncTotal.Inc("full")
+	return &SpotifyLibrary{
+		Tracks:       toSpotifyLibraryTracks(saved),
+		LastFullSync: now.Unix(),
+	}, refreshToken, nil
+}
+
+// getSpotifyLibrary returns the stored library, or nil if there is none.
+func (s *Server) getSpotifyLibrary(email string) (*SpotifyLibrary, error) {
+	b, err := s.redis.Get(spotifyLibraryKey(email)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GET spotify library: %s", err)
+	}
+	var lib SpotifyLibrary
+	mustUnmarshalJSON(b, &lib)
+	return &lib, nil
+}
+
+func (s *Server) putSpotifyLibrary(email string, lib *SpotifyLibrary) error {
+	if err := s.redis.Set(spotifyLibraryKey(email), mustMarshalJSON(lib), spotifyLibraryTTL).Err(); err != nil {
+		return fmt.Errorf("SET spotify library: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeSpotify serves the Spotify token and saved tracks endpoints.
+type fakeSpotify struct {
+	tracks   []SpotifySavedTrack // most recently added first
+	pageSize int
+	pages    int // number of saved tracks pages served
+
+	refreshToken string     // returned by the token endpoint, if not ""
+	tokenForm    url.Values // of the last token request
+}
+
+func (f *fakeSpotify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/token":
+		r.ParseForm()
+		f.tokenForm = r.PostForm
+		w.Write(mustMarshalJSON(SpotifyTokenResponse{AccessToken: "access", TokenType: "Bearer", ExpiresIn: 3600, RefreshToken: f.refreshToken}))
+	case "/v1/me/tracks":
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.pages++
+		offset, _ := strconv.Atoi(r.FormValue("offset"))
+		end := offset + f.pageSize
+		if end > len(f.tracks) {
+			end = len(f.tracks)
+		}
+		rsp := SpotifyResponse{Total: len(f.tracks), Items: f.tracks[offset:end]}
+		if end < len(f.tracks) {
+			rsp.Next = "https://api.spotify.com/v1/me/tracks?offset=" + strconv.Itoa(end)
+		}
+		json.NewEncoder(w).Encode(rsp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeSpotify) client() (*http.Client, *SpotifyOAuth) {
+	c := &http.Client{Transport: hostTransport{"accounts.spotify.com": f, "api.spotify.com": f}}
+	return c, newSpotifyOAuth(c, "id", "secret")
+}
+
+func testSavedTrack(id, addedAt string) SpotifySavedTrack {
+	return SpotifySavedTrack{
+		AddedAt: addedAt,
+		Track: SpotifyTrack{
+			ID:   id,
+			Name: "Song " + id,
+			Album: SpotifyAlbum{
+				Name:    "Album " + id,
+				Artists: []SpotifyArtist{{Name: "Artist"}},
+			},
+		},
+	}
+}
+
+func trackIDs(lib *SpotifyLibrary) string {
+	var ids string
+	for _, t := range lib.Tracks {
+		ids += t.ID
+	}
+	return ids
+}
+
+func TestSyncSpotify(t *testing.T) {
+	now := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	lastFullSync := now.Add(-24 * time.Hour).Unix()
+
+	a := testSavedTrack("a", "2020-01-01T00:00:00Z")
+	b := testSavedTrack("b", "2020-02-01T00:00:00Z")
+	c := testSavedTrack("c", "2020-03-01T00:00:00Z")
+	d := testSavedTrack("d", "2020-04-01T00:00:00Z")
+	e := testSavedTrack("e", "2020-05-01T00:00:00Z")
+	bResaved := testSavedTrack("b", "2020-06-01T00:00:00Z")
+
+	stored := &SpotifyLibrary{
+		Tracks:       toSpotifyLibraryTracks([]SpotifySavedTrack{c, b, a}),
+		LastFullSync: lastFullSync,
+	}
+
+	tests := []struct {
+		name     string
+		lib      *SpotifyLibrary
+		spotify  []SpotifySavedTrack
+		want     string // track IDs
+		wantSync int64  // LastFullSync
+		pages    int
+	}{
+		{"no library", nil, []SpotifySavedTrack{c, b, a}, "cba", now.Unix(), 2},
+		{
+			"stale library",
+			&SpotifyLibrary{Tracks: stored.Tracks, LastFullSync: now.Add(-spotifyFullSyncInterval).Unix()},
+			[]SpotifySavedTrack{c, b, a},
+			"cba", now.Unix(), 2,
+		},
+		// Stops at the first page with a track that isn't newer than the
+		// stored library's most recent track.
+		{"added", stored, []SpotifySavedTrack{e, d, c, b, a}, "edcba", lastFullSync, 2},
+		{"unchanged", stored, []SpotifySavedTrack{c, b, a}, "cba", lastFullSync, 1},
+		// Re-saved tracks move to the front.
+		{"re-saved", stored, []SpotifySavedTrack{bResaved, c, a}, "bca", lastFullSync, 1},
+		// The incremental sync has 4 tracks, but Spotify has 3, so it's
+		// followed by a full sync (2 pages).
+		{"removed", stored, []SpotifySavedTrack{d, c, a}, "dca", now.Unix(), 1 + 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSpotify{tracks: tt.spotify, pageSize: 2}
+			c, oauth := f.client()
+
+			lib, refreshToken, err := syncSpotify(context.Background(), c, oauth, "refresh", tt.lib, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if refreshToken != "refresh" {
+				t.Errorf("got refresh token %q", refreshToken)
+			}
+			if got := trackIDs(lib); got != tt.want {
+				t.Errorf("got tracks %q, want %q", got, tt.want)
+			}
+			if lib.LastFullSync != tt.wantSync {
+				t.Errorf("got last full sync %d, want %d", lib.LastFullSync, tt.wantSync)
+			}
+			if f.pages != tt.pages {
+				t.Errorf("got %d pages, want %d", f.pages, tt.pages)
+			}
+			for _, tr := range lib.Tracks {
+				if tr.Song == nil {
+					t.Errorf("track %s: no song", tr.ID)
+				}
+			}
+		})
+	}
+
+	// The re-saved track has its new added time.
+	f := &fakeSpotify{tracks: []SpotifySavedTrack{bResaved, c, a}, pageSize: 2}
+	hc, oauth := f.client()
+	lib, _, err := syncSpotify(context.Background(), hc, oauth, "refresh", stored, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lib.Tracks[0].AddedAt != bResaved.AddedAt {
+		t.Errorf("re-saved: got added at %s", lib.Tracks[0].AddedAt)
+	}
+}
+
+func TestPutSpotifyLibrary(t *testing.T) {
+	s, f := newTestServer(t)
+	const email = "foo@example.com"
+
+	lib := &SpotifyLibrary{Tracks: toSpotifyLibraryTracks([]SpotifySavedTrack{testSavedTrack("a", "2020-01-01T00:00:00Z")})}
+	if err := s.putSpotifyLibrary(email, lib); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := f.ttl(spotifyLibraryKey(email)); ttl <= spotifyFullSyncInterval {
+		t.Errorf("got TTL %s, want more than %s", ttl, spotifyFullSyncInterval)
+	}
+	got, err := s.getSpotifyLibrary(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trackIDs(got) != "a" {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Personal API tokens allow scripted access to the read-only /api/v1
+// endpoints via "Authorization: Bearer <token>". Only the SHA-256 hash of a
+// token is stored; the plaintext token is shown once, at creation.
+
+const apiTokenPrefix = "ad_"
+
+const maxAPITokens = 20
+
+type TokenScope string
+
+const (
+	ScopeAccountRead   TokenScope = "account:read"
+	ScopeBirthdaysRead TokenScope = "birthdays:read"
+)
+
+var AllTokenScopes = [...]TokenScope{
+	ScopeAccountRead,
+	ScopeBirthdaysRead,
+}
+
+func validTokenScope(s TokenScope) bool {
+	for _, v := range AllTokenScopes {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenKey is the key for the APIToken record, keyed by token hash.
+func apiTokenKey(hash string) string {
+	return fmt.Sprintf("api_token:%s", hash)
+}
+
+// apiTokensKey is the key for the hash of token ID -> token hash, for the
+// tokens belonging to the account.
+func apiTokensKey(email string) string {
+	return fmt.Sprintf("api_tokens:%s", email)
+}
+
+type APIToken struct {
+	ID      string       `json:"id"`
+	Name    string       `json:"name"`
+	Scopes  []TokenScope `json:"scopes"`
+	Created int64        `json:"created"` // unix seconds
+}
+
+func (t *APIToken) hasScope(scope TokenScope) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenRecord is the stored form of APIToken, which additionally records
+// the account that the token belongs to.
+type apiTokenRecord struct {
+	APIToken
+	Email string `json:"email"`
+}
+
+func generateAPIToken() string {
+	p := make([]byte, 32)
+	if _, err := rand.Read(p); err != nil {
+		panic(err)
+	}
+	return apiTokenPrefix + hex.EncodeToString(p)
+}
+
+func generateAPITokenID() string {
+	p := make([]byte, 8)
+	if _, err := rand.Read(p); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(p)
+}
+
+func hashAPIToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// apiIdentity is like currentIdentity, but if the request has a bearer
+// token, it authenticates using the token instead of the identity cookie.
+// The token must have the given scope. Returns "" if the request is not
+// authenticated.
+func (s *Server) apiIdentity(r *http.Request, scope TokenScope) string {
+	lg := loggerFrom(r.Context())
+
+	token := bearerToken(r)
+	if token == "" {
+		return s.currentIdentity(r)
+	}
+
+	b, err := s.redis.Get(apiTokenKey(hashAPIToken(token))).Bytes()
+	if err == redis.Nil {
+		return ""
+	}
+	if err != nil {
+		lg.Errorf("GET api token: %s", err)
+		return ""
+	}
+
+	var t apiTokenRecord
+	mustUnmarshalJSON(b, &t)
+	if !t.hasScope(scope) {
+		lg.With("account", accountHash(t.Email)).Warningf("api token %s missing scope %s", t.ID, scope)
+		return ""
+	}
+	if s.deletionPending(r.Context(), t.Email) {
+		return ""
+	}
+	return t.Email
+}
+
+func (s *Server) getAPITokens(email string) ([]APIToken, error) {
+	hashes, err := s.redis.HVals(apiTokensKey(email)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("HVALS api tokens: %s", err)
+	}
+	if len(hashes) == 0 {
+		return []APIToken{}, nil
+	}
+
+	keys := make([]string, len(hashes))
+	for i, h := range hashes {
+		keys[i] = apiTokenKey(h)
+	}
+	vals, err := s.redis.MGet(keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("MGET api tokens: %s", err)
+	}
+
+	tokens := make([]APIToken, 0, len(vals))
+	for _, v := range vals {
+		str, ok := v.(string)
+		if !ok {
+			continue // missing
+		}
+		var t apiTokenRecord
+		mustUnmarshalJSON([]byte(str), &t)
+		tokens = append(tokens, t.APIToken)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created < tokens[j].Created
+	})
+	return tokens, nil
+}
+
+func (s *Server) APITokensHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	tokens, err := s.getAPITokens(email)
+	if err != nil {
+		lg.Errorf("get api tokens: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		lg.Errorf("write response: %s", err)
+	}
+}
+
+type CreateAPITokenResponse struct {
+	APIToken
+	Token string `json:"token"`
+}
+
+func (s *Server) CreateAPITokenHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	if err := r.ParseForm(); err != nil {
+		writeBadRequest(w, "bad form")
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if name == "" || len(name) > 100 {
+		writeBadRequest(w, "name must be 1 to 100 characters")
+		return
+	}
+
+	var scopes []TokenScope
+	for _, v := range r.Form["scope"] {
+		scope := TokenScope(v)
+		if !validTokenScope(scope) {
+			writeBadRequest(w, "bad scope")
+			return
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		writeBadRequest(w, "at least one scope required")
+		return
+	}
+
+	n, err := s.redis.HLen(apiTokensKey(email)).Result()
+	if err != nil {
+		lg.Errorf("HLEN api tokens: %s", err)
+		writeInternalError(w)
+		return
+	}
+	if n >= maxAPITokens {
+		writeAPIError(w, http.StatusConflict, APIError{
+			Code:    ErrCodeTooManyTokens,
+			Message: fmt.Sprintf("at most %d tokens allowed", maxAPITokens),
+		})
+		return
+	}
+
+	token := generateAPIToken()
+	hash := hashAPIToken(token)
+	t := apiTokenRecord{
+		APIToken: APIToken{
+			ID:      generateAPITokenID(),
+			Name:    name,
+			Scopes:  scopes,
+			Created: time.Now().Unix(),
+		},
+		Email: email,
+	}
+
+	if err := s.redis.Set(apiTokenKey(hash), mustMarshalJSON(t), 0).Err(); err != nil {
+		lg.Errorf("SET api token: %s", err)
+		writeInternalError(w)
+		return
+	}
+	if err := s.redis.HSet(apiTokensKey(email), t.ID, hash).Err(); err != nil {
+		lg.Errorf("HSET api tokens: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	lg.Infof("created api token %s", t.ID)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(CreateAPITokenResponse{
+		APIToken: t.APIToken,
+		Token:    token,
+	}); err != nil {
+		lg.Errorf("write response: %s", err)
+	}
+}
+
+func (s *Server) RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := s.currentIdentity(r)
+	if email == "" {
+		writeUnauthorized(w)
+		return
+	}
+	lg = lg.With("account", accountHash(email))
+
+	id := p.ByName("id")
+	hash, err := s.redis.HGet(apiTokensKey(email), id).Result()
+	if err == redis.Nil {
+		writeNotFound(w, "no such token")
+		return
+	}
+	if err != nil {
+		lg.Errorf("HGET api tokens: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	if err := s.redis.Del(apiTokenKey(hash)).Err(); err != nil {
+		lg.Errorf("DEL api token: %s", err)
+		writeInternalError(w)
+		return
+	}
+	if err := s.redis.HDel(apiTokensKey(email), id).Err(); err != nil {
+		lg.Errorf("HDEL api tokens: %s", err)
+		writeInternalError(w)
+		return
+	}
+
+	lg.Infof("revoked api token %s", id)
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"time"
 
@@ -23,10 +23,29 @@ type IndexTmplArgs struct {
 	IsDev     bool
 }
 
+// ConfirmTmplArgs are the arguments for the confirmation page shown by GET
+// requests to email links. The form POSTs Fields to Action, so that link
+// prefetchers and scanners, which only issue GETs, can't change the account.
+type ConfirmTmplArgs struct {
+	AppName string
+	Title   string
+	Message string
+	Action  string
+	Fields  map[string]string
+	Button  string
+}
+
 var (
-	indexTmpl = template.Must(template.ParseFiles("templates/index.html"))
+	indexTmpl   = template.Must(template.ParseFiles("templates/index.html"))
+	confirmTmpl = template.Must(template.ParseFiles("templates/confirm.html"))
 )
 
+// tokenEqual reports whether the token from a request matches the stored
+// token, in constant time.
+func tokenEqual(got, want string) bool {
+	return hmac.Equal([]byte(got), []byte(want))
+}
+
 func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	http.SetCookie(w, &http.Cookie{
 		Name:   cookieNameIdentity,
@@ -36,6 +55,8 @@ func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request, _ httprou
 }
 
 func (s *Server) IndexHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := s.currentIdentity(r)
 
 	b := Bootstrap{
@@ -48,11 +69,13 @@ func (s *Server) IndexHandler(w http.ResponseWriter, r *http.Request, _ httprout
 		b,
 		env() == Dev,
 	}); err != nil {
-		log.Printf("execute index template: %s", err)
+		lg.Errorf("execute index template: %s", err)
 	}
 }
 
 func (s *Server) StartHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	// for hard visits, clear cookie and show login page
 	http.SetCookie(w, &http.Cookie{
 		Name:   cookieNameIdentity,
@@ -69,16 +92,19 @@ func (s *Server) StartHandler(w http.ResponseWriter, r *http.Request, _ httprout
 		b,
 		env() == Dev,
 	}); err != nil {
-		log.Printf("execute index template: %s", err)
+		lg.Errorf("execute index template: %s", err)
 	}
 }
 
 func (s *Server) FeedHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := s.currentIdentity(r)
 	if email == "" {
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
+	lg = lg.With("account", accountHash(email))
 
 	b := Bootstrap{
 		LoggedIn: email != "",
@@ -90,11 +116,13 @@ func (s *Server) FeedHandler(w http.ResponseWriter, r *http.Request, _ httproute
 		b,
 		env() == Dev,
 	}); err != nil {
-		log.Printf("execute index template: %s", err)
+		lg.Errorf("execute index template: %s", err)
 	}
 }
 
 func (s *Server) UnsubHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
 	email := r.FormValue("email")
 	if email == "" {
 		http.Error(w, "missing email", http.StatusBadRequest)
@@ -107,15 +135,17 @@ func (s *Server) UnsubHandler(w http.ResponseWriter, r *http.Request, _ httprout
 		return
 	}
 
+	lg = lg.With("account", accountHash(email))
+
 	wantToken, err := s.redis.Get(unsubTokenKey(email)).Result()
 	if err != nil {
-		log.Printf("GET unsub token: %s", err)
+		lg.Errorf("GET unsub token: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	if token != wantToken {
-		log.Printf("unsub token mismatch")
+		lg.Warningf("unsub token mismatch")
 		http.Error(w, "token mismatch", http.StatusForbidden)
 		return
 	}
@@ -126,12 +156,12 @@ func (s *Server) UnsubHandler(w http.ResponseWriter, r *http.Request, _ httprout
 		return a
 	})
 	if err == redis.Nil {
-		log.Printf("unsub: no such account %s", email)
+		lg.Warningf("unsub: no such account")
 		http.Error(w, "no such account", http.StatusNotFound)
 		return
 	}
 	if err != nil {
-		log.Printf("update account: %s", err)
+		lg.Errorf("update account: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -139,7 +169,67 @@ func (s *Server) UnsubHandler(w http.ResponseWriter, r *http.Request, _ httprout
 	fmt.Fprintf(w, "successfully unsubscribed %s\n", email)
 }
 
+func (s *Server) UndoDeleteHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	lg := loggerFrom(r.Context())
+
+	email := r.FormValue("email")
+	if email == "" {
+		http.Error(w, "missing email", http.StatusBadRequest)
+		return
+	}
+
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "missing token", http.StatusBadRequest)
+		return
+	}
+
+	lg = lg.With("account", accountHash(email))
+
+	wantToken, err := s.redis.Get(undoDeleteTokenKey(email)).Result()
+	if err == redis.Nil {
+		http.Error(w, "no pending deletion; the account may have already been deleted", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		lg.Errorf("GET undo delete token: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if !tokenEqual(token, wantToken) {
+		lg.Warningf("undo delete token mismatch")
+		http.Error(w, "token mismatch", http.StatusForbidden)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		if err := confirmTmpl.Execute(w, ConfirmTmplArgs{
+			AppName: AppName,
+			Title:   "Restore account",
+			Message: fmt.Sprintf("Cancel the pending deletion of the account %s?", email),
+			Action:  "/undo-delete",
+			Fields:  map[string]string{"email": email, "token": token},
+			Button:  "Restore account",
+		}); err != nil {
+			lg.Errorf("execute confirm template: %s", err)
+		}
+		return
+	}
+
+	if err := s.cancelAccountDeletion(r.Context(), email); err != nil {
+		lg.Errorf("cancel account deletion: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "successfully restored account %s\n", email)
+}
+
 func (s *Server) PreviewEmailHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	lg := loggerFrom(ctx)
+
 	const timestamp = 1599644061
 	t := time.Unix(timestamp, 0)
 
@@ -147,44 +237,56 @@ func (s *Server) PreviewEmailHandler(w http.ResponseWriter, r *http.Request, _ h
 
 	acc, err := getAccount(accountKey(email), s.redis)
 	if err != nil {
-		log.Printf("get account: %s", err)
+		lg.Errorf("get account: %s", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	if !acc.connectionComplete() {
-		log.Printf("connection incomplete")
+		lg.Errorf("connection incomplete")
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
 	conn := *acc.Connection
 
-	songs := s.getSongsFromCache(conn.Service, email)
+	songs := s.getSongsFromCache(ctx, conn.Service, email)
 	if songs == nil {
 		var err error
-		songs, err = FetchSongs(context.Background(), s.http, conn, s.config)
+		songs, err = s.fetchSongs(contextWithLogger(context.Background(), lg), email, conn)
 		if err != nil {
-			log.Printf("fetch songs: %s", err)
+			lg.Errorf("fetch songs: %s", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
 	}
-	s.putSongsToCache(conn.Service, email, songs)
+	s.putSongsToCache(ctx, conn.Service, email, songs)
+
+	mutes, err := s.getMutes(email)
+	if err != nil {
+		lg.Errorf("get mutes: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	songs = mutes.filterMuted(songs)
 
-	items := computeBirthdays(timestamp, time.UTC, songs)
+	day := computeBirthdays(timestamp, time.UTC, songs, acc.Settings.birthdayOptions(conn.Service))
+	s.setArtworkURLs(requestBaseURL(r), day.Items)
+	s.setCachedArtworkColors(ctx, day.Items)
 
 	err = emailTmpl.ExecuteTemplate(w, "base", EmailTmplArgs{
 		Today:         t,
 		AppVisitURL:   "https://" + AppDomain + "/feed",
-		BirthdayItems: items,
+		BirthdayItems: day.Items,
+		OmittedItems:  day.Omitted,
 		UnsubURL:      "",
+		MuteAlbumURL:  nil,
 		SupportEmail:  SupportEmail,
 		Browser:       true,
 		IsDev:         env() == Dev,
 	})
 	if err != nil {
-		log.Printf("execute email template: %s", err)
+		lg.Errorf("execute email template: %s", err)
 	}
 }
 
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUndoDeleteHandler(t *testing.T) {
+	s, _ := newTestServer(t)
+	const email = "a@example.com"
+	const token = "undo-token"
+	pending := Account{Deletion: &PendingDeletion{Requested: 1, Purge: time.Now().Add(time.Hour).Unix()}}
+
+	reset := func(t *testing.T) {
+		putTestAccount(t, s, email, pending)
+		if err := s.redis.Set(undoDeleteTokenKey(email), token, 0).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deletionPending := func(t *testing.T) bool {
+		acc, err := getAccount(accountKey(email), s.redis)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acc.pendingDeletion()
+	}
+	form := url.Values{"email": {email}, "token": {token}}
+
+	t.Run("GET renders confirmation", func(t *testing.T) {
+		reset(t)
+		rec := httptest.NewRecorder()
+		s.UndoDeleteHandler(rec, httptest.NewRequest("GET", "/undo-delete?"+form.Encode(), nil), nil)
+		if rec.Code != 200 {
+			t.Fatalf("status: got %d, want 200", rec.Code)
+		}
+		body := rec.Body.String()
+		for _, want := range []string{`method="POST"`, `action="/undo-delete"`, `value="undo-token"`} {
+			if !strings.Contains(body, want) {
+				t.Errorf("body missing %s: %s", want, body)
+			}
+		}
+		if !deletionPending(t) {
+			t.Errorf("GET canceled the deletion")
+		}
+	})
+
+	t.Run("POST cancels", func(t *testing.T) {
+		reset(t)
+		req := httptest.NewRequest("POST", "/undo-delete", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		s.UndoDeleteHandler(rec, req, nil)
+		if rec.Code != 200 {
+			t.Fatalf("status: got %d, want 200", rec.Code)
+		}
+		if deletionPending(t) {
+			t.Errorf("deletion still pending")
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		reset(t)
+		for _, method := range []string{"GET", "POST"} {
+			q := url.Values{"email": {email}, "token": {"wrong"}}
+			rec := httptest.NewRecorder()
+			s.UndoDeleteHandler(rec, httptest.NewRequest(method, "/undo-delete?"+q.Encode(), nil), nil)
+			if rec.Code != 403 {
+				t.Errorf("%s: status: got %d, want 403", method, rec.Code)
+			}
+		}
+		if !deletionPending(t) {
+			t.Errorf("deletion canceled")
+		}
+	})
+}
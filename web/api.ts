@@ -1,8 +1,17 @@
 import { assertExhaustive } from "./shared"
 
+// The server describes these types in its OpenAPI document, served at
+// /api/v1/openapi.json. Compare against it when changing them.
+
 export type Account = {
 	connection: Connection | null
 	settings: Settings
+	deletion: PendingDeletion | null
+}
+
+export type PendingDeletion = {
+	requested: number // unix seconds
+	purge: number // unix seconds
 }
 
 // NOTE: keep this in sync with the Service type.
@@ -33,14 +42,26 @@ export type ScrobbleConnection = {
 
 export type SpotifyConnection = {
 	service: "spotify"
-	refreshToken: string
 }
 
 export type Settings = {
 	emailsEnabled: boolean
 	emailFormat: "html" | "plain text"
+	// An album is included in birthdays only if it meets either threshold that
+	// is non-zero. Both are ignored for Spotify, which has neither play counts
+	// nor loved songs.
+	minPlayCount: number
+	minLovedCount: number
+	maxItems: number // 0 means no limit
+	sortMode: SortMode | "" // "" is treated as "most played"
+	excludeCompilations: boolean
+	yearReleases: boolean // include year-precision releases on 1 January
+	leapDay: "none" | "february 28" | "march 1" | "" // day to show 29 February releases in non-leap years; "" in older accounts, meaning "none"
+	monthReleases: "first day" | "any day" | "weekly" | "" // days to show month-precision releases; "" in older accounts
 }
 
+export type SortMode = "most played" | "oldest first" | "newest first"
+
 export function connectionComplete(a: Account): boolean {
 	return a.connection !== null
 }
@@ -52,26 +73,95 @@ export type Bootstrap = {
 
 export type CacheParam = "off" | "on"
 
-export type SuccessReleaseMatch = "day" | "month"
+export type SuccessReleaseMatch = "day" | "leap day" | "month" | "month any day" | "month weekly" | "year"
 
 export type ReleaseDate = {
 	year: number
-	month: number
-	day: number // or 0
+	month: number // or 0 if precision is "year"
+	day: number // or 0 if precision is "year" or "month"
+	precision: "day" | "month" | "year" | "" // "" in older cached data: "day" if day != 0, else "month"
+	ambiguous: boolean // whether the date may be a different date in another region
+}
+
+export type ArtworkURLs = {
+	email: string // 180px; or ""
+	thumbnail: string // 64px; or ""
 }
 
 export type BirthdayItem = {
-	artist: string
+	artist: string // joint credit for artists
+	artists: string[]
+	compilation: boolean // "Various Artists" compilation
 	album: string
 	release: ReleaseDate
 	link: string // or ""
 	artworkURL: string // or ""
 	releaseMatch: SuccessReleaseMatch
+	artwork: ArtworkURLs // resized artwork via the artwork proxy
+	color: string // dominant color of the artwork, "#rrggbb"; or ""
 
 	songs: {
 		title: string
 		link: string // or ""
+		artists: string[] | null // if different from the album's artists
 	}[]
 }
 
-export type BirthdayResponse = { [t: number]: BirthdayItem[] | null }
+// Muted artists and albums are excluded from birthdays and emails.
+export type Mutes = {
+	artists: MutedArtist[]
+	albums: MutedAlbum[]
+}
+
+export type MutedArtist = {
+	id: string
+	artist: string
+}
+
+export type MutedAlbum = {
+	id: string
+	artist: string
+	album: string
+}
+
+// Formats the artists as a joint credit, e.g. "A, B & C".
+// NOTE: keep this in sync with joinArtists in the server.
+export function joinArtists(artists: string[]): string {
+	if (artists.length <= 1) {
+		return artists.join("")
+	}
+	return artists.slice(0, -1).join(", ") + " & " + artists[artists.length - 1]
+}
+
+export type BirthdayDay = {
+	items: BirthdayItem[] | null
+	omitted: number // number of matching albums excluded by the settings
+}
+
+export type BirthdayResponse = { [t: number]: BirthdayDay }
+
+// NOTE: keep this in sync with the APIErrorCode type in the server.
+export type APIErrorCode =
+	| "bad_request"
+	| "unauthorized"
+	| "bad_passphrase"
+	| "invalid_fields" // details are a list of { field, message }
+	| "forbidden"
+	| "not_found"
+	| "too_many_tokens"
+	| "too_many_mutes"
+	| "rate_limited"
+	| "internal"
+	| "connection_required" // account has no music service connection
+	| "connection_permission" // insuffcient permissions, likely that profile is private
+	| "connection_not_found" // no such profile
+	| "connection_error" // generic error
+
+// The body of error responses from the /api/v1 and /connect endpoints.
+export type APIErrorResponse = {
+	error: {
+		code: APIErrorCode
+		message: string
+		details?: unknown
+	}
+}
@@ -1,5 +1,5 @@
 import React from "react"
-import { Account, connectionComplete, BirthdayResponse, BirthdayItem, Service } from "../../api"
+import { Account, connectionComplete, BirthdayResponse, BirthdayItem, Service, joinArtists } from "../../api"
 import { Connect } from "../connect"
 import { NProgressType } from "../../types"
 import { RouteComponentProps } from "react-router"
@@ -130,9 +130,9 @@ export class Feed extends React.Component<FeedProps, FeedState> {
 				case 200:
 					const result = await rsp.json() as BirthdayResponse
 					const data: BirthdayData = {
-						todayItems: result[today.getEpochSeconds()] || [],
-						tomorrowItems: result[tomorrow.getEpochSeconds()] || [],
-						overmorrowItems: result[overmorrow.getEpochSeconds()] || [],
+						todayItems: result[today.getEpochSeconds()]?.items || [],
+						tomorrowItems: result[tomorrow.getEpochSeconds()]?.items || [],
+						overmorrowItems: result[overmorrow.getEpochSeconds()]?.items || [],
 						todayTime: today.toDateTime(tzName),
 						tomorrowTime: tomorrow.toDateTime(tzName),
 						overmorrowTime: overmorrow.toDateTime(tzName),
@@ -149,7 +149,7 @@ export class Feed extends React.Component<FeedProps, FeedState> {
 						if (known.has(timestamp)) {
 							continue
 						}
-						data.extraItems = result[t]!
+						data.extraItems = result[t].items || []
 						data.extraTime = Temporal.Absolute.fromEpochSeconds(timestamp).toDateTime(tzName)
 					}
 
@@ -385,9 +385,10 @@ export class BirthdayItemComponent extends React.Component<{ item: BirthdayItem,
 		return songs.map((s, i) => {
 			const punct = i === songs.length - 1 ? "" : <>,&nbsp;</>
 			const song = <span className="song">{s.title}</span>
+			const artists = s.artists ? <span className="song-artists"> ({joinArtists(s.artists)})</span> : null
 			return s.link ?
-				<span key={s.link}><a href={s.link} target="_blank">{song}</a>{punct}</span> :
-				<span key={s.link}>{song}{punct}</span>
+				<span key={s.link}><a href={s.link} target="_blank">{song}</a>{artists}{punct}</span> :
+				<span key={s.link}>{song}{artists}{punct}</span>
 		})
 	}
 
@@ -407,7 +408,7 @@ export class BirthdayItemComponent extends React.Component<{ item: BirthdayItem,
 
 	render() {
 		const { item } = this.props
-		const artStyle = item.artworkURL ? { backgroundImage: "url(" + item.artworkURL + ")" } : { backgroundColor: "#e5e5e5" }
+		const artStyle = item.artworkURL ? { backgroundImage: "url(" + item.artworkURL + ")", backgroundColor: item.color || "#e5e5e5" } : { backgroundColor: "#e5e5e5" }
 		const artDesc = item.artworkURL ? "Artwork" : "Missing artwork"
 		const art = <div role="img" alt={artDesc + " for album + '" + item.album + "'"} className="art" style={artStyle}></div>
 		const album = <span className="album">{item.album}</span>
@@ -429,7 +430,9 @@ export class BirthdayItemComponent extends React.Component<{ item: BirthdayItem,
 					{<span className="years-badge" style={yearsBadgeStyles}>
 						{this.yearsAgoDisplay()}
 					</span>}
-					{item.releaseMatch == "month" && <span className="release-match">&nbsp;— this month</span>}
+					{item.releaseMatch == "leap day" && <span className="release-match">&nbsp;— released on 29 February</span>}
+					{(item.releaseMatch == "month" || item.releaseMatch == "month any day" || item.releaseMatch == "month weekly") && <span className="release-match">&nbsp;— this month</span>}
+					{item.releaseMatch == "year" && <span className="release-match">&nbsp;— this year (exact date unknown)</span>}
 				</div>
 				<div className="r2">
 					<span className="songs"><span className="emph">Songs:&nbsp;&nbsp;{this.songList()}</span></span>
@@ -1,5 +1,5 @@
 import React from "react"
-import { Account, Service, connectionComplete, Connection } from "../../api"
+import { Account, Service, connectionComplete, Connection, Settings as AccountSettings } from "../../api"
 import { colors, defaultToastOptions, scrobbleBaseURL, supportEmail, cookieBorkedNavPath } from "../../util"
 import { assertExhaustive } from "../../shared"
 import { NProgressType } from "../../types"
@@ -112,29 +112,29 @@ export class Settings extends React.Component<SettingsProps> {
 	private async setEmailNotifications(on: boolean) {
 		try {
 			this.requestStart()
-			const r = await fetch("/api/v1/account/email-notifications", {
-				method: "PUT",
+			const patch: Partial<AccountSettings> = { emailsEnabled: on }
+			const r = await fetch("/api/v1/account/settings", {
+				method: "PATCH",
 				signal: this.abort.signal,
 				headers: {
 					"content-type": "application/json",
 				},
-				body: JSON.stringify(on),
+				body: JSON.stringify(patch),
 			})
 			this.requestEnd()
 			switch (r.status) {
-				case 200:
+				case 200: {
+					const settings: AccountSettings = await r.json()
 					Toastify({
 						...defaultToastOptions,
 						text: "Updated!",
 					}).showToast()
 					this.props.onAccountChange({
 						...this.props.account,
-						settings: {
-							...this.props.account.settings,
-							emailsEnabled: on,
-						},
+						settings,
 					})
 					break
+				}
 				case 401:
 				case 403:
 					// cookie expired or malicious request?